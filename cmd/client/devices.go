@@ -0,0 +1,186 @@
+package main
+
+import (
+	"novachat-server/novaclient"
+	"novachat-server/novaprotocol"
+	"novachat-server/novaprotocol/serverapi"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rivo/tview"
+)
+
+// Link request waiting for /approve or /reject
+var pendingLink struct {
+	mutex   sync.Mutex
+	request *serverapi.DeviceLinkRequest
+}
+
+// Account of this device, messages it sent over earlier connections are ours too
+var ownAccount struct {
+	mutex sync.Mutex
+	id    uuid.UUID
+}
+
+func setOwnAccount(id uuid.UUID) {
+	ownAccount.mutex.Lock()
+	ownAccount.id = id
+	ownAccount.mutex.Unlock()
+}
+
+// isOwnMessage tells whether stored message was sent by us, in this connection or by our account
+func isOwnMessage(m serverapi.StoredMessage) bool {
+	ownAccount.mutex.Lock()
+	defer ownAccount.mutex.Unlock()
+	return m.Origin == client.GetID() || (ownAccount.id != uuid.Nil && m.Author == ownAccount.id)
+}
+
+// signIn signs in with saved device credentials, if there are any
+func signIn() {
+	if *deviceFlag == "" {
+		return
+	}
+	creds, err := novaclient.LoadCredentials(*deviceFlag)
+	if err != nil {
+		logf("[red]%s", err.Error())
+		return
+	}
+	if creds == nil {
+		logf("[gray]no device credentials, use /account <device name> or /link <code> <device name>")
+		return
+	}
+	if err := sendServer(novaprotocol.MSG_DEVICE_LOGIN, creds); err != nil {
+		logf("[red]failed to sign in: %s", err.Error())
+		return
+	}
+	setOwnAccount(creds.Account)
+}
+
+func runDeviceCommand(cmd, arg string) {
+	var err error
+	switch cmd {
+	case "/account":
+		err = sendServer(novaprotocol.MSG_ACCOUNT_CREATE, &serverapi.AccountCreate{DeviceName: arg})
+	case "/link":
+		// Without arguments asks for code to show on this device, with them links this device
+		if arg == "" {
+			err = sendServer(novaprotocol.MSG_DEVICE_LINK_CODE, struct{}{})
+			break
+		}
+		code, name, _ := strings.Cut(arg, " ")
+		err = sendServer(novaprotocol.MSG_DEVICE_LINK, &serverapi.DeviceLink{Code: code, Name: name})
+	case "/approve", "/reject":
+		pendingLink.mutex.Lock()
+		request := pendingLink.request
+		pendingLink.request = nil
+		pendingLink.mutex.Unlock()
+		if request == nil {
+			logf("[red]no pending link request")
+			return
+		}
+		err = sendServer(novaprotocol.MSG_DEVICE_LINK_CONFIRM, &serverapi.DeviceLinkConfirm{Code: request.Code, Approve: cmd == "/approve"})
+	case "/devices":
+		err = sendServer(novaprotocol.MSG_DEVICE_LIST, struct{}{})
+	case "/revoke":
+		id, perr := uuid.Parse(arg)
+		if perr != nil {
+			logf("[red]usage: /revoke <device id>")
+			return
+		}
+		err = sendServer(novaprotocol.MSG_DEVICE_REVOKE, &serverapi.DeviceRevoke{ID: id})
+	}
+	if err != nil {
+		logf("[red]failed to send %s: %s", cmd, err.Error())
+	}
+}
+
+// saveDevice keeps credentials of created or linked device
+func saveDevice(creds *serverapi.DeviceCredentials) {
+	setOwnAccount(creds.Account)
+	logf("[green]signed in as device [%s[] of account [%s[]", creds.Device.String(), creds.Account.String())
+	if *deviceFlag == "" {
+		logf("[yellow]credentials are not saved, start with -device <file> to keep them")
+		return
+	}
+	if err := novaclient.SaveCredentials(*deviceFlag, creds); err != nil {
+		logf("[red]%s", err.Error())
+	}
+}
+
+func formatDevice(d serverapi.Device) string {
+	state := "[gray]offline"
+	switch {
+	case !d.RevokedAt.IsZero():
+		state = "[red]revoked " + d.RevokedAt.Local().Format(time.DateTime)
+	case d.Client == client.GetID():
+		state = "[green]this device"
+	case d.Client != uuid.Nil:
+		state = "[green]online"
+	}
+	return "[blue]" + d.ID.String() + " [white]" + tview.Escape(d.Name) + " " + state
+}
+
+func handleDeviceMessage(msgType string, data []byte) {
+	switch msgType {
+	case novaprotocol.MSG_ACCOUNT_CREATE, novaprotocol.MSG_DEVICE_LINK:
+		creds, err := novaprotocol.ParseJsonMessage[serverapi.DeviceCredentials](data)
+		if err != nil || creds == nil {
+			logf("[red]failed to parse message: %v", err)
+			return
+		}
+		saveDevice(creds)
+
+	case novaprotocol.MSG_DEVICE_LOGIN:
+		d, err := novaprotocol.ParseJsonMessage[serverapi.Device](data)
+		if err != nil || d == nil {
+			logf("[red]failed to parse message: %v", err)
+			return
+		}
+		logf("[green]signed in as device %s", tview.Escape(d.Name))
+
+	case novaprotocol.MSG_DEVICE_LINK_CODE:
+		code, err := novaprotocol.ParseJsonMessage[serverapi.DeviceLinkCode](data)
+		if err != nil || code == nil {
+			logf("[red]failed to parse message: %v", err)
+			return
+		}
+		chatf("[yellow]enter [white]/link %s-%s <device name>[yellow] on new device until %s",
+			code.Code[:len(code.Code)/2], code.Code[len(code.Code)/2:], code.ExpiresAt.Local().Format(time.TimeOnly))
+
+	case novaprotocol.MSG_DEVICE_LINK_REQUEST:
+		request, err := novaprotocol.ParseJsonMessage[serverapi.DeviceLinkRequest](data)
+		if err != nil || request == nil {
+			logf("[red]failed to parse message: %v", err)
+			return
+		}
+		pendingLink.mutex.Lock()
+		pendingLink.request = request
+		pendingLink.mutex.Unlock()
+		chatf("[yellow]device [white]%s[yellow] from %s wants to join your account, /approve or /reject",
+			tview.Escape(request.Name), request.RemoteAddr)
+
+	case novaprotocol.MSG_DEVICE_LINK_CONFIRM:
+		logf("[green]link request answered")
+
+	case novaprotocol.MSG_DEVICE_LIST:
+		devices, err := novaprotocol.ParseJsonMessage[[]serverapi.Device](data)
+		if err != nil || devices == nil {
+			logf("[red]failed to parse message: %v", err)
+			return
+		}
+		chatf("[gray]--- devices ---")
+		for _, d := range *devices {
+			chatf("%s", formatDevice(d))
+		}
+
+	case novaprotocol.MSG_DEVICE_REVOKE:
+		d, err := novaprotocol.ParseJsonMessage[serverapi.Device](data)
+		if err != nil || d == nil {
+			logf("[red]failed to parse message: %v", err)
+			return
+		}
+		logf("[green]revoked device %s", tview.Escape(d.Name))
+	}
+}
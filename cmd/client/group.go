@@ -0,0 +1,148 @@
+package main
+
+import (
+	"novachat-server/novaclient/senderkey"
+	"novachat-server/novaprotocol"
+	"novachat-server/novaprotocol/handshake"
+	"novachat-server/novaprotocol/serverapi"
+	"slices"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Sender keys of common chat room, every member encrypts its messages once and server multicasts them
+var groupKeys = senderkey.NewKeyring()
+
+// Common chat room, nil id until server acknowledges join
+var lobby struct {
+	mutex sync.Mutex
+	room  serverapi.Room
+	// Other members of room, whether or not they distributed their keys to us
+	members map[uuid.UUID]bool
+	// Members that got our current key
+	sentTo map[uuid.UUID]bool
+	// Members that joined before we exchanged pairwise keys with them
+	pending map[uuid.UUID]bool
+}
+
+func lobbyID() uuid.UUID {
+	lobby.mutex.Lock()
+	defer lobby.mutex.Unlock()
+	return lobby.room.ID
+}
+
+// joinLobby joins common chat room, without rooms support chat is encrypted for every peer separately
+func joinLobby() {
+	if *roomFlag == "" || !slices.Contains(client.GetCapabilities(), handshake.CapRooms) {
+		return
+	}
+	if err := sendServer(novaprotocol.MSG_ROOM_JOIN, &serverapi.RoomJoin{Name: *roomFlag}); err != nil {
+		logf("[red]failed to join room: %s", err.Error())
+	}
+}
+
+func onLobbyJoined(room serverapi.Room) {
+	lobby.mutex.Lock()
+	defer lobby.mutex.Unlock()
+	lobby.room = room
+	lobby.members = make(map[uuid.UUID]bool)
+	lobby.sentTo = make(map[uuid.UUID]bool)
+	lobby.pending = make(map[uuid.UUID]bool)
+	logf("[green]joined room %s, messages are encrypted with sender keys", room.Name)
+}
+
+// sendDistribution sends our current key to member over pairwise channel, caller holds lobby mutex
+func sendDistribution(member uuid.UUID) {
+	userInfo, ok := usersInfo.Get(member)
+	if !ok || userInfo.Key == nil {
+		lobby.pending[member] = true
+		return
+	}
+	d, err := groupKeys.Distribution(lobby.room.ID)
+	if err == nil {
+		err = sendPeer(member, userInfo.Key, senderkey.MSG_DISTRIBUTION, d)
+	}
+	if err != nil {
+		logf("[red]failed to send sender key: %s", err.Error())
+		return
+	}
+	lobby.sentTo[member] = true
+}
+
+// onMemberJoined gives newcomer our key. Chain only moves forward, so it can not read earlier messages
+func onMemberJoined(room, member uuid.UUID) {
+	lobby.mutex.Lock()
+	defer lobby.mutex.Unlock()
+	if room != lobby.room.ID || room == uuid.Nil {
+		return
+	}
+	lobby.members[member] = true
+	sendDistribution(member)
+}
+
+// onPeerKey sends key to member waiting for pairwise channel
+func onPeerKey(peer uuid.UUID) {
+	lobby.mutex.Lock()
+	defer lobby.mutex.Unlock()
+	if !lobby.pending[peer] {
+		return
+	}
+	delete(lobby.pending, peer)
+	sendDistribution(peer)
+}
+
+// onDistribution stores key of member and answers with ours, so newcomer learns keys of everyone
+func onDistribution(origin uuid.UUID, data []byte) {
+	d, err := novaprotocol.ParseJsonMessage[senderkey.Distribution](data)
+	if err != nil || d == nil {
+		logf("[red]failed to parse message: %v", err)
+		return
+	}
+	lobby.mutex.Lock()
+	defer lobby.mutex.Unlock()
+	if d.Group != lobby.room.ID || d.Group == uuid.Nil {
+		return
+	}
+	if err := groupKeys.Receive(origin, d); err != nil {
+		logf("[red]invalid sender key from %s: %s", origin, err.Error())
+		return
+	}
+	lobby.members[origin] = true
+	if !lobby.sentTo[origin] {
+		sendDistribution(origin)
+	}
+}
+
+// onMemberLeft rotates our key, so member that left can not read further messages
+func onMemberLeft(room, member uuid.UUID) {
+	lobby.mutex.Lock()
+	defer lobby.mutex.Unlock()
+	if room != lobby.room.ID || room == uuid.Nil {
+		return
+	}
+	delete(lobby.pending, member)
+	known := lobby.members[member]
+	delete(lobby.members, member)
+	if !groupKeys.Remove(room, member) && !lobby.sentTo[member] && !known {
+		return
+	}
+	if _, err := groupKeys.Rotate(room); err != nil {
+		logf("[red]failed to rotate sender key: %s", err.Error())
+		return
+	}
+	// Members that have not distributed their keys yet still need ours
+	lobby.sentTo = make(map[uuid.UUID]bool)
+	for m := range lobby.members {
+		sendDistribution(m)
+	}
+}
+
+// groupFrame builds l1 frame encrypted once for every member of room
+func groupFrame[T any](room uuid.UUID, msgType string, data T) ([]byte, error) {
+	msg, err := novaprotocol.NewJsonMessage(msgType, data)
+	if err != nil {
+		return nil, err
+	}
+	return novaprotocol.NewL1Frame(novaprotocol.L1FlagIsJson|novaprotocol.L1FlagIsEncrypted, msg).Build(groupKeys.EncryptFunc(room))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"novachat-server/novaclient/keystore"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// Encrypted keystore, nil when client runs without -keystore
+var keys keystore.Keystore
+
+// Shared by prompts before terminal is taken by UI
+var stdin = bufio.NewReader(os.Stdin)
+
+// readPassphrase reads passphrase without echo, piped input is read line by line
+func readPassphrase(prompt string) ([]byte, error) {
+	fmt.Print(prompt)
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		defer fmt.Println()
+		return term.ReadPassword(fd)
+	}
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return nil, err
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
+
+// openKeystore unlocks keystore and takes identity, session key pair and contacts from it
+func openKeystore() error {
+	_, err := os.Stat(*keystoreFlag)
+	prompt := "Keystore passphrase: "
+	if os.IsNotExist(err) {
+		prompt = "New keystore passphrase: "
+	}
+	passphrase, err := readPassphrase(prompt)
+	if err != nil {
+		return err
+	}
+	defer clear(passphrase)
+
+	keys = keystore.Open(*keystoreFlag)
+	if err := keys.Unlock(passphrase); err != nil {
+		return err
+	}
+	if *restoreFlag != "" {
+		if err := restoreKeystore(*restoreFlag); err != nil {
+			return err
+		}
+	}
+
+	if ownIdentity, err = keys.Identity(); err != nil {
+		return err
+	}
+	if priv, pub, err = keys.SessionKeyPair(); err != nil {
+		return err
+	}
+	contacts = keys
+	return nil
+}
+
+// restoreKeystore replaces keys with backup, backup may have its own passphrase
+func restoreKeystore(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer f.Close()
+	passphrase, err := readPassphrase("Backup passphrase: ")
+	if err != nil {
+		return err
+	}
+	defer clear(passphrase)
+	return keys.Import(f, passphrase)
+}
+
+// rememberSessionKey keeps shared key of peer, earlier keys still open history after restart
+func rememberSessionKey(name string, key []byte) {
+	if keys == nil || name == "" {
+		return
+	}
+	if err := keys.SetSessionKey(name, key); err != nil {
+		logf("[red]%s", err.Error())
+	}
+}
+
+// openStoredFrame opens history frame with current key of peer, then with keys of earlier sessions from keystore
+func openStoredFrame(peer *UserInfo, frame []byte) (string, []byte, error) {
+	candidates := [][]byte{peer.Key}
+	if keys != nil && peer.Name != "" {
+		if p, ok := keys.Peer(peer.Name); ok {
+			candidates = append(candidates, p.SessionKey)
+			candidates = append(candidates, p.PreviousKeys...)
+		}
+	}
+	err := fmt.Errorf("no session key of %s", peer.Name)
+	for _, key := range candidates {
+		if key == nil {
+			continue
+		}
+		var msgType string
+		var data []byte
+		if msgType, data, err = openPeerFrame(key, frame); err == nil {
+			return msgType, data, nil
+		}
+	}
+	return "", nil, err
+}
+
+func runBackupCommand(arg string) {
+	if keys == nil {
+		logf("[red]no keystore, start client with -keystore")
+		return
+	}
+	if arg == "" {
+		logf("[red]usage: /backup <file>")
+		return
+	}
+	f, err := os.OpenFile(arg, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err == nil {
+		err = keys.Export(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		logf("[red]failed to back up keystore: %s", err.Error())
+		return
+	}
+	logf("[green]keystore backed up to %s, it is encrypted with the same passphrase", arg)
+}
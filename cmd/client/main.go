@@ -1,82 +1,228 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
 	"math/big"
 	"novachat-server/common/safemap"
-	"novachat-server/protocol"
+	"novachat-server/novaclient"
+	"novachat-server/novaclient/history"
+	"novachat-server/novaclient/senderkey"
+	"novachat-server/novaprotocol"
+	"novachat-server/novaprotocol/chatapi"
+	"novachat-server/novaprotocol/handshake"
+	"novachat-server/novaprotocol/serverapi"
+	"os"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gdamore/tcell/v2"
 	"github.com/google/uuid"
 	"github.com/rivo/tview"
-	"golang.org/x/net/websocket"
 )
 
-var sendChan = make(chan protocol.Packet, 10)
-var recvChan = make(chan protocol.Packet, 10)
+// Peer to peer key exchange, server only relays it. Chat messages follow chatapi
+const (
+	msgPeerPub = "peer_pub"
+)
+
+// PeerPublicKey is session key signed by identity key of sender
+type PeerPublicKey struct {
+	Pub       string            `json:"pub"`
+	Identity  ed25519.PublicKey `json:"identity,omitempty"`
+	Signature []byte            `json:"signature,omitempty"`
+}
 
-var name = ""
-var userId uuid.UUID
+var (
+	serverURL    = flag.String("url", "ws://localhost:8080/ws", "server url, ws:// or wss:// websocket, tcp:// or tls:// raw transport")
+	caFile       = flag.String("ca", "", "PEM file with additional CA certificates trusted for wss://")
+	nickFlag     = flag.String("nick", "", "nickname")
+	tokenFlag    = flag.String("token", "", "join token, if server requires one")
+	historyFlag  = flag.String("history", "", "file keeping decrypted messages for /search, empty keeps them in memory only")
+	deviceFlag   = flag.String("device", "", "file keeping credentials of this device, it signs in with them on start")
+	roomFlag     = flag.String("room", "lobby", "room of common chat, empty sends every message to every peer separately")
+	identityFlag = flag.String("identity", "", "file keeping identity key, empty generates new one every start and safety numbers change")
+	contactsFlag = flag.String("contacts", "", "file keeping identity keys of peers and verified contacts, empty keeps them in memory only")
+	keystoreFlag = flag.String("keystore", "", "passphrase encrypted file keeping identity, session keys and contacts, replaces -identity and -contacts")
+	restoreFlag  = flag.String("restore", "", "keystore backup made by /backup, it replaces keys of -keystore on start")
+)
+
+var client novaclient.Client
 
 var app = tview.NewApplication()
 var header, chatView, logsView *tview.TextView
 var inputField *tview.InputField
 
+// Key pair for peer to peer key exchange
 var priv, pub *big.Int
 
 type UserInfo struct {
-	Key  []byte
-	Name string
+	Key      []byte
+	Name     string
+	Identity ed25519.PublicKey
 }
 
 var usersInfo = safemap.New[uuid.UUID, *UserInfo]()
 
 func main() {
-	// Generate private key
+	flag.Parse()
+
 	var err error
-	priv, pub, err = protocol.GenerateKeyPair()
+	priv, pub, err = handshake.GenerateKeyPair(handshake.Generator2048, handshake.Prime2048)
 	if err != nil {
 		panic(fmt.Errorf("failed to generate keys pair: %w", err))
 	}
+	if err := loadIdentity(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if keys != nil {
+		defer keys.Lock()
+	}
+
+	name := *nickFlag
+	if name == "" {
+		fmt.Printf("Enter your name: ")
+		name, _ = stdin.ReadString('\n')
+		name = strings.TrimSpace(name)
+	}
 
-	client, err := websocket.Dial("ws://150.241.114.101:8080/ws", "", "ws://150.241.114.101:123")
+	cfg := novaclient.Config{
+		URL:       *serverURL,
+		Nickname:  name,
+		JoinToken: *tokenFlag,
+	}
+	if *caFile != "" {
+		cfg.RootCAs, err = novaclient.LoadCertPool(*caFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	client, err = novaclient.Dial(ctx, cfg)
+	cancel()
 	if err != nil {
-		panic(err)
+		var serverErr *novaclient.ServerError
+		if errors.As(err, &serverErr) {
+			fmt.Printf("Server rejected connection: %s\n", serverErr.Message)
+		} else {
+			fmt.Println(err)
+		}
+		os.Exit(1)
 	}
 	defer client.Close()
 
-	fmt.Printf("Enter your name: ")
-	fmt.Scanln(&name)
+	localHistory, err = history.Open(*historyFlag)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer localHistory.Close()
 
-	// Send presense
-	{
-		buf, err := protocol.NewPresenseRequest(&protocol.PresenseRequest{
-			Name: name,
-		})
-		if err != nil {
-			panic("failed to make presense request")
+	go framesHandler()
+	go signIn()
+	go joinLobby()
+	// Ask for everyone online, we start key exchange with them
+	go func() {
+		if err := sendServer(novaprotocol.MSG_LIST_CONN, struct{}{}); err != nil {
+			logf("[red]failed to list connections: %s", err.Error())
 		}
-		sendChan <- protocol.NewPacket(protocol.Servercast, buf, protocol.PacketParams{})
+	}()
+	runApp()
+}
+
+func logf(format string, args ...any) {
+	app.QueueUpdateDraw(func() {
+		fmt.Fprintf(logsView, format+"\n", args...)
+		logsView.ScrollToEnd()
+	})
+}
+
+func chatf(format string, args ...any) {
+	app.QueueUpdateDraw(func() {
+		fmt.Fprintf(chatView, format+"\n", args...)
+		chatView.ScrollToEnd()
+	})
+}
+
+func sendServer[T any](msgType string, data T) error {
+	msg, err := novaprotocol.NewJsonMessage(msgType, data)
+	if err != nil {
+		return err
 	}
+	return client.SendServer(msg)
+}
 
-	go runClient(client)
-	go packetsHandler(client)
-	runApp()
+// peerFrame builds l1 frame with json message, encrypted with peer key if it is given
+func peerFrame[T any](key []byte, msgType string, data T) ([]byte, error) {
+	msg, err := novaprotocol.NewJsonMessage(msgType, data)
+	if err != nil {
+		return nil, err
+	}
+	flags := novaprotocol.L1FlagIsJson
+	var encrypt novaprotocol.CryptFunc
+	if key != nil {
+		flags |= novaprotocol.L1FlagIsEncrypted
+		encrypt, _ = novaprotocol.NewCryptoFuncs(key)
+	}
+	return novaprotocol.NewL1Frame(flags, msg).Build(encrypt)
 }
 
-func runApp() {
-	// Создаем элементы интерфейса
+// sendPeer sends json message to peer, encrypted with peer key if it is given
+func sendPeer[T any](peer uuid.UUID, key []byte, msgType string, data T) error {
+	l1, err := peerFrame(key, msgType, data)
+	if err != nil {
+		return err
+	}
+	return client.SendPeer(peer, l1)
+}
 
+// sendStored sends encrypted chat message to peer, through server history if server keeps it.
+// Op carries message id and reply, destination and frame are filled here
+func sendStored[T any](peer uuid.UUID, key []byte, opType string, op serverapi.MessageOp, msgType string, data T) error {
+	l1, err := peerFrame(key, msgType, data)
+	if err != nil {
+		return err
+	}
+	return sendFrame(peer, opType, op, l1)
+}
+
+// sendFrame sends l1 frame of chat message to peer or room, through server history if server keeps it
+func sendFrame(destination uuid.UUID, opType string, op serverapi.MessageOp, l1 []byte) error {
+	if !slices.Contains(client.GetCapabilities(), handshake.CapHistory) {
+		return client.SendPeer(destination, l1)
+	}
+	op.Destination, op.Frame = destination, l1
+	return sendServer(opType, &op)
+}
+
+// openPeerFrame decrypts l1 frame exchanged with peer and returns its json message
+func openPeerFrame(key []byte, frame []byte) (string, []byte, error) {
+	_, decrypt := novaprotocol.NewCryptoFuncs(key)
+	l1, err := novaprotocol.ParseL1Frame(frame, decrypt)
+	if err != nil {
+		return "", nil, err
+	}
+	msgType, err := novaprotocol.ParseJsonMessageType(l1.GetData())
+	return msgType, l1.GetData(), err
+}
+
+func runApp() {
 	header = tview.NewTextView().
 		SetTextAlign(tview.AlignLeft).
 		SetRegions(false).
 		SetWordWrap(true).
 		SetDynamicColors(true).
 		SetMaxLines(1)
-
 	header.SetBackgroundColor(tcell.ColorSilver)
+	header.SetText(fmt.Sprintf("[black][%s[] %s", client.GetID().String(), client.GetNickname()))
 
 	logsView = tview.NewTextView().
 		SetDynamicColors(true).
@@ -103,263 +249,476 @@ func runApp() {
 				AddItem(logsView, 0, 1, false), 0, 1, false).
 		AddItem(inputField, 1, 1, true)
 
-	// Обработка ввода
 	inputField.SetDoneFunc(func(key tcell.Key) {
-		if key == tcell.KeyEnter {
-			defer inputField.SetText("")
-			text := inputField.GetText()
-			if text != "" {
-				go func() {
-					msg, err := protocol.NewChatMessage(&protocol.ChatMessage{
-						Text: text,
-					})
-					if err != nil {
-						app.QueueUpdateDraw(func() {
-							fmt.Fprintf(logsView, "[red]failed to create message: %s\n", err.Error())
-							logsView.ScrollToEnd()
-						})
-					}
-					usersInfo.Foreach(func(u uuid.UUID, ui *UserInfo) {
-						uMsg, err := protocol.EncryptAES256(ui.Key, msg)
-						if err != nil {
-							app.QueueUpdateDraw(func() {
-								fmt.Fprintf(logsView, "[red]failed to encrypt message for user: %s\n", err.Error())
-								logsView.ScrollToEnd()
-							})
-							return
-						}
-						sendChan <- protocol.NewPacket(u, uMsg, protocol.PacketParams{IsEncrytpted: true})
-					})
-					app.QueueUpdateDraw(func() {
-						fmt.Fprintf(chatView, "[yellow][LOCAL[][green][%s[][white]: %s\n", name, text)
-						chatView.ScrollToEnd()
-					})
-				}()
-			}
+		if key != tcell.KeyEnter {
+			return
 		}
+		text := inputField.GetText()
+		inputField.SetText("")
+		if text == "" {
+			return
+		}
+		if strings.HasPrefix(text, "/") {
+			go runCommand(text)
+			return
+		}
+		go sendChat(text)
 	})
 	if err := app.SetRoot(flex, true).Run(); err != nil {
 		panic(err)
 	}
 }
 
-func runClient(conn *websocket.Conn) {
-	// Send packets
-	go func() {
-		for packet := range sendChan {
-			protocol.WritePacket(conn, packet)
+func runCommand(text string) {
+	cmd, arg, _ := strings.Cut(text, " ")
+	switch cmd {
+	case "/nick":
+		if err := sendServer(novaprotocol.MSG_NICKNAME_CHANGE, &serverapi.NicknameChange{Nickname: arg}); err != nil {
+			logf("[red]failed to change nickname: %s", err.Error())
 		}
-	}()
+	case "/edit":
+		id := lastMessages.sentID()
+		if id == uuid.Nil || arg == "" {
+			logf("[red]nothing to edit")
+			return
+		}
+		broadcastChat(novaprotocol.MSG_MESSAGE_EDIT, id, chatapi.MSG_EDIT, &chatapi.Edit{Version: chatapi.Version, ID: id, EditedAt: time.Now().UTC(), Text: arg})
+		chatf("[yellow][LOCAL[][green][%s[][white]: %s [gray](edited)", client.GetNickname(), tview.Escape(arg))
+	case "/delete":
+		id := lastMessages.sentID()
+		if id == uuid.Nil {
+			logf("[red]nothing to delete")
+			return
+		}
+		broadcastChat(novaprotocol.MSG_MESSAGE_DELETE, id, chatapi.MSG_DELETE, &chatapi.Delete{Version: chatapi.Version, ID: id, DeletedAt: time.Now().UTC()})
+		chatf("[yellow][LOCAL[][green][%s[][gray]: deleted a message", client.GetNickname())
+	case "/reply":
+		// Reply goes to author of the last received message, in its thread
+		origin, id := lastMessages.receivedID()
+		userInfo, ok := usersInfo.Get(origin)
+		if !ok || userInfo.Key == nil || arg == "" {
+			logf("[red]nothing to reply to")
+			return
+		}
+		msg := chatapi.NewMessage(arg)
+		msg.ReplyTo = id
+		if err := sendStored(origin, userInfo.Key, novaprotocol.MSG_MESSAGE_SEND, serverapi.MessageOp{ID: msg.ID, ReplyTo: id}, chatapi.MSG_CHAT, msg); err != nil {
+			logf("[red]failed to reply: %s", err.Error())
+			return
+		}
+		if data, err := novaprotocol.NewJsonMessage(chatapi.MSG_CHAT, msg); err == nil {
+			remember(origin, client.GetID(), client.GetNickname(), chatapi.MSG_CHAT, data)
+		}
+		chatf("[yellow][LOCAL[][green][%s[][white]: [gray]↪ [white]%s", client.GetNickname(), tview.Escape(arg))
+	case "/history":
+		// Latest messages exchanged with peer, frames encrypted with keys of previous sessions stay unreadable
+		var peer uuid.UUID
+		usersInfo.Foreach(func(u uuid.UUID, ui *UserInfo) {
+			if ui.Name == arg {
+				peer = u
+			}
+		})
+		if peer == uuid.Nil {
+			logf("[red]unknown user: %s", arg)
+			return
+		}
+		if err := sendServer(novaprotocol.MSG_HISTORY, &serverapi.HistoryRequest{With: peer, Limit: 20}); err != nil {
+			logf("[red]failed to request history: %s", err.Error())
+		}
+	case "/account", "/link", "/approve", "/reject", "/devices", "/revoke":
+		runDeviceCommand(cmd, arg)
+	case "/search", "/more", "/open", "/export":
+		runSearchCommand(cmd, arg)
+	case "/verify":
+		runVerifyCommand(arg)
+	case "/backup":
+		runBackupCommand(arg)
+	case "/react":
+		// Reaction goes to author of the last received message
+		origin, id := lastMessages.receivedID()
+		userInfo, ok := usersInfo.Get(origin)
+		if !ok || userInfo.Key == nil || arg == "" {
+			logf("[red]nothing to react to")
+			return
+		}
+		reaction := &chatapi.Reaction{Version: chatapi.Version, ID: id, Reaction: arg}
+		if err := reaction.Validate(); err != nil {
+			logf("[red]failed to react: %s", err.Error())
+			return
+		}
+		if err := sendStored(origin, userInfo.Key, novaprotocol.MSG_MESSAGE_REACT, serverapi.MessageOp{ID: id}, chatapi.MSG_REACTION, reaction); err != nil {
+			logf("[red]failed to react: %s", err.Error())
+		}
+	default:
+		logf("[red]unknown command: %s", cmd)
+	}
+}
 
-	// Recv packets
-	go func() {
-		for {
-			packet, err := protocol.ReadPacket(conn)
-			if err != nil {
-				<-time.After(time.Millisecond * 50)
+// Last message we sent and last one we received, targets of /edit, /delete and /react
+type recentMessages struct {
+	mutex        sync.Mutex
+	sent         uuid.UUID
+	received     uuid.UUID
+	receivedFrom uuid.UUID
+}
+
+var lastMessages recentMessages
+
+func (r *recentMessages) sentID() uuid.UUID {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.sent
+}
+
+func (r *recentMessages) receivedID() (uuid.UUID, uuid.UUID) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.receivedFrom, r.received
+}
+
+// broadcastChat encrypts chat message once for common chat room,
+// or for every peer we exchanged keys with if there is no room
+func broadcastChat[T any](opType string, id uuid.UUID, msgType string, data T) {
+	if msg, err := novaprotocol.NewJsonMessage(msgType, data); err == nil {
+		remember(uuid.Nil, client.GetID(), client.GetNickname(), msgType, msg)
+	}
+	if room := lobbyID(); room != uuid.Nil {
+		l1, err := groupFrame(room, msgType, data)
+		if err == nil {
+			err = sendFrame(room, opType, serverapi.MessageOp{ID: id}, l1)
+		}
+		if err != nil {
+			logf("[red]failed to send message: %s", err.Error())
+		}
+		return
+	}
+	usersInfo.Foreach(func(u uuid.UUID, ui *UserInfo) {
+		if ui.Key == nil {
+			return
+		}
+		if err := sendStored(u, ui.Key, opType, serverapi.MessageOp{ID: id}, msgType, data); err != nil {
+			logf("[red]failed to send message to %s: %s", ui.Name, err.Error())
+		}
+	})
+}
+
+func sendChat(text string) {
+	msg := chatapi.NewMessage(text)
+	if err := msg.Validate(); err != nil {
+		logf("[red]failed to send message: %s", err.Error())
+		return
+	}
+	lastMessages.mutex.Lock()
+	lastMessages.sent = msg.ID
+	lastMessages.mutex.Unlock()
+	broadcastChat(novaprotocol.MSG_MESSAGE_SEND, msg.ID, chatapi.MSG_CHAT, msg)
+	chatf("[yellow][LOCAL[][green][%s[][white]: %s", client.GetNickname(), text)
+}
+
+func framesHandler() {
+	for frame := range client.Frames() {
+		l1, err := novaprotocol.ParseL1Frame(frame.GetData(), nil)
+		if err == nil && l1.GetFlags()&novaprotocol.L1FlagIsEncrypted != 0 && frame.GetDestination() == lobbyID() {
+			// Room payload, encrypted with sender key of origin
+			l1, err = novaprotocol.ParseL1Frame(frame.GetData(), groupKeys.DecryptFunc(frame.GetDestination(), frame.GetOrigin()))
+		} else if err == nil && l1.GetFlags()&novaprotocol.L1FlagIsEncrypted != 0 {
+			// Peer encrypted payload
+			userInfo, ok := usersInfo.Get(frame.GetOrigin())
+			if !ok || userInfo.Key == nil {
+				logf("[red]failed to decrypt message from %s, no key", frame.GetOrigin())
 				continue
 			}
-			recvChan <- packet
+			_, decrypt := novaprotocol.NewCryptoFuncs(userInfo.Key)
+			l1, err = novaprotocol.ParseL1Frame(frame.GetData(), decrypt)
 		}
-	}()
+		if err != nil {
+			logf("[red]failed to parse frame: %s", err.Error())
+			continue
+		}
+		if l1.GetFlags()&novaprotocol.L1FlagIsJson == 0 {
+			continue
+		}
+
+		msgType, err := novaprotocol.ParseJsonMessageType(l1.GetData())
+		if err != nil {
+			logf("[red]failed to parse message type: %s", err.Error())
+			continue
+		}
+
+		if frame.GetOrigin() == uuid.Nil {
+			handleServerMessage(msgType, l1.GetData())
+		} else {
+			handlePeerMessage(frame.GetOrigin(), msgType, l1.GetData(), l1.GetFlags()&novaprotocol.L1FlagIsEncrypted != 0)
+		}
+	}
+	logf("[red]connection lost: %v", client.Err())
 }
-func packetsHandler(conn *websocket.Conn) {
-	for recvPacket := range recvChan {
-
-		data := recvPacket.GetData()
-		if recvPacket.IsEncrypted() {
-			userInfo, ok := usersInfo.Get(recvPacket.GetOrigin())
-			if !ok {
-				log.Printf("failed to decrypt message from %s, no key\n", recvPacket.GetOrigin())
-				app.QueueUpdateDraw(func() {
-					fmt.Fprintf(logsView, "[red]failed to decrypt message from %s, no key\n", recvPacket.GetOrigin())
-					logsView.ScrollToEnd()
-				})
+
+func handleServerMessage(msgType string, data []byte) {
+	switch msgType {
+	case novaprotocol.MSG_LIST_CONN:
+		clients, err := novaprotocol.ParseJsonMessage[[]serverapi.Client](data)
+		if err != nil || clients == nil {
+			logf("[red]failed to parse message: %v", err)
+			return
+		}
+		for _, c := range *clients {
+			if c.ID == client.GetID() {
 				continue
 			}
-			decryptedData, err := protocol.DecryptAES256(userInfo.Key, data)
-			if err != nil {
-				app.QueueUpdateDraw(func() {
-					fmt.Fprintf(logsView, "[red]failed to decrypt message: %s\n", err.Error())
-					logsView.ScrollToEnd()
-				})
-				continue
+			usersInfo.Set(c.ID, &UserInfo{Name: c.Nickname})
+			logf("[red][SERVER[][white] USER [green][%s[] [red]%s[white] in chat", c.ID.String(), c.Nickname)
+			if err := sendPeer(c.ID, nil, msgPeerPub, ownPublicKey()); err != nil {
+				logf("[red]failed to send public key: %s", err.Error())
 			}
-			data = decryptedData
 		}
 
-		msgType, err := protocol.ParseMessageType(data)
-		if err != nil {
+	case novaprotocol.MSG_NEW_CONNECTION:
+		c, err := novaprotocol.ParseJsonMessage[serverapi.Client](data)
+		if err != nil || c == nil {
+			logf("[red]failed to parse message: %v", err)
+			return
+		}
+		// Newcomer lists connections and sends us its key
+		usersInfo.Set(c.ID, &UserInfo{Name: c.Nickname})
+		logf("[red][SERVER[][white] USER [green][%s[] [red]%s[white] joined chat", c.ID.String(), c.Nickname)
+
+	case novaprotocol.MSG_CONNECTION_LOST:
+		c, err := novaprotocol.ParseJsonMessage[serverapi.Client](data)
+		if err != nil || c == nil {
+			logf("[red]failed to parse message: %v", err)
+			return
+		}
+		usersInfo.Remove(c.ID)
+		onMemberLeft(lobbyID(), c.ID)
+		logf("[red][SERVER[][white] USER [green][%s[] [red]%s[white] left chat", c.ID.String(), c.Nickname)
+
+	case novaprotocol.MSG_ROOM_JOIN:
+		room, err := novaprotocol.ParseJsonMessage[serverapi.Room](data)
+		if err != nil || room == nil {
+			logf("[red]failed to parse message: %v", err)
+			return
+		}
+		onLobbyJoined(*room)
+
+	case novaprotocol.MSG_ROOM_JOINED, novaprotocol.MSG_ROOM_LEFT:
+		m, err := novaprotocol.ParseJsonMessage[serverapi.RoomMember](data)
+		if err != nil || m == nil {
+			logf("[red]failed to parse message: %v", err)
+			return
+		}
+		if msgType == novaprotocol.MSG_ROOM_JOINED {
+			onMemberJoined(m.Room.ID, m.Client.ID)
+		} else {
+			onMemberLeft(m.Room.ID, m.Client.ID)
+		}
+
+	case novaprotocol.MSG_NICKNAME_CHANGED:
+		c, err := novaprotocol.ParseJsonMessage[serverapi.NicknameChanged](data)
+		if err != nil || c == nil {
+			logf("[red]failed to parse message: %v", err)
+			return
+		}
+		if c.ID == client.GetID() {
 			app.QueueUpdateDraw(func() {
-				fmt.Fprintf(logsView, "[red]failed to parse message type: %s\n", err.Error())
-				logsView.ScrollToEnd()
+				header.SetText(fmt.Sprintf("[black][%s[] %s", client.GetID().String(), c.Nickname))
 			})
-			continue
+		} else if userInfo, ok := usersInfo.Get(c.ID); ok {
+			userInfo.Name = c.Nickname
 		}
+		logf("[red][SERVER[][white] %s is now known as [red]%s", c.OldNickname, c.Nickname)
 
-		if recvPacket.GetOrigin() == uuid.Nil {
-			// From server
-			switch msgType {
-			case "pr_res":
-				msg, err := protocol.ParsePresenseResponse(data)
-				if err != nil {
-					app.QueueUpdateDraw(func() {
-						fmt.Fprintf(logsView, "[red]failed to parse message: %s\n", err.Error())
-						logsView.ScrollToEnd()
-					})
-					continue
-				}
-				userId = msg.UserID
-				header.SetText(fmt.Sprintf("[black][%s[] %s", userId.String(), name))
-
-				app.QueueUpdateDraw(func() {
-					fmt.Fprintf(logsView, "[red][SERVER[][white] Your USERID: [green]%s\n", userId.String())
-					logsView.ScrollToEnd()
-				})
-				// send public key to everyone
-				{
-					buf, err := protocol.NewPublicKeyMessage(&protocol.PublicKeyMessage{
-						PublicKey: pub.Text(62),
-					})
-					if err != nil {
-						app.QueueUpdateDraw(func() {
-							fmt.Fprintf(logsView, "[red]failed to make message: %s\n", err.Error())
-							logsView.ScrollToEnd()
-						})
-					}
-					sendChan <- protocol.NewPacket(protocol.Broadcast, buf, protocol.PacketParams{})
-				}
+	case novaprotocol.MSG_ERROR:
+		e, err := novaprotocol.ParseJsonMessage[serverapi.Error](data)
+		if err != nil || e == nil {
+			logf("[red]failed to parse message: %v", err)
+			return
+		}
+		logf("[red][SERVER[][white] %s: %s", e.Code, e.Message)
 
-			case "pr_inf":
-				msg, err := protocol.ParsePresenseInfo(data)
-				if err != nil {
-					app.QueueUpdateDraw(func() {
-						fmt.Fprintf(logsView, "[red]failed to parse message: %s\n", err.Error())
-						logsView.ScrollToEnd()
-					})
-					continue
-				}
-				app.QueueUpdateDraw(func() {
-					fmt.Fprintf(logsView, "[red][SERVER[][white] USER [green][%s[] [red]%s[white] joined chat\n", msg.UserID.String(), msg.Name)
-					logsView.ScrollToEnd()
-				})
-				if msg.UserID != userId {
-
-					pInfo, err := protocol.NewPresenseInfo(&protocol.PresenseInfo{
-						UserID: userId,
-						Name:   name,
-					})
-					if err != nil {
-						app.QueueUpdateDraw(func() {
-							fmt.Fprintf(logsView, "[red]failed to make message: %s\n", err.Error())
-							logsView.ScrollToEnd()
-						})
-						continue
-					}
-					sendChan <- protocol.NewPacket(msg.UserID, pInfo, protocol.PacketParams{})
-
-					usersInfo.Set(msg.UserID, &UserInfo{
-						Key:  nil,
-						Name: msg.Name,
-					})
-				}
-			}
-		} else if recvPacket.GetOrigin() != userId {
-			// From another user
-			switch msgType {
-			case "pub":
-				msg, err := protocol.ParsePublicKeyMessage(data)
-				if err != nil {
-					app.QueueUpdateDraw(func() {
-						fmt.Fprintf(logsView, "[red]failed to parse message: %s\n", err.Error())
-						logsView.ScrollToEnd()
-					})
-					continue
-				}
-				targetPub, ok := new(big.Int).SetString(msg.PublicKey, 62)
-				if !ok {
-					app.QueueUpdateDraw(func() {
-						fmt.Fprintf(logsView, "[red]failed to decode public key: %s\n", err.Error())
-						logsView.ScrollToEnd()
-					})
-					continue
-				}
-				key := protocol.ComputeSharedKey(priv, targetPub)
+	case novaprotocol.MSG_HISTORY:
+		page, err := novaprotocol.ParseJsonMessage[serverapi.HistoryPage](data)
+		if err != nil || page == nil {
+			logf("[red]failed to parse message: %v", err)
+			return
+		}
+		userInfo, ok := usersInfo.Get(page.With)
+		if !ok {
+			return
+		}
+		chatf("[gray]--- history with %s ---", tview.Escape(userInfo.Name))
+		for _, m := range page.Messages {
+			chatf("[gray]%s %s", m.SentAt.Local().Format(time.DateTime), renderStored(userInfo, m))
+			rememberStored(userInfo, page.With, m)
+		}
+		chatf("[gray]--- end of history ---")
+
+	case novaprotocol.MSG_ACCOUNT_CREATE, novaprotocol.MSG_DEVICE_LOGIN, novaprotocol.MSG_DEVICE_LINK_CODE,
+		novaprotocol.MSG_DEVICE_LINK, novaprotocol.MSG_DEVICE_LINK_REQUEST, novaprotocol.MSG_DEVICE_LINK_CONFIRM,
+		novaprotocol.MSG_DEVICE_LIST, novaprotocol.MSG_DEVICE_REVOKE:
+		handleDeviceMessage(msgType, data)
+
+	case novaprotocol.MSG_KICKED:
+		k, err := novaprotocol.ParseJsonMessage[serverapi.Kicked](data)
+		if err != nil || k == nil {
+			logf("[red]failed to parse message: %v", err)
+			return
+		}
+		logf("[red][SERVER[][white] you were kicked: %s", k.Reason)
+	}
+}
 
-				userInfo, ok := usersInfo.Get(recvPacket.GetOrigin())
-				if !ok {
-					userInfo = &UserInfo{}
-					usersInfo.Set(recvPacket.GetOrigin(), userInfo)
-				}
-				// Exchange only once
-				if userInfo.Key == nil {
-					userInfo.Key = key
-
-					app.QueueUpdateDraw(func() {
-						fmt.Fprintf(logsView, "[red][DEBUG[][white] Exchanged keys with: [green]%s\n", recvPacket.GetOrigin().String())
-						logsView.ScrollToEnd()
-					})
-					// Send your key in return
-					resp, err := protocol.NewPublicKeyMessage(&protocol.PublicKeyMessage{
-						PublicKey: pub.Text(62),
-					})
-					if err != nil {
-						app.QueueUpdateDraw(func() {
-							fmt.Fprintf(logsView, "[red]failed to parse pub message: %s\n", err.Error())
-							logsView.ScrollToEnd()
-						})
-						continue
-					}
-					sendChan <- protocol.NewPacket(recvPacket.GetOrigin(), resp, protocol.PacketParams{})
-				}
+func handlePeerMessage(origin uuid.UUID, msgType string, data []byte, encrypted bool) {
+	switch msgType {
+	case msgPeerPub:
+		msg, err := novaprotocol.ParseJsonMessage[PeerPublicKey](data)
+		if err != nil || msg == nil {
+			logf("[red]failed to parse message: %v", err)
+			return
+		}
+		targetPub, ok := new(big.Int).SetString(msg.Pub, 62)
+		if !ok || !handshake.ValidPublicKey(targetPub) {
+			logf("[red]failed to decode public key of %s", origin)
+			return
+		}
 
-			case "ch_msg":
-				msg, err := protocol.ParseChatMessage(data)
-				if err != nil {
-					app.QueueUpdateDraw(func() {
-						fmt.Fprintf(logsView, "[red]failed to parse message: %s\n", err.Error())
-						logsView.ScrollToEnd()
-					})
-					continue
-				}
+		userInfo, ok := usersInfo.Get(origin)
+		if !ok {
+			userInfo = &UserInfo{}
+			usersInfo.Set(origin, userInfo)
+		}
+		// Exchange only once
+		if userInfo.Key != nil {
+			return
+		}
+		if !checkPeerIdentity(userInfo, msg) {
+			return
+		}
+		userInfo.Key = handshake.ComputeSharedKey(priv, targetPub)
+		rememberSessionKey(userInfo.Name, userInfo.Key)
+		logf("[red][DEBUG[][white] Exchanged keys with: [green]%s", origin.String())
+		onPeerKey(origin)
+		// Send our key in return
+		if err := sendPeer(origin, nil, msgPeerPub, ownPublicKey()); err != nil {
+			logf("[red]failed to send public key: %s", err.Error())
+		}
 
-				userInfo, ok := usersInfo.Get(recvPacket.GetOrigin())
-				if !ok {
-					app.QueueUpdateDraw(func() {
-						fmt.Fprintf(logsView, "[red]msg from unknown user")
-						logsView.ScrollToEnd()
-					})
-					continue
-				}
-				app.QueueUpdateDraw(func() {
-					fmt.Fprintf(chatView, "[yellow][%s[][green][%s[][white]: %s\n", recvPacket.GetOrigin().String()[:4], userInfo.Name, msg.Text)
-					chatView.ScrollToEnd()
-				})
-			case "pr_inf":
-				msg, err := protocol.ParsePresenseInfo(data)
-				if err != nil {
-					app.QueueUpdateDraw(func() {
-						fmt.Fprintf(logsView, "[red]failed to parse message: %s\n", err.Error())
-						logsView.ScrollToEnd()
-					})
-					continue
-				}
-				app.QueueUpdateDraw(func() {
-					fmt.Fprintf(logsView, "[red][SERVER[][white] USER [green][%s[] [red]%s[white] in chat\n", msg.UserID.String(), msg.Name)
-					logsView.ScrollToEnd()
-				})
-				if msg.UserID != userId {
-					uInfo, ex := usersInfo.Get(msg.UserID)
-					if !ex {
-						usersInfo.Set(msg.UserID, &UserInfo{
-							Key:  nil,
-							Name: msg.Name,
-						})
-					} else {
-						uInfo.Name = msg.Name
-					}
+	case senderkey.MSG_DISTRIBUTION:
+		// Chain key must never travel in clear
+		if !encrypted {
+			logf("[red]dropped unencrypted sender key from %s", origin)
+			return
+		}
+		onDistribution(origin, data)
+
+	case chatapi.MSG_CHAT, chatapi.MSG_EDIT, chatapi.MSG_DELETE, chatapi.MSG_REACTION:
+		if !encrypted {
+			logf("[red]dropped unencrypted message from %s", origin)
+			return
+		}
+		userInfo, ok := usersInfo.Get(origin)
+		if !ok {
+			logf("[red]msg from unknown user")
+			return
+		}
+		text, err := renderChat(msgType, data)
+		if err != nil {
+			logf("[red]failed to parse message: %v", err)
+			return
+		}
+		// Replies are private, other messages belong to the common chat
+		peer := uuid.Nil
+		if msgType == chatapi.MSG_CHAT {
+			if msg, err := chatapi.ParseMessage(data); err == nil && msg.ID != uuid.Nil {
+				lastMessages.mutex.Lock()
+				lastMessages.received, lastMessages.receivedFrom = msg.ID, origin
+				lastMessages.mutex.Unlock()
+				if msg.ReplyTo != uuid.Nil {
+					peer = origin
 				}
 			}
 		}
+		remember(peer, origin, userInfo.Name, msgType, data)
+		chatf("[yellow][%s[][green][%s[][white]: %s", origin.String()[:4], userInfo.Name, text)
+
+	case novaprotocol.MSG_BOT_TEXT:
+		// Bots run on server, so their messages are never end-to-end encrypted
+		msg, err := novaprotocol.ParseJsonMessage[serverapi.BotText](data)
+		if err != nil || msg == nil {
+			logf("[red]failed to parse message: %v", err)
+			return
+		}
+		name := origin.String()[:4]
+		if userInfo, ok := usersInfo.Get(origin); ok {
+			name = userInfo.Name
+		}
+		chatf("[yellow][BOT[][green][%s[][white]: %s", name, msg.Text)
+	}
+}
+
+// renderChat formats chat message for chat view, markdown is shown as is
+func renderChat(msgType string, data []byte) (string, error) {
+	switch msgType {
+	case chatapi.MSG_EDIT:
+		edit, err := chatapi.ParseEdit(data)
+		if err != nil {
+			return "", err
+		}
+		return tview.Escape(edit.Text) + " [gray](edited)", nil
+	case chatapi.MSG_DELETE:
+		if _, err := chatapi.ParseDelete(data); err != nil {
+			return "", err
+		}
+		return "[gray]deleted a message", nil
+	case chatapi.MSG_REACTION:
+		reaction, err := chatapi.ParseReaction(data)
+		if err != nil {
+			return "", err
+		}
+		if reaction.Remove {
+			return "[gray]removed reaction " + tview.Escape(reaction.Reaction), nil
+		}
+		return "[gray]reacted " + tview.Escape(reaction.Reaction), nil
+	}
+
+	msg, err := chatapi.ParseMessage(data)
+	if err != nil {
+		return "", err
+	}
+	text := tview.Escape(msg.Text)
+	if msg.ReplyTo != uuid.Nil {
+		text = "[gray]↪ [white]" + text
+	}
+	for _, a := range msg.Attachments {
+		text += fmt.Sprintf(" [blue][file: %s, %d bytes[]", tview.Escape(a.Name), a.Size)
+	}
+	return text, nil
+}
+
+// renderStored formats stored message of conversation with peer, edit replaces original text
+func renderStored(peer *UserInfo, m serverapi.StoredMessage) string {
+	name := peer.Name
+	if isOwnMessage(m) {
+		name = client.GetNickname()
+	}
+	prefix := fmt.Sprintf("[green][%s[][white]: ", tview.Escape(name))
+	if m.Deleted {
+		return prefix + "[gray]deleted message"
+	}
+	frame := m.Frame
+	if m.Edit != nil {
+		frame = m.Edit
+	}
+	msgType, data, err := openStoredFrame(peer, frame)
+	if err != nil {
+		return prefix + "[gray]encrypted"
+	}
+	text, err := renderChat(msgType, data)
+	if err != nil {
+		return prefix + "[red]invalid message"
+	}
+	if len(m.Reactions) > 0 {
+		text += fmt.Sprintf(" [gray](%d reactions)", len(m.Reactions))
 	}
+	return prefix + text
 }
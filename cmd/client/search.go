@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"novachat-server/novaclient/history"
+	"novachat-server/novaprotocol/chatapi"
+	"novachat-server/novaprotocol/serverapi"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rivo/tview"
+)
+
+// Search results shown per page
+const searchPageSize = 10
+
+// Decrypted messages, server can not search them
+var localHistory history.DB
+
+// remember applies chat message to local history. Peer is nil for messages of the common chat
+func remember(peer, origin uuid.UUID, author string, msgType string, data []byte) {
+	var err error
+	switch msgType {
+	case chatapi.MSG_CHAT:
+		msg, perr := chatapi.ParseMessage(data)
+		if perr != nil {
+			return
+		}
+		entry := history.Message{ID: msg.ID, Peer: peer, Origin: origin, Author: author, SentAt: msg.SentAt, Text: msg.Text}
+		// Messages of old clients have neither id nor time
+		if entry.ID == uuid.Nil {
+			entry.ID = uuid.New()
+		}
+		if entry.SentAt.IsZero() {
+			entry.SentAt = time.Now()
+		}
+		err = localHistory.Put(entry)
+
+	case chatapi.MSG_EDIT:
+		edit, perr := chatapi.ParseEdit(data)
+		if perr != nil {
+			return
+		}
+		if entry, ok := localHistory.Get(edit.ID); ok && entry.Origin == origin {
+			entry.Text, entry.Edited = edit.Text, true
+			err = localHistory.Put(entry)
+		}
+
+	case chatapi.MSG_DELETE:
+		del, perr := chatapi.ParseDelete(data)
+		if perr != nil {
+			return
+		}
+		if entry, ok := localHistory.Get(del.ID); ok && entry.Origin == origin {
+			err = localHistory.Delete(del.ID)
+		}
+	}
+	if err != nil {
+		logf("[red]failed to save history: %s", err.Error())
+	}
+}
+
+// rememberStored indexes message fetched by /history
+func rememberStored(peer *UserInfo, with uuid.UUID, m serverapi.StoredMessage) {
+	if m.Deleted {
+		if err := localHistory.Delete(m.ID); err != nil {
+			logf("[red]failed to save history: %s", err.Error())
+		}
+		return
+	}
+	author := peer.Name
+	if isOwnMessage(m) {
+		author = client.GetNickname()
+	}
+	for _, frame := range [][]byte{m.Frame, m.Edit} {
+		if frame == nil {
+			continue
+		}
+		if msgType, data, err := openStoredFrame(peer, frame); err == nil {
+			remember(with, m.Origin, author, msgType, data)
+		}
+	}
+}
+
+// Results of the last /search
+var search struct {
+	mutex   sync.Mutex
+	query   string
+	results []history.Result
+	page    int
+}
+
+func formatHistoryMessage(msg history.Message) string {
+	text := tview.Escape(msg.Text)
+	if msg.Edited {
+		text += " [gray](edited)"
+	}
+	return fmt.Sprintf("[gray]%s [green][%s[][white]: %s", msg.SentAt.Local().Format(time.DateTime), tview.Escape(msg.Author), text)
+}
+
+// showSearchPage prints current page of results, caller holds search mutex
+func showSearchPage() {
+	from := search.page * searchPageSize
+	if from >= len(search.results) {
+		chatf("[gray]--- no more results for %q ---", tview.Escape(search.query))
+		return
+	}
+	to := min(from+searchPageSize, len(search.results))
+	chatf("[gray]--- results %d-%d of %d for %q ---", from+1, to, len(search.results), tview.Escape(search.query))
+	for i, result := range search.results[from:to] {
+		chatf("[blue]%d.[white] %s", from+i+1, formatHistoryMessage(result.Message))
+	}
+	if to < len(search.results) {
+		chatf("[gray]--- /more for next page, /open <n> to show in context, /export <file> to save ---")
+	}
+}
+
+func runSearchCommand(cmd, arg string) {
+	search.mutex.Lock()
+	defer search.mutex.Unlock()
+
+	switch cmd {
+	case "/search":
+		if len(history.Tokenize(arg)) == 0 {
+			logf("[red]usage: /search <words>")
+			return
+		}
+		search.query, search.results, search.page = arg, localHistory.Search(arg, 0), 0
+		showSearchPage()
+
+	case "/more":
+		if search.results == nil {
+			logf("[red]search first")
+			return
+		}
+		search.page++
+		showSearchPage()
+
+	case "/open":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 || n > len(search.results) {
+			logf("[red]usage: /open <result number>")
+			return
+		}
+		hit := search.results[n-1].ID
+		chatf("[gray]--- context of result %d ---", n)
+		for _, msg := range localHistory.Around(hit, 3) {
+			if msg.ID == hit {
+				chatf("[yellow]>[white] %s", formatHistoryMessage(msg))
+			} else {
+				chatf("  %s", formatHistoryMessage(msg))
+			}
+		}
+
+	case "/export":
+		if search.results == nil || arg == "" {
+			logf("[red]usage: /export <file>, after /search")
+			return
+		}
+		format := history.FormatText
+		if strings.EqualFold(filepath.Ext(arg), ".json") {
+			format = history.FormatJson
+		}
+		messages := make([]history.Message, 0, len(search.results))
+		for _, result := range search.results {
+			messages = append(messages, result.Message)
+		}
+		file, err := os.OpenFile(arg, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+		if err != nil {
+			logf("[red]failed to export: %s", err.Error())
+			return
+		}
+		err = history.Export(file, format, messages)
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			logf("[red]failed to export: %s", err.Error())
+			return
+		}
+		logf("[green]exported %d messages to %s", len(messages), arg)
+	}
+}
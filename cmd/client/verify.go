@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"novachat-server/novaclient/identity"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/rivo/tview"
+)
+
+// Long-term key signing our session key, peers compare safety numbers derived from it
+var ownIdentity *identity.Identity
+
+// Identity keys seen for every nickname, verified ones warn loudly on change
+var contacts identity.Contacts
+
+// loadIdentity opens identity and contacts, without files new identity is generated every start
+func loadIdentity() error {
+	if *keystoreFlag != "" {
+		return openKeystore()
+	}
+	if *restoreFlag != "" {
+		return fmt.Errorf("-restore requires -keystore")
+	}
+	var err error
+	if *identityFlag == "" {
+		ownIdentity, err = identity.New()
+	} else {
+		ownIdentity, err = identity.LoadOrCreate(*identityFlag)
+	}
+	if err != nil {
+		return err
+	}
+	contacts, err = identity.OpenContacts(*contactsFlag)
+	return err
+}
+
+// ownPublicKey is our session key signed by identity
+func ownPublicKey() *PeerPublicKey {
+	key := pub.Text(62)
+	return &PeerPublicKey{Pub: key, Identity: ownIdentity.Public(), Signature: ownIdentity.SignKey(key)}
+}
+
+// checkPeerIdentity verifies signature of session key and compares identity with the one seen before.
+// False means key must not be used
+func checkPeerIdentity(userInfo *UserInfo, msg *PeerPublicKey) bool {
+	name := tview.Escape(userInfo.Name)
+	status, old, err := identity.CheckPeerKey(contacts, userInfo.Name, msg.Identity, msg.Pub, msg.Signature)
+	switch {
+	case errors.Is(err, identity.ErrorBadSignature):
+		chatf("[red::b]WARNING: key of %s is not signed by its identity, it was ignored", name)
+		return false
+	case errors.Is(err, identity.ErrorIdentityMissing):
+		chatf("[red::b]WARNING: %s, verified on %s, sent key without identity, it was ignored!", name, old.VerifiedAt.Local().Format("2006-01-02"))
+		chatf("[red::b]Server or someone else may try to read your messages, compare safety number again with /verify %s", name)
+		return false
+	case err != nil:
+		logf("[red]%s", err.Error())
+	}
+
+	switch {
+	case status == identity.KeyMissing:
+		logf("[yellow]%s has no identity key, its safety number can not be verified", name)
+		return true
+	case status == identity.KeyChanged && old.Verified():
+		chatf("[red::b]WARNING: safety number with %s changed since you verified it on %s!", name, old.VerifiedAt.Local().Format("2006-01-02"))
+		chatf("[red::b]Server or someone else may read your messages, compare it again with /verify %s", name)
+	case status == identity.KeyChanged:
+		logf("[yellow]safety number with %s changed", name)
+	}
+	userInfo.Identity = msg.Identity
+	return true
+}
+
+// runVerifyCommand shows safety number of peer, "/verify <nick> confirm" marks it as compared out of band
+func runVerifyCommand(arg string) {
+	name, confirm, _ := strings.Cut(arg, " ")
+	var peer *UserInfo
+	usersInfo.Foreach(func(_ uuid.UUID, ui *UserInfo) {
+		if ui.Name == name {
+			peer = ui
+		}
+	})
+	if peer == nil {
+		logf("[red]unknown user: %s", name)
+		return
+	}
+	if peer.Identity == nil {
+		logf("[red]%s did not send identity key yet", tview.Escape(name))
+		return
+	}
+
+	switch confirm {
+	case "":
+		contact, _ := contacts.Get(name)
+		status := "[yellow]not verified"
+		if contact.Verified() && contact.Key.Equal(peer.Identity) {
+			status = "[green]verified"
+		}
+		chatf("[white]safety number with %s (%s[white]):", tview.Escape(name), status)
+		chatf("[white::b]%s", identity.Fingerprint(ownIdentity.Public(), peer.Identity))
+		chatf("[gray]compare it with %s in person, then /verify %s confirm", tview.Escape(name), tview.Escape(name))
+	case "confirm":
+		if err := contacts.Verify(name); err != nil {
+			logf("[red]failed to verify: %s", err.Error())
+			return
+		}
+		chatf("[green]%s is verified", tview.Escape(name))
+	default:
+		logf("[red]usage: /verify <nick> [confirm]")
+	}
+}
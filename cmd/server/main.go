@@ -2,153 +2,54 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"io"
-	"log"
-	"net/http"
-	"novachat-server/common/safemap"
+	"log/slog"
 	"novachat-server/internal/application"
 	"novachat-server/internal/config"
+	"novachat-server/internal/logging"
+	"novachat-server/internal/plugin"
+	"os"
 	"os/signal"
 	"syscall"
-	"time"
-
-	"github.com/google/uuid"
-	"golang.org/x/net/websocket"
 )
 
-// Client представляет подключенного клиента
-type Client struct {
-	ID   uuid.UUID
-	Conn *websocket.Conn
-	Name string
-}
-
-var clients = safemap.New[uuid.UUID, *Client]()
-
 func main() {
+	// Cancelling ctx closes every client connection
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
 	cfg, err := config.LoadAppConfig()
 	if err != nil {
-		log.Fatalf("failed to load config: %s", err.Error())
-		return
-	}
-
-	app, err := application.NewApplication(ctx, cfg)
-	if err != nil {
-		log.Fatalf("failed to create application: %s", err.Error())
-		return
+		slog.Error("failed to load config", slog.Any("error", err))
+		os.Exit(1)
 	}
 
-	app.Start()
+	logger, err := logging.New(os.Stderr, cfg.LogLevel, cfg.LogFormat)
 	if err != nil {
-		log.Fatalf("failed to start application: %s", err.Error())
-		return
+		slog.Error("failed to create logger", slog.Any("error", err))
+		os.Exit(1)
 	}
+	slog.SetDefault(logger)
 
-	<-ctx.Done()
-	http.Handle("/", http.FileServer(http.Dir("./static")))
-	http.Handle("/ws", websocket.Handler(handleWebSocket))
-	log.Println("server started on port :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
-}
-
-func handleWebSocket(ws *websocket.Conn) {
-	id, err := uuid.NewRandom()
+	app, err := application.NewApplication(ctx, cfg, logger)
 	if err != nil {
-		return
+		logger.Error("failed to create application", slog.Any("error", err))
+		os.Exit(1)
 	}
-	client := &Client{
-		ID:   id,
-		Conn: ws,
-	}
-	clients.Set(client.ID, client)
-	defer clients.Remove(client.ID)
-
-	for {
-		msg, err := protocol.ReadPacket(client.Conn)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			log.Printf("failed to read packet: %s", err.Error())
-			<-time.After(time.Millisecond * 10)
-			break
-		}
 
-		if msg.GetTarget() == protocol.Servercast {
-			// For server, do not resend
-			err := processServerMessage(client, msg)
-			if err != nil {
-				log.Printf("failed to process server message: %s", err.Error())
-				continue
-			}
-		} else if msg.GetTarget() == protocol.Broadcast {
-			// Broadcast
-			msg.SetOrigin(client.ID)
-			broadcastMessage(msg)
-		} else {
-			msg.SetOrigin(client.ID)
-			// Unicast
-			target, ok := clients.Get(msg.GetTarget())
-			if !ok {
-				log.Printf("target not found")
-				continue
-			}
-			if err := protocol.WritePacket(target.Conn, msg); err != nil {
-				log.Printf("failed to send message to client [%s]: %s", target.ID.String(), err.Error())
-				continue
-			}
+	if cfg.ReminderInterval > 0 && cfg.ReminderRoom != "" {
+		reminder := plugin.NewReminder(ctx, cfg.ReminderNickname, cfg.ReminderRoom, cfg.ReminderText, cfg.ReminderInterval, logger)
+		if err := app.RegisterBot(reminder); err != nil {
+			logger.Error("failed to register reminder", slog.Any("error", err))
+			os.Exit(1)
 		}
-
 	}
-}
-
-func broadcastMessage(p protocol.Packet) {
-	clients.Foreach(func(u uuid.UUID, c *Client) {
-		if err := protocol.WritePacket(c.Conn, p); err != nil {
-			log.Printf("failed to send message to client [%s]: %s", c.ID.String(), err.Error())
-		}
-	})
-}
 
-func processServerMessage(client *Client, msg protocol.Packet) error {
-	msgType, err := protocol.ParseMessageType(msg.GetData())
+	err = app.Start()
 	if err != nil {
-		return fmt.Errorf("failed to get message type: %w", err)
-	}
-
-	switch msgType {
-	case "pr_req":
-		request, err := protocol.ParsePresenseRequest(msg.GetData())
-		if err != nil {
-			return fmt.Errorf("failed to unmarshal: %w", err)
-		}
-		client.Name = request.Name
-
-		// Send back his uuid
-		response, err := protocol.NewPresenseResponse(&protocol.PresenseResponse{
-			UserID: client.ID,
-		})
-		if err != nil {
-			return fmt.Errorf("failed to create response: %w", err)
-		}
-		err = protocol.WritePacket(client.Conn, protocol.NewPacket(uuid.Nil, response, protocol.PacketParams{}))
-		if err != nil {
-			return fmt.Errorf("failed to write packet: %w", err)
-		}
-		// Broadcast new user
-		br, err := protocol.NewPresenseInfo(&protocol.PresenseInfo{
-			UserID: client.ID,
-			Name:   client.Name,
-		})
-		if err != nil {
-			return fmt.Errorf("failed to create response: %w", err)
-		}
-		broadcastMessage(protocol.NewPacket(uuid.Nil, br, protocol.PacketParams{}))
+		logger.Error("failed to start application", slog.Any("error", err))
+		os.Exit(1)
 	}
 
-	return nil
+	<-app.Done()
+	logger.Info("server stopped")
 }
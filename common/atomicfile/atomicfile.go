@@ -0,0 +1,28 @@
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Write replaces file at path with data, readers see either old or new contents but never a partial file.
+// Data reaches disk before old file is replaced
+func Write(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,138 @@
+package jsonlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Log is append-only json lines file. Owner keeps live records in memory and serializes calls,
+// newer line of a record supersedes older ones until Rewrite leaves one line per live record
+type Log interface {
+	// Append writes v as one line
+	Append(v any) error
+	// Rewrite atomically replaces file with lines written by each
+	Rewrite(each func(write func(v any) error) error) error
+	// Lines in file, live records and their superseded versions
+	Lines() int
+	Close() error
+}
+
+type logImpl struct {
+	path  string
+	file  *os.File
+	lines int
+}
+
+// Open passes every line of file to replay and opens it for appending, missing file is created.
+// maxLine is the longest line accepted
+func Open(path string, maxLine int, replay func(line int, data []byte) error) (Log, error) {
+	l := &logImpl{path: path}
+	if err := l.replay(maxLine, replay); err != nil {
+		return nil, err
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *logImpl) replay(maxLine int, replay func(line int, data []byte) error) error {
+	file, err := os.Open(l.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, maxLine)
+	for scanner.Scan() {
+		l.lines++
+		if err := replay(l.lines, scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func (l *logImpl) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	return nil
+}
+
+func (l *logImpl) Append(v any) error {
+	if l.file == nil {
+		return os.ErrClosed
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	l.lines++
+	return nil
+}
+
+func (l *logImpl) Rewrite(each func(write func(v any) error) error) error {
+	if l.file == nil {
+		return os.ErrClosed
+	}
+	tmp := filepath.Join(filepath.Dir(l.path), "."+filepath.Base(l.path)+".tmp")
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	lines := 0
+	err = each(func(v any) error {
+		lines++
+		return enc.Encode(v)
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return err
+	}
+	// Appended lines must go to the new file
+	replaced := l.file
+	l.lines = lines
+	if err := l.open(); err != nil {
+		l.file = replaced
+		return err
+	}
+	return replaced.Close()
+}
+
+func (l *logImpl) Lines() int {
+	return l.lines
+}
+
+func (l *logImpl) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
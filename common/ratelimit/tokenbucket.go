@@ -0,0 +1,54 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Token bucket rate limiter
+type Limiter interface {
+	// Takes one token, returns false if bucket is empty
+	Allow() bool
+	// Takes n tokens, returns false if there are not enough of them
+	AllowN(n float64) bool
+}
+
+type tokenBucketImpl struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+// Token bucket refilled with rate tokens per second, holding at most burst tokens
+func NewTokenBucket(rate float64, burst float64) Limiter {
+	return &tokenBucketImpl{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+func (tb *tokenBucketImpl) Allow() bool {
+	return tb.AllowN(1)
+}
+
+func (tb *tokenBucketImpl) AllowN(n float64) bool {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+
+	if tb.tokens < n {
+		return false
+	}
+	tb.tokens -= n
+	return true
+}
@@ -60,5 +60,7 @@ func (h *safemapImpl[K, V]) Foreach(it func(K, V)) {
 }
 
 func (h *safemapImpl[K, V]) Count() int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
 	return len(h.data)
 }
@@ -0,0 +1,241 @@
+package account
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"novachat-server/common/atomicfile"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Active devices per account, revoked ones are not counted
+const MaxDevices = 16
+
+var (
+	ErrorNotFound       = errors.New("not found")
+	ErrorRevoked        = errors.New("device is revoked")
+	ErrorInvalidToken   = errors.New("invalid device token")
+	ErrorTooManyDevices = errors.New("too many devices")
+)
+
+// Device is one installation of client, it signs in with its own token.
+// Only hash of the token is stored
+type Device struct {
+	ID        uuid.UUID `json:"id"`
+	Name      string    `json:"name"`
+	TokenHash string    `json:"token_hash"`
+	CreatedAt time.Time `json:"created_at"`
+	RevokedAt time.Time `json:"revoked_at,omitzero"`
+}
+
+func (d Device) Revoked() bool {
+	return !d.RevokedAt.IsZero()
+}
+
+// Account groups devices of one user, its id addresses all of them
+type Account struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Devices   []Device  `json:"devices"`
+}
+
+// Store keeps accounts in json file, tokens are returned only when device is created
+type Store interface {
+	// Create makes account with its first device
+	Create(deviceName string) (Account, Device, string, error)
+	AddDevice(account uuid.UUID, name string) (Device, string, error)
+	Authenticate(account, device uuid.UUID, token string) (Device, error)
+	// Revoke keeps device in account, but it can not sign in anymore
+	Revoke(account, device uuid.UUID) (Device, error)
+	Get(id uuid.UUID) (Account, bool)
+	Exists(id uuid.UUID) bool
+}
+
+type storeImpl struct {
+	path     string
+	accounts map[uuid.UUID]*Account
+	mutex    sync.RWMutex
+}
+
+// NewStore loads accounts from json file, file is created on first change. Empty path keeps accounts in memory only
+func NewStore(path string) (Store, error) {
+	s := &storeImpl{
+		path:     path,
+		accounts: make(map[uuid.UUID]*Account),
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("failed to read accounts: %w", err)
+	}
+	var accounts []*Account
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, fmt.Errorf("failed to parse accounts: %w", err)
+	}
+	for _, a := range accounts {
+		s.accounts[a.ID] = a
+	}
+	return s, nil
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// newDevice returns device with fresh token
+func newDevice(name string) (Device, string) {
+	token := rand.Text()
+	return Device{
+		ID:        uuid.New(),
+		Name:      name,
+		TokenHash: hashToken(token),
+		CreatedAt: time.Now().UTC(),
+	}, token
+}
+
+func (s *storeImpl) Create(deviceName string) (Account, Device, string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	device, token := newDevice(deviceName)
+	a := &Account{ID: uuid.New(), CreatedAt: device.CreatedAt, Devices: []Device{device}}
+	s.accounts[a.ID] = a
+	if err := s.save(); err != nil {
+		delete(s.accounts, a.ID)
+		return Account{}, Device{}, "", err
+	}
+	return *a, device, token, nil
+}
+
+func (s *storeImpl) AddDevice(account uuid.UUID, name string) (Device, string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	a, ex := s.accounts[account]
+	if !ex {
+		return Device{}, "", ErrorNotFound
+	}
+	active := 0
+	for _, d := range a.Devices {
+		if !d.Revoked() {
+			active++
+		}
+	}
+	if active >= MaxDevices {
+		return Device{}, "", ErrorTooManyDevices
+	}
+	device, token := newDevice(name)
+	a.Devices = append(a.Devices, device)
+	if err := s.save(); err != nil {
+		a.Devices = a.Devices[:len(a.Devices)-1]
+		return Device{}, "", err
+	}
+	return device, token, nil
+}
+
+// device returns index of device in account, caller holds lock
+func (s *storeImpl) device(account, device uuid.UUID) (*Account, int, error) {
+	a, ex := s.accounts[account]
+	if !ex {
+		return nil, -1, ErrorNotFound
+	}
+	for i, d := range a.Devices {
+		if d.ID == device {
+			return a, i, nil
+		}
+	}
+	return nil, -1, ErrorNotFound
+}
+
+func (s *storeImpl) Authenticate(account, device uuid.UUID, token string) (Device, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	a, i, err := s.device(account, device)
+	if err != nil {
+		// Unknown account and device look the same as wrong token
+		return Device{}, ErrorInvalidToken
+	}
+	d := a.Devices[i]
+	if subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(d.TokenHash)) != 1 {
+		return Device{}, ErrorInvalidToken
+	}
+	if d.Revoked() {
+		return Device{}, ErrorRevoked
+	}
+	return d, nil
+}
+
+func (s *storeImpl) Revoke(account, device uuid.UUID) (Device, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	a, i, err := s.device(account, device)
+	if err != nil {
+		return Device{}, err
+	}
+	if a.Devices[i].Revoked() {
+		return a.Devices[i], ErrorRevoked
+	}
+	a.Devices[i].RevokedAt = time.Now().UTC()
+	if err := s.save(); err != nil {
+		a.Devices[i].RevokedAt = time.Time{}
+		return Device{}, err
+	}
+	return a.Devices[i], nil
+}
+
+func (s *storeImpl) Get(id uuid.UUID) (Account, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	a, ex := s.accounts[id]
+	if !ex {
+		return Account{}, false
+	}
+	copied := *a
+	copied.Devices = append([]Device(nil), a.Devices...)
+	return copied, true
+}
+
+func (s *storeImpl) Exists(id uuid.UUID) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, ex := s.accounts[id]
+	return ex
+}
+
+// save writes all accounts to temp file and renames it, so file is never half written.
+// Must be called under write lock
+func (s *storeImpl) save() error {
+	if s.path == "" {
+		return nil
+	}
+	accounts := make([]*Account, 0, len(s.accounts))
+	for _, a := range s.accounts {
+		accounts = append(accounts, a)
+	}
+
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.Write(s.path, data); err != nil {
+		return fmt.Errorf("failed to save accounts: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package account_test
+
+import (
+	"errors"
+	"novachat-server/internal/account"
+	"path/filepath"
+	"testing"
+)
+
+func TestDevices(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	store, err := account.NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acc, laptop, laptopToken, err := store.Create("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	phone, phoneToken, err := store.AddDevice(acc.ID, "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Authenticate(acc.ID, phone.ID, laptopToken); !errors.Is(err, account.ErrorInvalidToken) {
+		t.Errorf("token of another device accepted: %v", err)
+	}
+	if _, err := store.Revoke(acc.ID, phone.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Revocation survives restart, other devices keep working
+	store, err = account.NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Authenticate(acc.ID, phone.ID, phoneToken); !errors.Is(err, account.ErrorRevoked) {
+		t.Errorf("revoked device signed in: %v", err)
+	}
+	if d, err := store.Authenticate(acc.ID, laptop.ID, laptopToken); err != nil || d.Name != "laptop" {
+		t.Errorf("failed to sign in: %+v %v", d, err)
+	}
+	if got, ok := store.Get(acc.ID); !ok || len(got.Devices) != 2 {
+		t.Errorf("unexpected account %+v", got)
+	}
+}
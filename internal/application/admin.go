@@ -0,0 +1,202 @@
+package application
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"novachat-server/internal/clientmanager"
+	"novachat-server/internal/nickname"
+	"novachat-server/novaprotocol"
+	"novachat-server/novaprotocol/serverapi"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// routeAdmin executes moderation command, client must be authenticated as admin
+func (app *Application) routeAdmin(client clientmanager.Client, msgType string, data []byte) error {
+	if msgType == novaprotocol.MSG_ADMIN_AUTH {
+		return app.adminAuth(client, data)
+	}
+	if !client.IsAdmin() {
+		return respondError(client, msgType, serverapi.ErrorUnauthorized, fmt.Errorf("admin role required"))
+	}
+
+	var err error
+	switch msgType {
+	case novaprotocol.MSG_ADMIN_KICK:
+		err = app.adminKick(client, data)
+	case novaprotocol.MSG_ADMIN_BAN:
+		err = app.adminBan(client, data)
+	case novaprotocol.MSG_ADMIN_UNBAN:
+		err = app.adminUnban(client, data)
+	case novaprotocol.MSG_ADMIN_LIST_BANS:
+		err = app.adminListBans(client)
+	case novaprotocol.MSG_ADMIN_MUTE:
+		err = app.adminMute(client, data)
+	}
+	if err != nil {
+		return respondError(client, msgType, serverapi.ErrorBadRequest, err)
+	}
+	return nil
+}
+
+// respondAck echoes accepted admin request back to client
+func respondAck[T any](client clientmanager.Client, msgType string, req T) error {
+	msg, err := novaprotocol.NewJsonMessage(msgType, req)
+	if err != nil {
+		return err
+	}
+	return respondJson(client, msg)
+}
+
+func (app *Application) adminAuth(client clientmanager.Client, data []byte) error {
+	req, err := novaprotocol.ParseJsonMessage[serverapi.AdminAuth](data)
+	if err != nil || req == nil {
+		return respondError(client, novaprotocol.MSG_ADMIN_AUTH, serverapi.ErrorBadRequest, fmt.Errorf("invalid request"))
+	}
+	if app.cfg.AdminToken == "" || subtle.ConstantTimeCompare([]byte(req.Token), []byte(app.cfg.AdminToken)) != 1 {
+		client.Logger().Warn("failed admin auth")
+		return respondError(client, novaprotocol.MSG_ADMIN_AUTH, serverapi.ErrorUnauthorized, fmt.Errorf("invalid admin token"))
+	}
+	client.SetAdmin(true)
+	client.Logger().Info("authenticated as admin")
+	return respondAck(client, novaprotocol.MSG_ADMIN_AUTH, clientInfo(client))
+}
+
+// kick notifies client and closes its connection, connection handler does the rest
+func (app *Application) kick(target clientmanager.Client, reason string) {
+	msg, err := novaprotocol.NewJsonMessage(novaprotocol.MSG_KICKED, &serverapi.Kicked{Reason: reason})
+	if err == nil {
+		err = respondJson(target, msg)
+	}
+	if err != nil {
+		target.Logger().Warn("failed to notify kicked client", slog.Any("error", err))
+	}
+	if err := target.Close(); err != nil {
+		target.Logger().Warn("failed to close kicked client", slog.Any("error", err))
+	}
+}
+
+func (app *Application) adminKick(client clientmanager.Client, data []byte) error {
+	req, err := novaprotocol.ParseJsonMessage[serverapi.AdminKick](data)
+	if err != nil || req == nil {
+		return fmt.Errorf("invalid request")
+	}
+	target, ex := app.clientManager.GetClient(req.ID)
+	if !ex {
+		return fmt.Errorf("client not found")
+	}
+	client.Logger().Info("admin kicked client", slog.String("target_id", target.GetID().String()), slog.String("reason", req.Reason))
+	app.kick(target, req.Reason)
+	return respondAck(client, novaprotocol.MSG_ADMIN_KICK, req)
+}
+
+// banValue returns value to ban, taken from connected client if request refers one
+func (app *Application) banValue(req *serverapi.AdminBan) (string, error) {
+	value := req.Value
+	if req.ID != uuid.Nil {
+		target, ex := app.clientManager.GetClient(req.ID)
+		if !ex {
+			return "", fmt.Errorf("client not found")
+		}
+		switch req.Kind {
+		case serverapi.BanKindIP:
+			value = target.GetRemoteAddr()
+		case serverapi.BanKindIdentity:
+			value = target.GetNickname()
+		}
+	}
+	switch req.Kind {
+	case serverapi.BanKindIP:
+	case serverapi.BanKindIdentity:
+		value = nickname.Skeleton(value)
+	default:
+		return "", fmt.Errorf("unknown ban kind: %s", req.Kind)
+	}
+	if value == "" {
+		return "", fmt.Errorf("nothing to ban")
+	}
+	return value, nil
+}
+
+// isBanned checks client against both ip and identity bans
+func (app *Application) isBanned(client clientmanager.Client) (*serverapi.Ban, bool) {
+	if ban, ex := app.banList.IsBanned(serverapi.BanKindIP, client.GetRemoteAddr()); ex {
+		return ban, true
+	}
+	if client.GetNickname() == "" {
+		return nil, false
+	}
+	return app.banList.IsBanned(serverapi.BanKindIdentity, nickname.Skeleton(client.GetNickname()))
+}
+
+func (app *Application) adminBan(client clientmanager.Client, data []byte) error {
+	req, err := novaprotocol.ParseJsonMessage[serverapi.AdminBan](data)
+	if err != nil || req == nil {
+		return fmt.Errorf("invalid request")
+	}
+	value, err := app.banValue(req)
+	if err != nil {
+		return err
+	}
+
+	ban := serverapi.Ban{
+		Kind:   req.Kind,
+		Value:  value,
+		Reason: req.Reason,
+	}
+	if req.Duration > 0 {
+		ban.ExpiresAt = time.Now().Add(time.Duration(req.Duration) * time.Second)
+	}
+	if err := app.banList.Ban(ban); err != nil {
+		return fmt.Errorf("failed to save ban: %w", err)
+	}
+	client.Logger().Info("admin banned", slog.String("kind", ban.Kind), slog.String("value", ban.Value), slog.String("reason", ban.Reason))
+
+	// Drop everyone who is already connected
+	for _, c := range app.clientManager.ListClients() {
+		if _, banned := app.isBanned(c); banned {
+			app.kick(c, ban.Reason)
+		}
+	}
+	return respondAck(client, novaprotocol.MSG_ADMIN_BAN, &ban)
+}
+
+func (app *Application) adminUnban(client clientmanager.Client, data []byte) error {
+	req, err := novaprotocol.ParseJsonMessage[serverapi.AdminUnban](data)
+	if err != nil || req == nil {
+		return fmt.Errorf("invalid request")
+	}
+	value, err := app.banValue(&serverapi.AdminBan{Kind: req.Kind, Value: req.Value})
+	if err != nil {
+		return err
+	}
+	if err := app.banList.Unban(req.Kind, value); err != nil {
+		return fmt.Errorf("failed to save bans: %w", err)
+	}
+	client.Logger().Info("admin unbanned", slog.String("kind", req.Kind), slog.String("value", value))
+	return respondAck(client, novaprotocol.MSG_ADMIN_UNBAN, req)
+}
+
+func (app *Application) adminListBans(client clientmanager.Client) error {
+	return respondAck(client, novaprotocol.MSG_ADMIN_LIST_BANS, app.banList.List())
+}
+
+func (app *Application) adminMute(client clientmanager.Client, data []byte) error {
+	req, err := novaprotocol.ParseJsonMessage[serverapi.AdminMute](data)
+	if err != nil || req == nil {
+		return fmt.Errorf("invalid request")
+	}
+	until := time.Now().Add(time.Duration(req.Duration) * time.Second)
+	if target, ex := app.clientManager.GetClient(req.ID); ex {
+		target.SetMutedUntil(until)
+	} else if bot, ex := app.bots.Get(req.ID); ex {
+		// Integrations post through their bots
+		bot.setMutedUntil(until)
+	} else {
+		return fmt.Errorf("client not found")
+	}
+	client.Logger().Info("admin muted client", slog.String("target_id", req.ID.String()), slog.Int64("duration", req.Duration))
+	return respondAck(client, novaprotocol.MSG_ADMIN_MUTE, req)
+}
@@ -0,0 +1,137 @@
+package application
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"novachat-server/novaprotocol"
+	"novachat-server/novaprotocol/handshake"
+	"novachat-server/novaprotocol/serverapi"
+	"slices"
+	"sync"
+
+	"github.com/google/uuid"
+	"golang.org/x/net/websocket"
+)
+
+// Labels of rejected connections metric, admission limits are labeled with error code
+const (
+	rejectOrigin    = "origin"
+	rejectJoinToken = "join_token"
+)
+
+// admission counts open connections, globally and per remote address
+type admission struct {
+	mutex   sync.Mutex
+	total   int
+	perAddr map[string]int
+}
+
+// admit reserves connection slot, release must be called when connection is closed
+func (app *Application) admit(remoteAddr string) (release func(), code string, err error) {
+	a := &app.admission
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if app.cfg.MaxConnections > 0 && a.total >= app.cfg.MaxConnections {
+		app.metrics.connectionsRejected.Inc(serverapi.ErrorServerFull)
+		return nil, serverapi.ErrorServerFull, fmt.Errorf("server is full")
+	}
+	if app.cfg.MaxConnectionsPerIp > 0 && a.perAddr[remoteAddr] >= app.cfg.MaxConnectionsPerIp {
+		app.metrics.connectionsRejected.Inc(serverapi.ErrorTooManyConns)
+		return nil, serverapi.ErrorTooManyConns, fmt.Errorf("too many connections from %s", remoteAddr)
+	}
+	a.total++
+	a.perAddr[remoteAddr]++
+
+	return sync.OnceFunc(func() {
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+		a.total--
+		if a.perAddr[remoteAddr]--; a.perAddr[remoteAddr] <= 0 {
+			delete(a.perAddr, remoteAddr)
+		}
+	}), "", nil
+}
+
+// checkOrigin is websocket handshake, requests from origins not in AllowedOrigins get 403
+func (app *Application) checkOrigin(config *websocket.Config, req *http.Request) error {
+	origin, err := websocket.Origin(config, req)
+	if err == nil && origin == nil {
+		err = fmt.Errorf("null origin")
+	}
+	if err != nil {
+		app.metrics.connectionsRejected.Inc(rejectOrigin)
+		return err
+	}
+	config.Origin = origin
+
+	if len(app.cfg.AllowedOrigins) > 0 && !slices.Contains(app.cfg.AllowedOrigins, origin.Scheme+"://"+origin.Host) {
+		app.metrics.connectionsRejected.Inc(rejectOrigin)
+		app.logger.Warn("rejected websocket origin", slog.String("origin", origin.String()), slog.String("remote_addr", remoteHost(req.RemoteAddr)))
+		return fmt.Errorf("origin %s is not allowed", origin)
+	}
+	return nil
+}
+
+// reject sends unencrypted error, transport key is not negotiated yet
+func reject(w io.Writer, code string, reason error) error {
+	msg, err := novaprotocol.NewJsonMessage(novaprotocol.MSG_ERROR, &serverapi.Error{
+		Request: novaprotocol.MSG_JOIN,
+		Code:    code,
+		Message: reason.Error(),
+	})
+	if err != nil {
+		return err
+	}
+	return writePlainJson(w, msg)
+}
+
+func writePlainJson(w io.Writer, jsonData []byte) error {
+	l1, err := novaprotocol.NewL1Frame(novaprotocol.L1FlagIsJson, jsonData).Build(nil)
+	if err != nil {
+		return err
+	}
+	return novaprotocol.NewL0Frame(novaprotocol.L0FlagNone, uuid.Nil, l1).Write(w, nil)
+}
+
+// checkJoinToken asks client for join token if server requires one
+func (app *Application) checkJoinToken(rw io.ReadWriter) error {
+	if app.cfg.JoinToken == "" {
+		return nil
+	}
+
+	msg, err := novaprotocol.NewJsonMessage(novaprotocol.MSG_JOIN_REQUEST, struct{}{})
+	if err != nil {
+		return err
+	}
+	if err := writePlainJson(rw, msg); err != nil {
+		return fmt.Errorf("failed to send join request: %w", err)
+	}
+
+	l0frame, err := novaprotocol.ReadL0Frame(rw, nil)
+	if err != nil {
+		return fmt.Errorf("failed to read l0 frame: %w", err)
+	}
+	l1frame, err := novaprotocol.ParseL1Frame(l0frame.GetData(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to read l1 frame: %w", err)
+	}
+	messageType, err := novaprotocol.ParseJsonMessageType(l1frame.GetData())
+	if err != nil {
+		return fmt.Errorf("failed to parse message type: %w", err)
+	}
+	join, err := novaprotocol.ParseJsonMessage[handshake.JoinClient2Server](l1frame.GetData())
+	if messageType != novaprotocol.MSG_JOIN || err != nil || join == nil {
+		reject(rw, serverapi.ErrorBadRequest, fmt.Errorf("join token expected"))
+		return fmt.Errorf("unexpected join message %s", messageType)
+	}
+	if subtle.ConstantTimeCompare([]byte(join.Token), []byte(app.cfg.JoinToken)) != 1 {
+		app.metrics.connectionsRejected.Inc(rejectJoinToken)
+		reject(rw, serverapi.ErrorUnauthorized, fmt.Errorf("invalid join token"))
+		return fmt.Errorf("invalid join token")
+	}
+	return nil
+}
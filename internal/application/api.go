@@ -12,6 +12,7 @@ func (app *Application) routeAPI(client clientmanager.Client, l0Frame *novaproto
 	// Message for server, so l1 should be unencrypted
 	l1Frame, err := novaprotocol.ParseL1Frame(l0Frame.GetData(), nil)
 	if err != nil {
+		app.countFrameError(err)
 		return fmt.Errorf("failed to parse l1 frame: %v", err)
 	}
 
@@ -21,9 +22,38 @@ func (app *Application) routeAPI(client clientmanager.Client, l0Frame *novaproto
 		if err != nil {
 			return fmt.Errorf("failed to parse msg type: %w", err)
 		}
+		if app.pluginsServerMessage(client, msgType, l1Frame.GetData()) {
+			return nil
+		}
 		switch msgType {
 		case novaprotocol.MSG_LIST_CONN:
 			err = app.listConnections(client)
+		case novaprotocol.MSG_PING:
+			err = app.ping(client, l1Frame.GetData())
+		case novaprotocol.MSG_PONG:
+			err = app.pong(client, l1Frame.GetData())
+		case novaprotocol.MSG_REKEY:
+			err = app.finishRekey(client, l1Frame.GetData())
+		case novaprotocol.MSG_PRESENCE:
+			err = app.updatePresence(client, l1Frame.GetData())
+		case novaprotocol.MSG_NICKNAME_CHANGE:
+			err = app.changeNickname(client, l1Frame.GetData())
+		case novaprotocol.MSG_ROOM_JOIN:
+			err = app.joinRoom(client, l1Frame.GetData())
+		case novaprotocol.MSG_ROOM_LEAVE:
+			err = app.leaveRoom(client, l1Frame.GetData())
+		case novaprotocol.MSG_MESSAGE_SEND, novaprotocol.MSG_MESSAGE_EDIT,
+			novaprotocol.MSG_MESSAGE_DELETE, novaprotocol.MSG_MESSAGE_REACT:
+			err = app.messageOp(client, msgType, l1Frame.GetData())
+		case novaprotocol.MSG_HISTORY:
+			err = app.historyPage(client, l1Frame.GetData())
+		case novaprotocol.MSG_ACCOUNT_CREATE, novaprotocol.MSG_DEVICE_LOGIN, novaprotocol.MSG_DEVICE_LINK_CODE,
+			novaprotocol.MSG_DEVICE_LINK, novaprotocol.MSG_DEVICE_LINK_CONFIRM, novaprotocol.MSG_DEVICE_LIST,
+			novaprotocol.MSG_DEVICE_REVOKE:
+			err = app.routeDevices(client, msgType, l1Frame.GetData())
+		case novaprotocol.MSG_ADMIN_AUTH, novaprotocol.MSG_ADMIN_KICK, novaprotocol.MSG_ADMIN_BAN,
+			novaprotocol.MSG_ADMIN_UNBAN, novaprotocol.MSG_ADMIN_LIST_BANS, novaprotocol.MSG_ADMIN_MUTE:
+			err = app.routeAdmin(client, msgType, l1Frame.GetData())
 		}
 		if err != nil {
 			return fmt.Errorf("failed to execute api method: %w", err)
@@ -36,13 +66,30 @@ func (app *Application) routeAPI(client clientmanager.Client, l0Frame *novaproto
 	return nil
 }
 
+func clientInfo(c clientmanager.Client) *serverapi.Client {
+	status, statusText := c.GetStatus()
+	accountID, _ := c.GetAccount()
+	return &serverapi.Client{
+		ID:         c.GetID(),
+		Nickname:   c.GetNickname(),
+		Account:    accountID,
+		Status:     status,
+		StatusText: statusText,
+	}
+}
+
+// allClients lists clients of the whole cluster, bots included
+func (app *Application) allClients() []*serverapi.Client {
+	clients := linq.Select(app.clientManager.ListClients(), clientInfo)
+	clients = append(clients, app.listBots()...)
+	for _, remote := range app.cluster.ListClients() {
+		clients = append(clients, &remote)
+	}
+	return clients
+}
+
 func (app *Application) listConnections(client clientmanager.Client) error {
-	resp := linq.Select(app.clientManager.ListClients(), func(c clientmanager.Client) *serverapi.Client {
-		return &serverapi.Client{
-			ID:       c.GetID(),
-			Nickname: c.GetNickname(),
-		}
-	})
+	resp := app.allClients()
 	msg, err := novaprotocol.NewJsonMessage(novaprotocol.MSG_LIST_CONN, resp)
 	if err != nil {
 		return err
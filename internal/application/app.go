@@ -2,38 +2,288 @@ package application
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"novachat-server/common/ratelimit"
+	"novachat-server/common/safemap"
+	"novachat-server/internal/account"
+	"novachat-server/internal/bus"
 	"novachat-server/internal/clientmanager"
+	"novachat-server/internal/cluster"
 	"novachat-server/internal/config"
+	"novachat-server/internal/history"
+	"novachat-server/internal/moderation"
+	"novachat-server/internal/plugin"
+	"novachat-server/internal/webhook"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/google/uuid"
 	"golang.org/x/net/websocket"
 )
 
 type Application struct {
-	ctx context.Context
-	cfg *config.AppConfig
+	ctx    context.Context
+	cfg    *config.AppConfig
+	logger *slog.Logger
+
+	// Connections outlive ctx for the drain period
+	connCtx    context.Context
+	connCancel context.CancelFunc
+	ready      atomic.Bool
+	startedAt  time.Time
+	done       chan struct{}
+	// Running connection handlers, shutdown waits for them before closing stores
+	handlersMutex sync.Mutex
+	handlers      sync.WaitGroup
 
 	clientManager clientmanager.ClientManager
+	// Per client presence limiters, ephemeral signals must not flood peers
+	presenceLimiters safemap.Safemap[uuid.UUID, ratelimit.Limiter]
+	heartbeats       safemap.Safemap[uuid.UUID, *heartbeat]
+	rekeys           safemap.Safemap[uuid.UUID, *rekeyState]
+	rooms            safemap.Safemap[uuid.UUID, *clientRooms]
+
+	// Fan-out to client connections
+	bus bus.Bus
+
+	plugins      []plugin.Plugin
+	bots         safemap.Safemap[uuid.UUID, *botClient]
+	integrations []*integration
+
+	admission admission
+	banList   moderation.BanList
+	cluster   cluster.Cluster
+	history   history.Store
+	accounts  account.Store
+	devices   onlineDevices
+	links     deviceLinks
+
+	webhooks   webhook.Dispatcher
+	deadLetter *os.File
+
+	floodCounters floodCounters
+	metrics       appMetrics
+
+	mux *http.ServeMux
 }
 
-func NewApplication(ctx context.Context, cfg *config.AppConfig) (*Application, error) {
+func NewApplication(ctx context.Context, cfg *config.AppConfig, logger *slog.Logger) (*Application, error) {
+	banList, err := moderation.NewBanList(cfg.BansFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load bans: %w", err)
+	}
+
+	historyStore, err := history.NewStore(cfg.HistoryFile, cfg.HistoryLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load history: %w", err)
+	}
+
+	accounts, err := account.NewStore(cfg.AccountsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load accounts: %w", err)
+	}
+
+	clusterLink, err := newCluster(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks, deadLetter, err := newWebhooks(cfg, clusterLink.NodeID(), logger)
+	if err != nil {
+		return nil, err
+	}
+
+	connCtx, connCancel := context.WithCancel(context.WithoutCancel(ctx))
 	app := &Application{
-		ctx:           ctx,
-		cfg:           cfg,
-		clientManager: clientmanager.NewClientManager(),
+		ctx:              ctx,
+		connCtx:          connCtx,
+		connCancel:       connCancel,
+		done:             make(chan struct{}),
+		cfg:              cfg,
+		logger:           logger,
+		clientManager:    clientmanager.NewClientManager(logger),
+		presenceLimiters: safemap.New[uuid.UUID, ratelimit.Limiter](),
+		heartbeats:       safemap.New[uuid.UUID, *heartbeat](),
+		rekeys:           safemap.New[uuid.UUID, *rekeyState](),
+		rooms:            safemap.New[uuid.UUID, *clientRooms](),
+		bots:             safemap.New[uuid.UUID, *botClient](),
+		bus:              bus.NewLocalBus(cfg.BusQueueSize),
+		banList:          banList,
+		cluster:          clusterLink,
+		history:          historyStore,
+		accounts:         accounts,
+		webhooks:         webhooks,
+		deadLetter:       deadLetter,
+		mux:              http.NewServeMux(),
+	}
+	app.admission.perAddr = make(map[string]int)
+	app.devices.accounts = make(map[uuid.UUID]map[uuid.UUID]deviceConn)
+	app.links.codes = make(map[string]*pendingLink)
+	app.initMetrics()
+	if err := app.registerIntegrations(); err != nil {
+		return nil, err
 	}
 
 	return app, nil
 }
 
 func (app *Application) Start() error {
+	app.mux.Handle("/ws", websocket.Server{Handshake: app.checkOrigin, Handler: func(c *websocket.Conn) {
+		if !app.acceptConnection() {
+			c.Close()
+			return
+		}
+		remoteAddr := remoteHost(c.Request().RemoteAddr)
+		err := app.connectionHandler(c, remoteAddr)
+		if err != nil {
+			app.logger.Warn("client connection failed", slog.String("remote_addr", remoteAddr), slog.Any("error", err))
+		}
+	}})
+	app.mux.Handle("/metrics", app.metrics.registry)
+	app.mux.HandleFunc("/healthz", app.healthz)
+	app.mux.HandleFunc("/readyz", app.readyz)
+	app.mux.HandleFunc("/status", app.status)
+	app.mux.HandleFunc("GET /api/v1/clients", app.apiClients)
+	app.mux.HandleFunc("POST /api/v1/messages", app.apiPostMessage)
+
+	server := &http.Server{Handler: app.mux}
+	servers := []*http.Server{server}
+	listeners := []net.Listener{}
+	if app.tlsEnabled() {
+		tlsConfig, manager, err := app.tlsConfig()
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = tlsConfig
+
+		if app.cfg.HttpRedirectHostname != "" {
+			redirect := app.redirectHandler()
+			if manager != nil {
+				// Also answers ACME http-01 challenges
+				redirect = manager.HTTPHandler(redirect)
+			}
+			redirectServer := &http.Server{Addr: app.cfg.HttpRedirectHostname, Handler: redirect}
+			servers = append(servers, redirectServer)
+			go func() {
+				err := redirectServer.ListenAndServe()
+				if err != http.ErrServerClosed {
+					app.logger.Error("http redirect server stopped", slog.Any("error", err))
+				}
+			}()
+		}
+	}
+
+	if err := app.cluster.Start(clusterHandler{app: app}); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", app.cfg.HttpHostname)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	app.logger.Info("server started", slog.String("addr", listener.Addr().String()), slog.Bool("tls", app.tlsEnabled()))
+
+	if app.cfg.TcpHostname != "" {
+		tcpListener, err := app.listenTcp(server.TLSConfig)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		listeners = append(listeners, tcpListener)
+	}
+
+	app.startedAt = time.Now()
 	go func() {
-		http.Handle("/ws", websocket.Handler(func(c *websocket.Conn) {
-			err := app.connectionHandler(c)
-			log.Printf("failed to handle client connection: %s", err)
-		}))
-		log.Fatal(http.ListenAndServe(":8080", nil))
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != http.ErrServerClosed {
+			app.logger.Error("http server stopped", slog.Any("error", err))
+		}
 	}()
+	go app.shutdown(servers, listeners)
+
+	app.ready.Store(true)
 	return nil
 }
+
+// Done is closed when server is completely stopped
+func (app *Application) Done() <-chan struct{} {
+	return app.done
+}
+
+// acceptConnection registers connection handler, false once server is not ready.
+// Handler must call handlers.Done when accepted
+func (app *Application) acceptConnection() bool {
+	app.handlersMutex.Lock()
+	defer app.handlersMutex.Unlock()
+	if !app.ready.Load() {
+		return false
+	}
+	app.handlers.Add(1)
+	return true
+}
+
+// shutdown waits for ctx, drains and stops the servers and raw listeners
+func (app *Application) shutdown(servers []*http.Server, listeners []net.Listener) {
+	defer close(app.done)
+	<-app.ctx.Done()
+
+	app.handlersMutex.Lock()
+	app.ready.Store(false)
+	app.handlersMutex.Unlock()
+	app.logger.Info("draining", slog.Duration("drain", app.cfg.ShutdownDrain))
+	time.Sleep(app.cfg.ShutdownDrain)
+
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	app.connCancel()
+	ctx, cancel := context.WithTimeout(context.Background(), app.cfg.ShutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			app.logger.Warn("failed to shutdown http server", slog.Any("error", err))
+		}
+	}
+	// Hijacked websocket and raw tcp connections are not tracked by http server,
+	// their cleanup still writes to the stores closed below
+	handled := make(chan struct{})
+	go func() {
+		app.handlers.Wait()
+		close(handled)
+	}()
+	select {
+	case <-handled:
+	case <-ctx.Done():
+		app.logger.Warn("connection handlers did not finish in time")
+	}
+	if err := app.cluster.Stop(); err != nil {
+		app.logger.Warn("failed to leave cluster", slog.Any("error", err))
+	}
+	app.bus.Close()
+	app.webhooks.Close()
+	if err := app.history.Close(); err != nil {
+		app.logger.Warn("failed to close history", slog.Any("error", err))
+	}
+	if app.deadLetter != nil {
+		app.deadLetter.Close()
+	}
+}
+
+// remoteHost strips port from remote address
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,746 @@
+package application_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"novachat-server/internal/application"
+	"novachat-server/internal/config"
+	"novachat-server/internal/plugin"
+	"novachat-server/novaclient"
+	"novachat-server/novaprotocol"
+	"novachat-server/novaprotocol/handshake"
+	"novachat-server/novaprotocol/serverapi"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// startServer runs application on free local port, returns its websocket url
+func startServer(t *testing.T, configure func(cfg *config.AppConfig)) string {
+	t.Helper()
+	return startApp(t, configure, nil)
+}
+
+// startApp is startServer with plugins registered by register before start
+func startApp(t *testing.T, configure func(cfg *config.AppConfig), register func(app *application.Application) error) string {
+	t.Helper()
+	return launch(t, context.Background(), configure, register)
+}
+
+// launch is startApp stopped also when parent is canceled
+func launch(t *testing.T, parent context.Context, configure func(cfg *config.AppConfig), register func(app *application.Application) error) string {
+	t.Helper()
+	cfg, err := config.LoadAppConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.HttpHostname = freeAddr(t)
+	cfg.BansFile, cfg.HistoryFile, cfg.AccountsFile, cfg.WebhookDeadLetterFile = "", "", "", ""
+	cfg.ShutdownDrain = 0
+	if configure != nil {
+		configure(cfg)
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	app, err := application.NewApplication(ctx, cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if register != nil {
+		if err := register(app); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := app.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		<-app.Done()
+	})
+	if cfg.TlsCertFile != "" {
+		return "wss://" + cfg.HttpHostname + "/ws"
+	}
+	return "ws://" + cfg.HttpHostname + "/ws"
+}
+
+// freeAddr returns local address nobody listens on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func dial(t *testing.T, url, nickname string) novaclient.Client {
+	t.Helper()
+	return dialConfig(t, novaclient.Config{URL: url, Nickname: nickname})
+}
+
+func dialConfig(t *testing.T, cfg novaclient.Config) novaclient.Client {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := novaclient.Dial(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func send(t *testing.T, c novaclient.Client, msgType string, v any) {
+	t.Helper()
+	msg, err := novaprotocol.NewJsonMessage(msgType, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendServer(msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// await skips frames until server message of msgType, MSG_ERROR answering it fails test
+func await[T any](t *testing.T, c novaclient.Client, msgType string) *T {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case frame, ok := <-c.Frames():
+			if !ok {
+				t.Fatalf("connection lost waiting for %s: %v", msgType, c.Err())
+			}
+			if frame.GetOrigin() != uuid.Nil {
+				continue
+			}
+			l1, err := novaprotocol.ParseL1Frame(frame.GetData(), nil)
+			if err != nil {
+				continue
+			}
+			got, err := novaprotocol.ParseJsonMessageType(l1.GetData())
+			if err != nil {
+				continue
+			}
+			if got == novaprotocol.MSG_ERROR {
+				e, _ := novaprotocol.ParseJsonMessage[serverapi.Error](l1.GetData())
+				if e != nil && e.Request == msgType {
+					t.Fatalf("%s failed: %s %s", msgType, e.Code, e.Message)
+				}
+				continue
+			}
+			if got != msgType {
+				continue
+			}
+			v, err := novaprotocol.ParseJsonMessage[T](l1.GetData())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		case <-timeout:
+			t.Fatalf("no %s from server", msgType)
+		}
+	}
+}
+
+func TestHistoryAcrossReconnect(t *testing.T) {
+	url := startServer(t, nil)
+	alice := dial(t, url, "alice")
+	send(t, alice, novaprotocol.MSG_ACCOUNT_CREATE, &serverapi.AccountCreate{DeviceName: "laptop"})
+	creds := await[serverapi.DeviceCredentials](t, alice, novaprotocol.MSG_ACCOUNT_CREATE)
+	bob := dial(t, url, "bob")
+	send(t, bob, novaprotocol.MSG_ACCOUNT_CREATE, &serverapi.AccountCreate{DeviceName: "phone"})
+	bobCreds := await[serverapi.DeviceCredentials](t, bob, novaprotocol.MSG_ACCOUNT_CREATE)
+
+	id := uuid.New()
+	send(t, alice, novaprotocol.MSG_MESSAGE_SEND, &serverapi.MessageOp{ID: id, Destination: bob.GetID(), Frame: []byte("hello")})
+	stored := await[serverapi.MessageStored](t, alice, novaprotocol.MSG_MESSAGE_SEND)
+	alice.Close()
+	bob.Close()
+
+	// Both sides come back with new connection ids
+	alice = dial(t, url, "alice")
+	send(t, alice, novaprotocol.MSG_DEVICE_LOGIN, creds)
+	await[serverapi.Device](t, alice, novaprotocol.MSG_DEVICE_LOGIN)
+	bob = dial(t, url, "bob")
+	send(t, bob, novaprotocol.MSG_DEVICE_LOGIN, bobCreds)
+	await[serverapi.Device](t, bob, novaprotocol.MSG_DEVICE_LOGIN)
+
+	send(t, alice, novaprotocol.MSG_MESSAGE_EDIT, &serverapi.MessageOp{ID: id, Destination: bob.GetID(), Frame: []byte("hello!")})
+	await[serverapi.MessageStored](t, alice, novaprotocol.MSG_MESSAGE_EDIT)
+
+	send(t, bob, novaprotocol.MSG_HISTORY, &serverapi.HistoryRequest{With: alice.GetID()})
+	page := await[serverapi.HistoryPage](t, bob, novaprotocol.MSG_HISTORY)
+	if page.Conversation != stored.Conversation || len(page.Messages) != 1 {
+		t.Fatalf("conversation lost after reconnect: %+v", page)
+	}
+	if m := page.Messages[0]; m.Author != creds.Account || string(m.Edit) != "hello!" {
+		t.Errorf("unexpected message %+v", m)
+	}
+}
+
+// awaitError waits for MSG_ERROR answering msgType
+func awaitError(t *testing.T, c novaclient.Client, msgType string) *serverapi.Error {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case frame, ok := <-c.Frames():
+			if !ok {
+				t.Fatalf("connection lost waiting for %s error: %v", msgType, c.Err())
+			}
+			l1, err := novaprotocol.ParseL1Frame(frame.GetData(), nil)
+			if err != nil || frame.GetOrigin() != uuid.Nil {
+				continue
+			}
+			if got, _ := novaprotocol.ParseJsonMessageType(l1.GetData()); got != novaprotocol.MSG_ERROR {
+				continue
+			}
+			if e, _ := novaprotocol.ParseJsonMessage[serverapi.Error](l1.GetData()); e != nil && e.Request == msgType {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("no %s error from server", msgType)
+		}
+	}
+}
+
+func TestIdentityBanOnRename(t *testing.T) {
+	url := startServer(t, func(cfg *config.AppConfig) { cfg.AdminToken = "secret" })
+	admin := dial(t, url, "admin")
+	send(t, admin, novaprotocol.MSG_ADMIN_AUTH, &serverapi.AdminAuth{Token: "secret"})
+	await[serverapi.Client](t, admin, novaprotocol.MSG_ADMIN_AUTH)
+	send(t, admin, novaprotocol.MSG_ADMIN_BAN, &serverapi.AdminBan{Kind: serverapi.BanKindIdentity, Value: "mallory", Reason: "spam"})
+	await[serverapi.Ban](t, admin, novaprotocol.MSG_ADMIN_BAN)
+
+	alice := dial(t, url, "alice")
+	send(t, alice, novaprotocol.MSG_NICKNAME_CHANGE, &serverapi.NicknameChange{Nickname: "Mallory"})
+	if e := awaitError(t, alice, novaprotocol.MSG_NICKNAME_CHANGE); e.Code != serverapi.ErrorBanned {
+		t.Errorf("rename to banned nickname answered with %s", e.Code)
+	}
+}
+
+// awaitPeer waits for frame of origin and returns its data
+func awaitPeer(t *testing.T, c novaclient.Client, origin uuid.UUID) []byte {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case frame, ok := <-c.Frames():
+			if !ok {
+				t.Fatalf("connection lost waiting for frame of %s: %v", origin, c.Err())
+			}
+			if frame.GetOrigin() == origin {
+				return frame.GetData()
+			}
+		case <-timeout:
+			t.Fatalf("no frame from %s", origin)
+		}
+	}
+}
+
+// linkDevice links new connection as device of account issuer is signed in to
+func linkDevice(t *testing.T, url string, issuer novaclient.Client, nickname string) (novaclient.Client, *serverapi.DeviceCredentials) {
+	t.Helper()
+	send(t, issuer, novaprotocol.MSG_DEVICE_LINK_CODE, struct{}{})
+	code := await[serverapi.DeviceLinkCode](t, issuer, novaprotocol.MSG_DEVICE_LINK_CODE)
+	device := dial(t, url, nickname)
+	send(t, device, novaprotocol.MSG_DEVICE_LINK, &serverapi.DeviceLink{Code: code.Code, Name: nickname})
+	req := await[serverapi.DeviceLinkRequest](t, issuer, novaprotocol.MSG_DEVICE_LINK_REQUEST)
+	if req.Client != device.GetID() {
+		t.Fatalf("link request of unexpected client %s", req.Client)
+	}
+	send(t, issuer, novaprotocol.MSG_DEVICE_LINK_CONFIRM, &serverapi.DeviceLinkConfirm{Code: code.Code, Approve: true})
+	await[serverapi.Device](t, issuer, novaprotocol.MSG_DEVICE_LINK_CONFIRM)
+	return device, await[serverapi.DeviceCredentials](t, device, novaprotocol.MSG_DEVICE_LINK)
+}
+
+func TestAccountFanOut(t *testing.T) {
+	url := startServer(t, nil)
+	laptop := dial(t, url, "alice")
+	send(t, laptop, novaprotocol.MSG_ACCOUNT_CREATE, &serverapi.AccountCreate{DeviceName: "laptop"})
+	creds := await[serverapi.DeviceCredentials](t, laptop, novaprotocol.MSG_ACCOUNT_CREATE)
+	phone, _ := linkDevice(t, url, laptop, "alice-phone")
+	bob := dial(t, url, "bob")
+
+	// Every device gets only the frame sealed for its own session key
+	err := bob.SendAccount(creds.Account, map[uuid.UUID][]byte{laptop.GetID(): []byte("laptop"), phone.GetID(): []byte("phone")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for c, want := range map[novaclient.Client]string{laptop: "laptop", phone: "phone"} {
+		if got := awaitPeer(t, c, bob.GetID()); string(got) != want {
+			t.Errorf("device got frame %q, want %q", got, want)
+		}
+	}
+}
+
+func TestDeviceRevoke(t *testing.T) {
+	url := startServer(t, nil)
+	laptop := dial(t, url, "alice")
+	send(t, laptop, novaprotocol.MSG_ACCOUNT_CREATE, &serverapi.AccountCreate{DeviceName: "laptop"})
+	await[serverapi.DeviceCredentials](t, laptop, novaprotocol.MSG_ACCOUNT_CREATE)
+	phone, phoneCreds := linkDevice(t, url, laptop, "alice-phone")
+
+	send(t, laptop, novaprotocol.MSG_DEVICE_REVOKE, &serverapi.DeviceRevoke{ID: phoneCreds.Device})
+	if d := await[serverapi.Device](t, laptop, novaprotocol.MSG_DEVICE_REVOKE); d.RevokedAt.IsZero() {
+		t.Errorf("device not revoked: %+v", d)
+	}
+	await[serverapi.Kicked](t, phone, novaprotocol.MSG_KICKED)
+
+	again := dial(t, url, "alice-phone")
+	send(t, again, novaprotocol.MSG_DEVICE_LOGIN, phoneCreds)
+	if e := awaitError(t, again, novaprotocol.MSG_DEVICE_LOGIN); e.Code != serverapi.ErrorUnauthorized {
+		t.Errorf("revoked device login answered with %s", e.Code)
+	}
+}
+
+func TestAccountsRefusedInCluster(t *testing.T) {
+	url := startServer(t, func(cfg *config.AppConfig) {
+		listener, _ := net.Listen("tcp", "127.0.0.1:0")
+		cfg.ClusterListen = listener.Addr().String()
+		listener.Close()
+		cfg.ClusterSecret = "secret"
+	})
+	alice := dial(t, url, "alice")
+	if slices.Contains(alice.GetCapabilities(), handshake.CapAccounts) {
+		t.Error("clustered server offered accounts")
+	}
+	send(t, alice, novaprotocol.MSG_ACCOUNT_CREATE, &serverapi.AccountCreate{DeviceName: "laptop"})
+	awaitError(t, alice, novaprotocol.MSG_ACCOUNT_CREATE)
+}
+
+func TestBannedAddressRejected(t *testing.T) {
+	url := startServer(t, func(cfg *config.AppConfig) { cfg.AdminToken = "secret" })
+	admin := dial(t, url, "admin")
+	send(t, admin, novaprotocol.MSG_ADMIN_AUTH, &serverapi.AdminAuth{Token: "secret"})
+	await[serverapi.Client](t, admin, novaprotocol.MSG_ADMIN_AUTH)
+	send(t, admin, novaprotocol.MSG_ADMIN_BAN, &serverapi.AdminBan{Kind: serverapi.BanKindIP, Value: "127.0.0.1", Reason: "spam"})
+	// Admin shares the address, so it is kicked too
+	await[serverapi.Kicked](t, admin, novaprotocol.MSG_KICKED)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := novaclient.Dial(ctx, novaclient.Config{URL: url, Nickname: "mallory"})
+	var serverErr *novaclient.ServerError
+	if !errors.As(err, &serverErr) || serverErr.Code != serverapi.ErrorBanned {
+		t.Errorf("banned address got no reason: %v", err)
+	}
+}
+
+// greedyPlugin consumes every server message it sees
+type greedyPlugin struct {
+	plugin.Base
+	seen chan string
+}
+
+func (greedyPlugin) Name() string { return "greedy" }
+
+func (p greedyPlugin) OnServerMessage(_ serverapi.Client, msgType string, _ []byte) bool {
+	p.seen <- msgType
+	return true
+}
+
+func TestPluginsSkipAdminMessages(t *testing.T) {
+	greedy := greedyPlugin{seen: make(chan string, 16)}
+	url := startApp(t, func(cfg *config.AppConfig) { cfg.AdminToken = "secret" }, func(app *application.Application) error {
+		return app.RegisterPlugin(greedy)
+	})
+	admin := dial(t, url, "admin")
+	send(t, admin, novaprotocol.MSG_ADMIN_AUTH, &serverapi.AdminAuth{Token: "secret"})
+	await[serverapi.Client](t, admin, novaprotocol.MSG_ADMIN_AUTH)
+	send(t, admin, novaprotocol.MSG_LIST_CONN, struct{}{})
+	select {
+	case msgType := <-greedy.seen:
+		if msgType != novaprotocol.MSG_LIST_CONN {
+			t.Errorf("plugin saw %s", msgType)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("plugin saw no message")
+	}
+}
+
+// httpURL turns websocket url of server into url of http endpoint
+func httpURL(url, path string) string {
+	return "http://" + strings.TrimSuffix(strings.TrimPrefix(url, "ws://"), "/ws") + path
+}
+
+// postMessage posts text to room through integration api, returns response status
+func postMessage(t *testing.T, url, token, room, text string) int {
+	t.Helper()
+	api := httpURL(url, "/api/v1/messages")
+	body, _ := json.Marshal(&serverapi.PostMessage{Room: room, Text: text})
+	req, err := http.NewRequest(http.MethodPost, api, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestIntegrationRateLimited(t *testing.T) {
+	url := startServer(t, func(cfg *config.AppConfig) {
+		cfg.Integrations = map[string]string{"deploy": "secret"}
+		cfg.RateFramesPerSec, cfg.RateFramesBurst = 0.001, 1
+	})
+	if status := postMessage(t, url, "secret", "ops", "deployed"); status != http.StatusAccepted {
+		t.Fatalf("first post: %d", status)
+	}
+	if status := postMessage(t, url, "secret", "ops", "deployed"); status != http.StatusTooManyRequests {
+		t.Errorf("second post: %d", status)
+	}
+}
+
+// relayPlugin records destinations of relayed frames
+type relayPlugin struct {
+	plugin.Base
+	relayed chan uuid.UUID
+}
+
+func (relayPlugin) Name() string { return "relay" }
+
+func (p relayPlugin) OnRelay(_ serverapi.Client, destination uuid.UUID, _ []byte) bool {
+	p.relayed <- destination
+	return true
+}
+
+func TestIntegrationPostsSeenByPlugins(t *testing.T) {
+	relay := relayPlugin{relayed: make(chan uuid.UUID, 16)}
+	url := startApp(t, func(cfg *config.AppConfig) {
+		cfg.Integrations = map[string]string{"deploy": "secret"}
+	}, func(app *application.Application) error {
+		return app.RegisterPlugin(relay)
+	})
+	if status := postMessage(t, url, "secret", "ops", "deployed"); status != http.StatusAccepted {
+		t.Fatalf("post: %d", status)
+	}
+	select {
+	case <-relay.relayed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("plugin did not see integration post")
+	}
+}
+
+// metric returns value of counter from /metrics
+func metric(t *testing.T, url, name string) float64 {
+	t.Helper()
+	resp, err := http.Get(httpURL(url, "/metrics"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, name+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+	}
+	t.Fatalf("no metric %s", name)
+	return 0
+}
+
+// exchange sends numbered frames both ways, each must arrive
+func exchange(t *testing.T, alice, bob novaclient.Client, count int) {
+	t.Helper()
+	for i := range count {
+		text := fmt.Sprintf("message %d", i)
+		if err := alice.SendPeer(bob.GetID(), []byte(text)); err != nil {
+			t.Fatal(err)
+		}
+		if got := awaitPeer(t, bob, alice.GetID()); string(got) != text {
+			t.Fatalf("bob got %q, want %q", got, text)
+		}
+		if err := bob.SendPeer(alice.GetID(), []byte(text)); err != nil {
+			t.Fatal(err)
+		}
+		if got := awaitPeer(t, alice, bob.GetID()); string(got) != text {
+			t.Fatalf("alice got %q, want %q", got, text)
+		}
+	}
+}
+
+func TestRekeyMidSession(t *testing.T) {
+	url := startServer(t, func(cfg *config.AppConfig) {
+		cfg.RekeyFrames = 8
+		// Rate limited answer must still switch the key
+		cfg.RateApiPerSec, cfg.RateApiBurst, cfg.RateDisconnectAfter = 0.001, 1, 1000
+	})
+	alice := dial(t, url, "alice")
+	bob := dial(t, url, "bob")
+	exchange(t, alice, bob, 30)
+	if rekeys := metric(t, url, "nova_rekeys_total"); rekeys < 4 {
+		t.Errorf("only %v rekeys", rekeys)
+	}
+}
+
+func TestRekeyUnanswered(t *testing.T) {
+	url := startServer(t, func(cfg *config.AppConfig) {
+		cfg.RekeyFrames = 8
+		cfg.HandshakeTimeout = 100 * time.Millisecond
+	})
+	alice := dial(t, url, "alice")
+	bob := dial(t, url, "bob")
+
+	// Alice stops reading, so rekey sent to her stays unanswered past the timeout while she keeps sending
+	for range 80 {
+		if err := bob.SendPeer(alice.GetID(), []byte("flood")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(20 * time.Millisecond):
+				alice.SendPeer(bob.GetID(), []byte("ping"))
+			}
+		}
+	}()
+	if lost := await[serverapi.Client](t, bob, novaprotocol.MSG_CONNECTION_LOST); lost.ID != alice.GetID() {
+		t.Fatalf("unexpected client lost %s", lost.ID)
+	}
+	exchange(t, bob, dial(t, url, "carol"), 10)
+}
+
+func TestTcpTransport(t *testing.T) {
+	tcpAddr := freeAddr(t)
+	url := startServer(t, func(cfg *config.AppConfig) { cfg.TcpHostname = tcpAddr })
+	alice := dial(t, url, "alice")
+	bob := dial(t, "tcp://"+tcpAddr, "bob")
+	exchange(t, alice, bob, 3)
+}
+
+// selfSigned writes certificate for 127.0.0.1 and its key, returns their files and pool trusting it
+func selfSigned(t *testing.T) (string, string, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "novachat test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(t.TempDir(), "cert.pem"), filepath.Join(t.TempDir(), "key.pem")
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certFile, certPem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPem)
+	return certFile, keyFile, pool
+}
+
+func TestTlsTransport(t *testing.T) {
+	certFile, keyFile, pool := selfSigned(t)
+	tcpAddr := freeAddr(t)
+	url := startServer(t, func(cfg *config.AppConfig) {
+		cfg.TlsCertFile, cfg.TlsKeyFile = certFile, keyFile
+		cfg.TcpHostname = tcpAddr
+	})
+	alice := dialConfig(t, novaclient.Config{URL: url, Nickname: "alice", RootCAs: pool})
+	// Websocket is served only over tls once certificates are configured, raw tcp stays plain
+	bob := dial(t, "tcp://"+tcpAddr, "bob")
+	exchange(t, alice, bob, 3)
+
+	untrusted, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := novaclient.Dial(untrusted, novaclient.Config{URL: url, Nickname: "mallory"}); err == nil {
+		t.Error("connected without trusting certificate")
+	}
+}
+
+// get requests http endpoint of server, returns status code and body
+func get(t *testing.T, url, path, token string) (int, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, httpURL(url, path), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, body
+}
+
+func TestReadiness(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	url := launch(t, ctx, func(cfg *config.AppConfig) {
+		cfg.StatusToken = "secret"
+		cfg.ShutdownDrain = 500 * time.Millisecond
+	}, nil)
+	alice := dial(t, url, "alice")
+
+	if code, _ := get(t, url, "/healthz", ""); code != http.StatusOK {
+		t.Errorf("healthz answered %d", code)
+	}
+	if code, _ := get(t, url, "/readyz", ""); code != http.StatusOK {
+		t.Errorf("readyz answered %d while serving", code)
+	}
+	if code, _ := get(t, url, "/status", ""); code != http.StatusUnauthorized {
+		t.Errorf("status answered %d without token", code)
+	}
+	code, body := get(t, url, "/status", "secret")
+	var status serverapi.Status
+	if err := json.Unmarshal(body, &status); err != nil || code != http.StatusOK {
+		t.Fatalf("status answered %d: %v", code, err)
+	}
+	if !status.Ready || len(status.Clients) != 1 || status.Clients[0].ID != alice.GetID() {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	// Draining server keeps answering but reports not ready
+	stop()
+	deadline := time.Now().Add(400 * time.Millisecond)
+	for {
+		code, _ := get(t, url, "/readyz", "")
+		if code == http.StatusServiceUnavailable {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("readyz answered %d while draining", code)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandshakeStallClosed(t *testing.T) {
+	tcpAddr := freeAddr(t)
+	startServer(t, func(cfg *config.AppConfig) {
+		cfg.TcpHostname = tcpAddr
+		cfg.HandshakeTimeout = 100 * time.Millisecond
+	})
+	conn, err := net.Dial("tcp", tcpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Client reads server key but never answers
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	received, err := io.Copy(io.Discard, conn)
+	if err != nil {
+		t.Fatalf("connection not closed by server: %v", err)
+	}
+	if received == 0 {
+		t.Error("server did not start key exchange")
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("closed after %s, before handshake timeout", elapsed)
+	}
+}
+
+func TestPresenceSignals(t *testing.T) {
+	url := startServer(t, nil)
+	alice := dial(t, url, "alice")
+	bob := dial(t, url, "bob")
+
+	send(t, alice, novaprotocol.MSG_PRESENCE, &serverapi.Presence{State: serverapi.PresenceAway, Text: "lunch"})
+	if p := await[serverapi.Presence](t, bob, novaprotocol.MSG_PRESENCE); p.ID != alice.GetID() || p.State != serverapi.PresenceAway || p.Text != "lunch" {
+		t.Errorf("unexpected presence %+v", p)
+	}
+	// Typing goes only to the peer and never carries text
+	send(t, alice, novaprotocol.MSG_PRESENCE, &serverapi.Presence{State: serverapi.PresenceTypingStarted, Text: "secret", Peer: bob.GetID()})
+	if p := await[serverapi.Presence](t, bob, novaprotocol.MSG_PRESENCE); p.ID != alice.GetID() || p.State != serverapi.PresenceTypingStarted || p.Text != "" {
+		t.Errorf("unexpected typing %+v", p)
+	}
+}
+
+func TestFloodDisconnect(t *testing.T) {
+	url := startServer(t, func(cfg *config.AppConfig) {
+		cfg.RateFramesPerSec, cfg.RateFramesBurst = 0.001, 10
+		cfg.RateNoticeAfter, cfg.RateDisconnectAfter = 2, 5
+	})
+	alice := dial(t, url, "alice")
+	bob := dial(t, url, "bob")
+	for range 40 {
+		alice.SendPeer(bob.GetID(), []byte("spam"))
+	}
+
+	// Dropped frames are noticed, then sender is cut off
+	if e := awaitError(t, alice, ""); e.Code != serverapi.ErrorRateLimited {
+		t.Errorf("flood answered with %s", e.Code)
+	}
+	delivered := 0
+	timeout := time.After(5 * time.Second)
+	for lost := false; !lost; {
+		select {
+		case frame := <-bob.Frames():
+			if frame.GetOrigin() == alice.GetID() {
+				delivered++
+				continue
+			}
+			l1, err := novaprotocol.ParseL1Frame(frame.GetData(), nil)
+			if err != nil {
+				continue
+			}
+			if msgType, _ := novaprotocol.ParseJsonMessageType(l1.GetData()); msgType == novaprotocol.MSG_CONNECTION_LOST {
+				info, _ := novaprotocol.ParseJsonMessage[serverapi.Client](l1.GetData())
+				lost = info != nil && info.ID == alice.GetID()
+			}
+		case <-timeout:
+			t.Fatal("flooding client not disconnected")
+		}
+	}
+	if delivered > 10 {
+		t.Errorf("%d flood frames delivered past burst", delivered)
+	}
+}
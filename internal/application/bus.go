@@ -0,0 +1,167 @@
+package application
+
+import (
+	"encoding/json"
+	"log/slog"
+	"novachat-server/internal/bus"
+	"novachat-server/internal/clientmanager"
+	"novachat-server/internal/webhook"
+	"novachat-server/novaprotocol"
+	"novachat-server/novaprotocol/serverapi"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// subscribe delivers messages of topic to client connection, frameType labels routed frames metric.
+// Lagging client is disconnected, it resyncs history after reconnect
+func (app *Application) subscribe(client clientmanager.Client, topic string, frameType string) (bus.Subscription, error) {
+	return app.subscribeFrames(client, topic, frameType, nil)
+}
+
+// subscribeAccount delivers to device only its own frame out of serverapi.AccountFrames sent to account
+func (app *Application) subscribeAccount(client clientmanager.Client, accountID uuid.UUID) (bus.Subscription, error) {
+	return app.subscribeFrames(client, bus.AccountTopic(accountID), frameTypeUnicast, func(data []byte) []byte {
+		var frames serverapi.AccountFrames
+		if err := json.Unmarshal(data, &frames); err != nil {
+			return nil
+		}
+		return frames.Frames[client.GetID()]
+	})
+}
+
+// subscribeFrames is subscribe with pick choosing data of client frames for this connection, nil pick keeps data as is
+func (app *Application) subscribeFrames(client clientmanager.Client, topic string, frameType string, pick func(data []byte) []byte) (bus.Subscription, error) {
+	lagging := func() {
+		client.Logger().Warn("client lagging behind, disconnecting", slog.String("topic", topic))
+		if err := client.Close(); err != nil {
+			client.Logger().Warn("failed to close lagging client", slog.Any("error", err))
+		}
+	}
+	return app.bus.Subscribe(topic, func(msg bus.Message) {
+		if msg.Except == client.GetID() {
+			return
+		}
+		data := msg.Data
+		if pick != nil && msg.Origin != uuid.Nil {
+			if data = pick(data); data == nil {
+				return
+			}
+		}
+		destination := msg.Destination
+		if destination == uuid.Nil {
+			destination = client.GetID()
+		}
+		l0 := novaprotocol.NewL0Frame(novaprotocol.L0FlagIsEncrypted, destination, data)
+		l0.SetOrigin(msg.Origin)
+		if err := l0.Write(client, client.Encrypt); err != nil {
+			client.Logger().Warn("failed to deliver message", slog.String("topic", topic), slog.Any("error", err))
+			return
+		}
+		app.metrics.framesRouted.Inc(frameType)
+		if !msg.ReceivedAt.IsZero() {
+			app.metrics.relayLatency.Observe(time.Since(msg.ReceivedAt).Seconds())
+		}
+	}, lagging)
+}
+
+// subscribeClient subscribes established client to its own topics, returned function unsubscribes
+func (app *Application) subscribeClient(client clientmanager.Client) (func(), error) {
+	presence, err := app.subscribe(client, bus.TopicPresence, frameTypeBroadcast)
+	if err != nil {
+		return nil, err
+	}
+	broadcast, err := app.subscribe(client, bus.TopicBroadcast, frameTypeBroadcast)
+	if err != nil {
+		presence.Unsubscribe()
+		return nil, err
+	}
+	direct, err := app.subscribe(client, bus.DirectTopic(client.GetID()), frameTypeUnicast)
+	if err != nil {
+		presence.Unsubscribe()
+		broadcast.Unsubscribe()
+		return nil, err
+	}
+	return func() {
+		presence.Unsubscribe()
+		broadcast.Unsubscribe()
+		direct.Unsubscribe()
+	}, nil
+}
+
+// publishJson publishes server message, nil destination means every subscriber itself
+func (app *Application) publishJson(topic string, except uuid.UUID, destination uuid.UUID, jsonData []byte) {
+	l1, err := novaprotocol.NewL1Frame(novaprotocol.L1FlagIsJson, jsonData).Build(nil)
+	if err == nil {
+		err = app.bus.Publish(topic, bus.Message{Except: except, Destination: destination, Data: l1})
+	}
+	if err != nil {
+		app.logger.Warn("failed to publish message", slog.String("topic", topic), slog.Any("error", err))
+	}
+}
+
+// publishFrame publishes frame of client to topic, sender itself is skipped
+func (app *Application) publishFrame(topic string, l0frame *novaprotocol.NovaFrameL0, receivedAt time.Time) {
+	err := app.bus.Publish(topic, bus.Message{
+		Except:      l0frame.GetOrigin(),
+		Origin:      l0frame.GetOrigin(),
+		Destination: l0frame.GetDestination(),
+		Data:        l0frame.GetData(),
+		ReceivedAt:  receivedAt,
+	})
+	if err != nil {
+		app.logger.Warn("failed to publish frame", slog.String("topic", topic), slog.Any("error", err))
+	}
+}
+
+// isLocal reports whether destination is client or bot of this node
+func (app *Application) isLocal(destination uuid.UUID) bool {
+	if _, ex := app.clientManager.GetClient(destination); ex {
+		return true
+	}
+	return app.bots.Exists(destination)
+}
+
+// relayRoom delivers frame to members of destination room, they may live on any node
+func (app *Application) relayRoom(logger *slog.Logger, l0frame *novaprotocol.NovaFrameL0, receivedAt time.Time) {
+	destination := l0frame.GetDestination()
+	app.publishFrame(bus.RoomTopic(destination), l0frame, receivedAt)
+	app.webhooks.Emit(webhook.EventRoomMessage, &webhook.RoomMessage{Room: destination, Origin: l0frame.GetOrigin(), Size: len(l0frame.GetData())})
+	if err := app.cluster.Multicast(l0frame); err != nil {
+		logger.Warn("failed to multicast room message", slog.String("room", destination.String()), slog.Any("error", err))
+	}
+}
+
+// relay routes frame to local client, room joined by origin or another node
+func (app *Application) relay(logger *slog.Logger, l0frame *novaprotocol.NovaFrameL0, receivedAt time.Time) {
+	destination := l0frame.GetDestination()
+	if app.isLocal(destination) {
+		app.publishFrame(bus.DirectTopic(destination), l0frame, receivedAt)
+		return
+	}
+
+	if app.isRoomMember(l0frame.GetOrigin(), destination) {
+		app.relayRoom(logger, l0frame, receivedAt)
+		return
+	}
+
+	// Destination may live on another node
+	forwarded, err := app.cluster.Forward(l0frame)
+	if err != nil {
+		logger.Warn("failed to forward message", slog.String("destination", destination.String()), slog.Any("error", err))
+		return
+	}
+	if !forwarded {
+		if app.isAccount(destination) {
+			// Devices of account may live on any node
+			app.publishFrame(bus.AccountTopic(destination), l0frame, receivedAt)
+			if err := app.cluster.Multicast(l0frame); err != nil {
+				logger.Warn("failed to multicast account message", slog.String("account", destination.String()), slog.Any("error", err))
+			}
+			return
+		}
+		logger.Debug("unicast target not found", slog.String("destination", destination.String()))
+		return
+	}
+	app.metrics.framesRouted.Inc(frameTypeForwarded)
+}
@@ -0,0 +1,78 @@
+package application
+
+import (
+	"fmt"
+	"log/slog"
+	"novachat-server/internal/bus"
+	"novachat-server/internal/clientmanager"
+	"novachat-server/internal/cluster"
+	"novachat-server/internal/config"
+	"novachat-server/novaprotocol"
+	"novachat-server/novaprotocol/serverapi"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// newCluster creates cluster link from config, standalone server is a cluster of one node
+func newCluster(cfg *config.AppConfig, logger *slog.Logger) (cluster.Cluster, error) {
+	node := cfg.ClusterNode
+	if node == "" {
+		node = uuid.NewString()
+	}
+	if cfg.ClusterListen == "" {
+		return cluster.New(node, cluster.NewMemoryHub().Backend(), logger), nil
+	}
+	if cfg.ClusterSecret == "" {
+		return nil, fmt.Errorf("cluster secret is required")
+	}
+	return cluster.New(node, cluster.NewTcpBackend(cfg.ClusterListen, cfg.ClusterPeers, cfg.ClusterSecret, logger), logger), nil
+}
+
+// announce publishes client info to other nodes
+func (app *Application) announce(client clientmanager.Client) {
+	if err := app.cluster.ClientUp(*clientInfo(client)); err != nil {
+		client.Logger().Warn("failed to announce client to cluster", slog.Any("error", err))
+	}
+}
+
+// clusterHandler delivers traffic from other nodes to local clients
+type clusterHandler struct {
+	app *Application
+}
+
+// localTopic is direct topic for local client or account topic for account with local devices,
+// any other destination is treated as room
+func (h clusterHandler) localTopic(destination uuid.UUID) string {
+	if h.app.isLocal(destination) {
+		return bus.DirectTopic(destination)
+	}
+	if h.app.devices.has(destination) {
+		return bus.AccountTopic(destination)
+	}
+	return bus.RoomTopic(destination)
+}
+
+func (h clusterHandler) DeliverFrame(frame *novaprotocol.NovaFrameL0) {
+	h.app.publishFrame(h.localTopic(frame.GetDestination()), frame, time.Time{})
+}
+
+func (h clusterHandler) DeliverJson(destination uuid.UUID, jsonMsg []byte) {
+	if destination == uuid.Nil {
+		h.app.broadcastLocal(nil, jsonMsg)
+		return
+	}
+	h.app.publishJson(h.localTopic(destination), uuid.Nil, destination, jsonMsg)
+}
+
+// NodeLost reports clients of crashed or stopped node as disconnected
+func (h clusterHandler) NodeLost(node string, clients []serverapi.Client) {
+	for _, info := range clients {
+		msg, err := novaprotocol.NewJsonMessage(novaprotocol.MSG_CONNECTION_LOST, &info)
+		if err != nil {
+			h.app.logger.Error("failed to create message", slog.Any("error", err))
+			return
+		}
+		h.app.broadcastLocal(nil, msg)
+	}
+}
@@ -0,0 +1,412 @@
+package application
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"novachat-server/internal/account"
+	"novachat-server/internal/bus"
+	"novachat-server/internal/clientmanager"
+	"novachat-server/internal/nickname"
+	"novachat-server/novaprotocol"
+	"novachat-server/novaprotocol/handshake"
+	"novachat-server/novaprotocol/serverapi"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Link codes are 8 digits, short enough to type and confirmed by issuer anyway
+const linkCodeDigits = 8
+
+// onlineDevices tracks connections of signed in devices
+type onlineDevices struct {
+	mutex sync.Mutex
+	// Account -> client id -> connection
+	accounts map[uuid.UUID]map[uuid.UUID]deviceConn
+}
+
+type deviceConn struct {
+	client clientmanager.Client
+	sub    bus.Subscription
+}
+
+func (o *onlineDevices) add(account uuid.UUID, conn deviceConn) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	conns, ex := o.accounts[account]
+	if !ex {
+		conns = make(map[uuid.UUID]deviceConn)
+		o.accounts[account] = conns
+	}
+	conns[conn.client.GetID()] = conn
+}
+
+func (o *onlineDevices) remove(account, id uuid.UUID) (deviceConn, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	conn, ex := o.accounts[account][id]
+	delete(o.accounts[account], id)
+	if len(o.accounts[account]) == 0 {
+		delete(o.accounts, account)
+	}
+	return conn, ex
+}
+
+func (o *onlineDevices) list(account uuid.UUID) []clientmanager.Client {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	clients := make([]clientmanager.Client, 0, len(o.accounts[account]))
+	for _, conn := range o.accounts[account] {
+		clients = append(clients, conn.client)
+	}
+	return clients
+}
+
+func (o *onlineDevices) has(account uuid.UUID) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	_, ex := o.accounts[account]
+	return ex
+}
+
+// pendingLink is link code waiting for new device and then for confirmation of its issuer
+type pendingLink struct {
+	account   uuid.UUID
+	issuer    uuid.UUID
+	expiresAt time.Time
+	// Set when new device entered the code
+	requester uuid.UUID
+	name      string
+}
+
+type deviceLinks struct {
+	mutex sync.Mutex
+	codes map[string]*pendingLink
+}
+
+func newLinkCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1e8))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", linkCodeDigits, n.Int64()), nil
+}
+
+// normalizeLinkCode drops separators people type or QR payload carries
+func normalizeLinkCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, code)
+}
+
+// issue replaces codes of issuer with new one
+func (l *deviceLinks) issue(account, issuer uuid.UUID, ttl time.Duration) (serverapi.DeviceLinkCode, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	for code, link := range l.codes {
+		if link.issuer == issuer || now.After(link.expiresAt) {
+			delete(l.codes, code)
+		}
+	}
+	for {
+		code, err := newLinkCode()
+		if err != nil {
+			return serverapi.DeviceLinkCode{}, err
+		}
+		if _, ex := l.codes[code]; ex {
+			continue
+		}
+		l.codes[code] = &pendingLink{account: account, issuer: issuer, expiresAt: now.Add(ttl)}
+		return serverapi.DeviceLinkCode{Code: code, ExpiresAt: now.Add(ttl).UTC()}, nil
+	}
+}
+
+// request marks code as entered by new device, code can be entered only once
+func (l *deviceLinks) request(code string, requester uuid.UUID, name string) (pendingLink, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	link, ex := l.codes[code]
+	if !ex || link.requester != uuid.Nil || time.Now().After(link.expiresAt) {
+		return pendingLink{}, false
+	}
+	link.requester, link.name = requester, name
+	return *link, true
+}
+
+// take removes requested code of issuer
+func (l *deviceLinks) take(code string, issuer uuid.UUID) (pendingLink, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	link, ex := l.codes[code]
+	if !ex || link.issuer != issuer || link.requester == uuid.Nil || time.Now().After(link.expiresAt) {
+		return pendingLink{}, false
+	}
+	delete(l.codes, code)
+	return *link, true
+}
+
+// drop removes codes issued by client or entered by it
+func (l *deviceLinks) drop(client uuid.UUID) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for code, link := range l.codes {
+		if link.issuer == client || link.requester == client {
+			delete(l.codes, code)
+		}
+	}
+}
+
+func accountErrorCode(err error) string {
+	switch {
+	case errors.Is(err, account.ErrorNotFound):
+		return serverapi.ErrorNotFound
+	case errors.Is(err, account.ErrorInvalidToken), errors.Is(err, account.ErrorRevoked):
+		return serverapi.ErrorUnauthorized
+	default:
+		return serverapi.ErrorBadRequest
+	}
+}
+
+// routeDevices executes account and device request, everything except sign in requires signed in device.
+// Accounts and their revocations are not shared between nodes, so clustered server refuses them
+func (app *Application) routeDevices(client clientmanager.Client, msgType string, data []byte) error {
+	if !slices.Contains(app.capabilities(), handshake.CapAccounts) {
+		return respondError(client, msgType, serverapi.ErrorBadRequest, fmt.Errorf("accounts are not supported in cluster"))
+	}
+	accountID, _ := client.GetAccount()
+	switch msgType {
+	case novaprotocol.MSG_ACCOUNT_CREATE:
+		return app.accountCreate(client, data)
+	case novaprotocol.MSG_DEVICE_LOGIN:
+		return app.deviceLogin(client, data)
+	case novaprotocol.MSG_DEVICE_LINK:
+		return app.deviceLink(client, data)
+	}
+	if accountID == uuid.Nil {
+		return respondError(client, msgType, serverapi.ErrorUnauthorized, fmt.Errorf("not signed in"))
+	}
+
+	switch msgType {
+	case novaprotocol.MSG_DEVICE_LINK_CODE:
+		code, err := app.links.issue(accountID, client.GetID(), app.cfg.DeviceLinkTTL)
+		if err != nil {
+			return respondError(client, msgType, serverapi.ErrorBadRequest, err)
+		}
+		return respondAck(client, msgType, &code)
+	case novaprotocol.MSG_DEVICE_LINK_CONFIRM:
+		return app.deviceLinkConfirm(client, accountID, data)
+	case novaprotocol.MSG_DEVICE_LIST:
+		return app.deviceList(client, accountID)
+	case novaprotocol.MSG_DEVICE_REVOKE:
+		return app.deviceRevoke(client, accountID, data)
+	}
+	return nil
+}
+
+// signIn binds client to device and subscribes it to account topic
+func (app *Application) signIn(client clientmanager.Client, accountID, deviceID uuid.UUID) error {
+	// Device has one connection, older one is replaced
+	for _, other := range app.devices.list(accountID) {
+		if _, device := other.GetAccount(); device == deviceID && other.GetID() != client.GetID() {
+			app.kick(other, "device signed in from another connection")
+		}
+	}
+	sub, err := app.subscribeAccount(client, accountID)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe account: %w", err)
+	}
+	client.SetAccount(accountID, deviceID)
+	app.devices.add(accountID, deviceConn{client: client, sub: sub})
+	app.announce(client)
+	client.Logger().Info("device signed in", slog.String("account", accountID.String()), slog.String("device", deviceID.String()))
+	return nil
+}
+
+// signOut is called when client disconnects
+func (app *Application) signOut(client clientmanager.Client) {
+	app.links.drop(client.GetID())
+	accountID, _ := client.GetAccount()
+	if accountID == uuid.Nil {
+		return
+	}
+	if conn, ex := app.devices.remove(accountID, client.GetID()); ex {
+		conn.sub.Unsubscribe()
+	}
+}
+
+func (app *Application) accountCreate(client clientmanager.Client, data []byte) error {
+	req, err := novaprotocol.ParseJsonMessage[serverapi.AccountCreate](data)
+	if err != nil || req == nil {
+		return respondError(client, novaprotocol.MSG_ACCOUNT_CREATE, serverapi.ErrorBadRequest, fmt.Errorf("invalid request"))
+	}
+	if accountID, _ := client.GetAccount(); accountID != uuid.Nil {
+		return respondError(client, novaprotocol.MSG_ACCOUNT_CREATE, serverapi.ErrorBadRequest, fmt.Errorf("already signed in"))
+	}
+	// Device names follow nickname rules
+	name, err := nickname.Normalize(req.DeviceName)
+	if err != nil {
+		return respondError(client, novaprotocol.MSG_ACCOUNT_CREATE, serverapi.ErrorBadRequest, err)
+	}
+	created, device, token, err := app.accounts.Create(name)
+	if err != nil {
+		return respondError(client, novaprotocol.MSG_ACCOUNT_CREATE, accountErrorCode(err), err)
+	}
+	if err := app.signIn(client, created.ID, device.ID); err != nil {
+		return err
+	}
+	return respondAck(client, novaprotocol.MSG_ACCOUNT_CREATE, &serverapi.DeviceCredentials{Account: created.ID, Device: device.ID, Token: token})
+}
+
+func (app *Application) deviceLogin(client clientmanager.Client, data []byte) error {
+	req, err := novaprotocol.ParseJsonMessage[serverapi.DeviceCredentials](data)
+	if err != nil || req == nil {
+		return respondError(client, novaprotocol.MSG_DEVICE_LOGIN, serverapi.ErrorBadRequest, fmt.Errorf("invalid request"))
+	}
+	if accountID, _ := client.GetAccount(); accountID != uuid.Nil {
+		return respondError(client, novaprotocol.MSG_DEVICE_LOGIN, serverapi.ErrorBadRequest, fmt.Errorf("already signed in"))
+	}
+	device, err := app.accounts.Authenticate(req.Account, req.Device, req.Token)
+	if err != nil {
+		client.Logger().Warn("failed device sign in", slog.String("device", req.Device.String()), slog.Any("error", err))
+		return respondError(client, novaprotocol.MSG_DEVICE_LOGIN, accountErrorCode(err), err)
+	}
+	if err := app.signIn(client, req.Account, device.ID); err != nil {
+		return err
+	}
+	return respondAck(client, novaprotocol.MSG_DEVICE_LOGIN, app.deviceInfo(req.Account, device))
+}
+
+// deviceLink passes code entered by new device to its issuer, new device is answered on confirmation
+func (app *Application) deviceLink(client clientmanager.Client, data []byte) error {
+	req, err := novaprotocol.ParseJsonMessage[serverapi.DeviceLink](data)
+	if err != nil || req == nil {
+		return respondError(client, novaprotocol.MSG_DEVICE_LINK, serverapi.ErrorBadRequest, fmt.Errorf("invalid request"))
+	}
+	if accountID, _ := client.GetAccount(); accountID != uuid.Nil {
+		return respondError(client, novaprotocol.MSG_DEVICE_LINK, serverapi.ErrorBadRequest, fmt.Errorf("already signed in"))
+	}
+	name, err := nickname.Normalize(req.Name)
+	if err != nil {
+		return respondError(client, novaprotocol.MSG_DEVICE_LINK, serverapi.ErrorBadRequest, err)
+	}
+	code := normalizeLinkCode(req.Code)
+	link, ok := app.links.request(code, client.GetID(), name)
+	if !ok {
+		client.Logger().Warn("invalid device link code")
+		return respondError(client, novaprotocol.MSG_DEVICE_LINK, serverapi.ErrorNotFound, fmt.Errorf("invalid or expired code"))
+	}
+	issuer, ex := app.clientManager.GetClient(link.issuer)
+	if !ex {
+		app.links.drop(link.issuer)
+		return respondError(client, novaprotocol.MSG_DEVICE_LINK, serverapi.ErrorNotFound, fmt.Errorf("issuer of the code is offline"))
+	}
+	return respondAck(issuer, novaprotocol.MSG_DEVICE_LINK_REQUEST, &serverapi.DeviceLinkRequest{
+		Code:       code,
+		Name:       name,
+		Client:     client.GetID(),
+		RemoteAddr: client.GetRemoteAddr(),
+	})
+}
+
+func (app *Application) deviceLinkConfirm(client clientmanager.Client, accountID uuid.UUID, data []byte) error {
+	req, err := novaprotocol.ParseJsonMessage[serverapi.DeviceLinkConfirm](data)
+	if err != nil || req == nil {
+		return respondError(client, novaprotocol.MSG_DEVICE_LINK_CONFIRM, serverapi.ErrorBadRequest, fmt.Errorf("invalid request"))
+	}
+	link, ok := app.links.take(normalizeLinkCode(req.Code), client.GetID())
+	if !ok {
+		return respondError(client, novaprotocol.MSG_DEVICE_LINK_CONFIRM, serverapi.ErrorNotFound, fmt.Errorf("no pending link"))
+	}
+	requester, ex := app.clientManager.GetClient(link.requester)
+	if !ex {
+		return respondError(client, novaprotocol.MSG_DEVICE_LINK_CONFIRM, serverapi.ErrorNotFound, fmt.Errorf("new device is offline"))
+	}
+	if !req.Approve {
+		respondError(requester, novaprotocol.MSG_DEVICE_LINK, serverapi.ErrorUnauthorized, fmt.Errorf("link rejected"))
+		return respondAck(client, novaprotocol.MSG_DEVICE_LINK_CONFIRM, req)
+	}
+
+	device, token, err := app.accounts.AddDevice(accountID, link.name)
+	if err != nil {
+		respondError(requester, novaprotocol.MSG_DEVICE_LINK, accountErrorCode(err), err)
+		return respondError(client, novaprotocol.MSG_DEVICE_LINK_CONFIRM, accountErrorCode(err), err)
+	}
+	if err := app.signIn(requester, accountID, device.ID); err != nil {
+		return err
+	}
+	client.Logger().Info("device linked", slog.String("device", device.ID.String()), slog.String("name", device.Name))
+	err = respondAck(requester, novaprotocol.MSG_DEVICE_LINK, &serverapi.DeviceCredentials{Account: accountID, Device: device.ID, Token: token})
+	if err != nil {
+		requester.Logger().Warn("failed to send device credentials", slog.Any("error", err))
+	}
+	return respondAck(client, novaprotocol.MSG_DEVICE_LINK_CONFIRM, app.deviceInfo(accountID, device))
+}
+
+// deviceInfo describes device with its connection, if it is online on this node
+func (app *Application) deviceInfo(accountID uuid.UUID, device account.Device) *serverapi.Device {
+	info := &serverapi.Device{ID: device.ID, Name: device.Name, CreatedAt: device.CreatedAt, RevokedAt: device.RevokedAt}
+	for _, c := range app.devices.list(accountID) {
+		if _, id := c.GetAccount(); id == device.ID {
+			info.Client = c.GetID()
+		}
+	}
+	return info
+}
+
+func (app *Application) deviceList(client clientmanager.Client, accountID uuid.UUID) error {
+	acc, ex := app.accounts.Get(accountID)
+	if !ex {
+		return respondError(client, novaprotocol.MSG_DEVICE_LIST, serverapi.ErrorNotFound, account.ErrorNotFound)
+	}
+	devices := make([]*serverapi.Device, 0, len(acc.Devices))
+	for _, device := range acc.Devices {
+		devices = append(devices, app.deviceInfo(accountID, device))
+	}
+	return respondAck(client, novaprotocol.MSG_DEVICE_LIST, devices)
+}
+
+// deviceRevoke disables device of the same account and disconnects it
+func (app *Application) deviceRevoke(client clientmanager.Client, accountID uuid.UUID, data []byte) error {
+	req, err := novaprotocol.ParseJsonMessage[serverapi.DeviceRevoke](data)
+	if err != nil || req == nil {
+		return respondError(client, novaprotocol.MSG_DEVICE_REVOKE, serverapi.ErrorBadRequest, fmt.Errorf("invalid request"))
+	}
+	device, err := app.accounts.Revoke(accountID, req.ID)
+	if err != nil {
+		return respondError(client, novaprotocol.MSG_DEVICE_REVOKE, accountErrorCode(err), err)
+	}
+	client.Logger().Info("device revoked", slog.String("device", device.ID.String()), slog.String("name", device.Name))
+	info := app.deviceInfo(accountID, device)
+	if err := respondAck(client, novaprotocol.MSG_DEVICE_REVOKE, info); err != nil {
+		return err
+	}
+	for _, c := range app.devices.list(accountID) {
+		if _, id := c.GetAccount(); id == device.ID {
+			app.kick(c, "device revoked")
+		}
+	}
+	return nil
+}
+
+// isAccount reports whether destination is account known to this node or signed in on another one
+func (app *Application) isAccount(destination uuid.UUID) bool {
+	if app.accounts.Exists(destination) {
+		return true
+	}
+	for _, remote := range app.cluster.ListClients() {
+		if remote.Account == destination {
+			return true
+		}
+	}
+	return false
+}
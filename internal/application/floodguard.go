@@ -0,0 +1,108 @@
+package application
+
+import (
+	"novachat-server/common/ratelimit"
+	"novachat-server/internal/config"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Violations are forgiven after client behaves for this long
+	floodForgiveInterval = time.Minute
+)
+
+type floodAction int
+
+const (
+	floodAllow floodAction = iota
+	floodDrop
+	floodNotice
+	floodDisconnect
+)
+
+// FloodStats counts rate limiter reactions since server start
+type FloodStats struct {
+	Dropped      uint64
+	Notices      uint64
+	Disconnected uint64
+}
+
+type floodCounters struct {
+	dropped      atomic.Uint64
+	notices      atomic.Uint64
+	disconnected atomic.Uint64
+}
+
+// FloodStats returns snapshot of rate limiter counters
+func (app *Application) FloodStats() FloodStats {
+	return FloodStats{
+		Dropped:      app.floodCounters.dropped.Load(),
+		Notices:      app.floodCounters.notices.Load(),
+		Disconnected: app.floodCounters.disconnected.Load(),
+	}
+}
+
+// floodGuard holds limits of one connection, used only from connection goroutine
+type floodGuard struct {
+	cfg      *config.AppConfig
+	counters *floodCounters
+
+	frames ratelimit.Limiter
+	bytes  ratelimit.Limiter
+	api    ratelimit.Limiter
+
+	violations    int
+	lastViolation time.Time
+}
+
+func (app *Application) newFloodGuard() *floodGuard {
+	return &floodGuard{
+		cfg:      app.cfg,
+		counters: &app.floodCounters,
+		frames:   ratelimit.NewTokenBucket(app.cfg.RateFramesPerSec, app.cfg.RateFramesBurst),
+		bytes:    ratelimit.NewTokenBucket(app.cfg.RateBytesPerSec, app.cfg.RateBytesBurst),
+		api:      ratelimit.NewTokenBucket(app.cfg.RateApiPerSec, app.cfg.RateApiBurst),
+	}
+}
+
+// checkFrame accounts received frame of given size
+func (fg *floodGuard) checkFrame(size uint64) floodAction {
+	// Both buckets are charged, so flooding one does not refill another
+	framesOk := fg.frames.Allow()
+	bytesOk := fg.bytes.AllowN(float64(size))
+	if framesOk && bytesOk {
+		return floodAllow
+	}
+	return fg.violation()
+}
+
+// checkAPI accounts server API call
+func (fg *floodGuard) checkAPI() floodAction {
+	if fg.api.Allow() {
+		return floodAllow
+	}
+	return fg.violation()
+}
+
+// violation escalates reaction: drop, then drop with notice, then disconnect
+func (fg *floodGuard) violation() floodAction {
+	now := time.Now()
+	if now.Sub(fg.lastViolation) > floodForgiveInterval {
+		fg.violations = 0
+	}
+	fg.lastViolation = now
+	fg.violations++
+
+	switch {
+	case fg.violations >= fg.cfg.RateDisconnectAfter:
+		fg.counters.disconnected.Add(1)
+		return floodDisconnect
+	case fg.violations >= fg.cfg.RateNoticeAfter:
+		fg.counters.notices.Add(1)
+		return floodNotice
+	default:
+		fg.counters.dropped.Add(1)
+		return floodDrop
+	}
+}
@@ -1,12 +1,15 @@
 package application
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"novachat-server/internal/clientmanager"
+	"novachat-server/internal/webhook"
 	"novachat-server/novaprotocol"
 	"novachat-server/novaprotocol/serverapi"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -28,115 +31,201 @@ func respondJson(client clientmanager.Client, jsonData []byte) error {
 	return l0.Write(client, client.Encrypt)
 }
 
-// connectionHandler manages the entire client connection lifecycle
-func (app *Application) connectionHandler(rw io.ReadWriteCloser) error {
-	client, err := app.clientManager.NewClient(rw)
+// respondError notifies client that request of given type was rejected
+func respondError(client clientmanager.Client, request string, code string, reason error) error {
+	msg, err := novaprotocol.NewJsonMessage(novaprotocol.MSG_ERROR, &serverapi.Error{
+		Request: request,
+		Code:    code,
+		Message: reason.Error(),
+	})
+	if err != nil {
+		return err
+	}
+	return respondJson(client, msg)
+}
+
+// floodReaction applies rate limiter decision, returns true if frame must be dropped
+// and error if client must be disconnected
+func (app *Application) floodReaction(client clientmanager.Client, action floodAction) (bool, error) {
+	switch action {
+	case floodDrop:
+		return true, nil
+	case floodNotice:
+		err := respondError(client, "", serverapi.ErrorRateLimited, fmt.Errorf("rate limit exceeded, frame dropped"))
+		if err != nil {
+			client.Logger().Warn("failed to send rate limit notice", slog.Any("error", err))
+		}
+		return true, nil
+	case floodDisconnect:
+		respondError(client, "", serverapi.ErrorRateLimited, fmt.Errorf("rate limit exceeded, disconnecting"))
+		return true, fmt.Errorf("client %s disconnected for flooding", client.GetID().String())
+	}
+	return false, nil
+}
+
+// connectionHandler manages the entire client connection lifecycle, it must be accepted by acceptConnection
+func (app *Application) connectionHandler(rw io.ReadWriteCloser, remoteAddr string) error {
+	defer app.handlers.Done()
+
+	// Banned addresses do not even get a handshake, only the reason
+	if ban, banned := app.banList.IsBanned(serverapi.BanKindIP, remoteAddr); banned {
+		reject(rw, serverapi.ErrorBanned, fmt.Errorf("banned: %s", ban.Reason))
+		rw.Close()
+		return fmt.Errorf("address %s is banned: %s", remoteAddr, ban.Reason)
+	}
+
+	release, code, err := app.admit(remoteAddr)
+	if err != nil {
+		reject(rw, code, err)
+		rw.Close()
+		return fmt.Errorf("connection rejected: %w", err)
+	}
+	defer release()
+
+	client, err := app.clientManager.NewClient(rw, remoteAddr)
 	if err != nil {
 		return fmt.Errorf("failed to create client: %w", err)
 	}
 	defer func() {
 		if err := client.Close(); err != nil {
-			log.Printf("Error closing client: %v", err)
+			client.Logger().Debug("error closing client", slog.Any("error", err))
 		}
 	}()
 
+	// Server shutdown closes every connection, blocked reads return immediately
+	ctx, cancel := context.WithCancel(app.connCtx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		client.Close()
+	}()
+
+	client.SetReadDeadline(time.Now().Add(app.cfg.HandshakeTimeout))
+	if err := app.checkJoinToken(client); err != nil {
+		return fmt.Errorf("join failed: %w", err)
+	}
+
 	// Perform key exchange
-	encryptionKey, err := keyExchange(client)
+	encryptionKey, err := app.keyExchange(client)
 	if err != nil {
 		return fmt.Errorf("key exchange failed: %w", err)
 	}
 	// Set encryption key for the client
 	client.SetEncryptionKey(encryptionKey)
 
-	err = sendWelcomeInviteMessage(client)
+	err = sendWelcomeInviteMessage(client, app.capabilities())
 	if err != nil {
 		return fmt.Errorf("welcome failed: %w", err)
 	}
 
-	cInfo, err := recvWelcomeAcceptMessage(client)
+	client.SetReadDeadline(time.Now().Add(app.cfg.HandshakeTimeout))
+	err = app.acceptWelcome(client)
 	if err != nil {
 		return fmt.Errorf("welcome accept failed: %w", err)
 	}
-	client.SetInfo(cInfo.Nickname)
+	if ban, banned := app.isBanned(client); banned {
+		respondError(client, novaprotocol.MSG_WELCOME_ACCEPT, serverapi.ErrorBanned, fmt.Errorf("banned: %s", ban.Reason))
+		return fmt.Errorf("client %s is banned: %s", client.GetNickname(), ban.Reason)
+	}
+	client.SetStatus(serverapi.PresenceOnline, "")
+	unsubscribe, err := app.subscribeClient(client)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe client: %w", err)
+	}
+	defer unsubscribe()
+	app.announce(client)
+	app.pluginsConnect(client)
+	go app.runHeartbeat(ctx, client)
+	app.rekeys.Set(client.GetID(), &rekeyState{})
+	defer app.rekeys.Remove(client.GetID())
 
-	// Send welcome message
-	log.Printf("successfully established secure connection with client: %s", client.GetID().String())
+	client.Logger().Info("established secure connection")
 
 	// Notify all clients about new client
 	{
-		msg, err := novaprotocol.NewJsonMessage(novaprotocol.MSG_NEW_CONNECTION, &serverapi.Client{
-			ID:       client.GetID(),
-			Nickname: client.GetNickname(),
-		})
+		msg, err := novaprotocol.NewJsonMessage(novaprotocol.MSG_NEW_CONNECTION, clientInfo(client))
 		if err != nil {
 			return fmt.Errorf("failed to create message: %w", err)
 		}
-
-		for _, otherClient := range app.clientManager.ListClients() {
-			if otherClient != client {
-				err = respondJson(otherClient, msg)
-				if err != nil {
-					return fmt.Errorf("failed to send new connection: %w", err)
-				}
-			}
-		}
+		app.broadcastJson(client, msg)
+		app.webhooks.Emit(webhook.EventClientConnected, clientInfo(client))
 	}
 	defer func() {
+		app.presenceLimiters.Remove(client.GetID())
+		app.leaveAllRooms(client)
+		app.signOut(client)
+		app.pluginsDisconnect(client)
+		if err := app.cluster.ClientDown(client.GetID()); err != nil {
+			client.Logger().Warn("failed to remove client from cluster", slog.Any("error", err))
+		}
+		app.webhooks.Emit(webhook.EventClientDisconnected, clientInfo(client))
 		// Notify all clients about losing client
-		{
-			msg, err := novaprotocol.NewJsonMessage(novaprotocol.MSG_CONNECTION_LOST, &serverapi.Client{
-				ID:       client.GetID(),
-				Nickname: client.GetNickname(),
-			})
-			if err != nil {
-				log.Printf("failed to send connection lost message: %w", err)
-				return
-			}
-
-			for _, otherClient := range app.clientManager.ListClients() {
-				if otherClient != client {
-					err = respondJson(otherClient, msg)
-					if err != nil {
-						log.Printf("failed to send connection lost message: %w", err)
-						return
-					}
-				}
-			}
+		msg, err := novaprotocol.NewJsonMessage(novaprotocol.MSG_CONNECTION_LOST, clientInfo(client))
+		if err != nil {
+			client.Logger().Error("failed to send connection lost message", slog.Any("error", err))
+			return
 		}
+		app.broadcastJson(client, msg)
 	}()
 
 	// Main messaging cycle
+	guard := app.newFloodGuard()
 	for {
+		// Half-open connections never answer pings, so they hit the deadline
+		client.SetReadDeadline(time.Now().Add(app.idleTimeout()))
+		bytesBefore, _ := client.GetTraffic()
 		l0frame, err := novaprotocol.ReadL0Frame(client, client.Decrypt)
 		if err != nil {
 			if err == io.EOF {
 				return nil
 			}
-			log.Printf("failed to read l0 frame: %v", err)
+			app.countFrameError(err)
+			return fmt.Errorf("failed to read l0 frame: %w", err)
+		}
+		receivedAt := time.Now()
+		if err := app.checkRekey(client); err != nil {
+			return err
+		}
+		bytesAfter, _ := client.GetTraffic()
+		if drop, err := app.floodReaction(client, guard.checkFrame(bytesAfter-bytesBefore)); drop {
+			if err != nil {
+				return err
+			}
+			// Client seals what follows the answer with the new key, dropping it desyncs the connection
+			if !isRekeyAnswer(l0frame) {
+				continue
+			}
 		}
+
 		if l0frame.GetOrigin() != client.GetID() {
-			log.Printf("invalid packet source")
+			client.Logger().Warn("invalid packet source", slog.String("origin", l0frame.GetOrigin().String()))
 			continue
 		}
 
 		if l0frame.GetDestination() == uuid.Nil {
 			// Message for server
-			app.routeAPI(client, l0frame)
+			if drop, err := app.floodReaction(client, guard.checkAPI()); drop {
+				if err != nil {
+					return err
+				}
+				if !isRekeyAnswer(l0frame) {
+					continue
+				}
+			}
+			app.metrics.framesRouted.Inc(frameTypeAPI)
+			if err := app.routeAPI(client, l0frame); err != nil {
+				client.Logger().Warn("api call failed", slog.Any("error", err))
+			}
 
 		} else {
-			// Unicast
-			target, ex := app.clientManager.GetClient(l0frame.GetDestination())
-			if !ex {
-				log.Printf("unicast target not found")
+			if client.IsMuted() {
+				client.Logger().Debug("dropped frame from muted client")
 				continue
 			}
-
-			err = l0frame.Write(target, target.Encrypt)
-			if err != nil {
-				log.Printf("failed to unicast message: %v", err)
+			if !app.pluginsRelay(client, l0frame) {
 				continue
 			}
+			app.relay(client.Logger(), l0frame, receivedAt)
 		}
 	}
-	return nil
 }
@@ -3,21 +3,57 @@ package application
 import (
 	"crypto/rand"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/big"
+	"novachat-server/common/linq"
 	"novachat-server/internal/clientmanager"
 	"novachat-server/novaprotocol"
 	"novachat-server/novaprotocol/handshake"
+	"slices"
+	"time"
 
 	"github.com/google/uuid"
 )
 
-// keyExchange performs Diffie-Hellman key exchange with mutual authentication
-func keyExchange(rw clientmanager.Client) ([]byte, error) {
+// Features this server supports
+var serverCapabilities = []string{
+	handshake.CapPresence,
+	handshake.CapNicknameChange,
+	handshake.CapPing,
+	handshake.CapRooms,
+	handshake.CapHistory,
+	handshake.CapAccounts,
+	handshake.CapRekey,
+	handshake.CapWelcomeAck,
+}
+
+// capabilities are features of this node, accounts are kept per node so cluster runs without them
+func (app *Application) capabilities() []string {
+	if app.cfg.ClusterListen == "" {
+		return serverCapabilities
+	}
+	return linq.Where(serverCapabilities, func(c string) bool {
+		return c != handshake.CapAccounts
+	})
+}
+
+// negotiateCapabilities keeps client capabilities known to server
+func (app *Application) negotiateCapabilities(clientCaps []string) []string {
+	return linq.Where(app.capabilities(), func(c string) bool {
+		return slices.Contains(clientCaps, c)
+	})
+}
+
+// keyExchange performs Diffie-Hellman key exchange with mutual authentication,
+// every attempt gets its own HandshakeTimeout so a failed attempt does not starve the next one
+func (app *Application) keyExchange(rw clientmanager.Client) ([]byte, error) {
 	for attempt := 0; attempt < maxKeyExchangeRetryAttempts; attempt++ {
+		app.metrics.handshakeAttempts.Inc()
+		rw.SetReadDeadline(time.Now().Add(app.cfg.HandshakeTimeout))
 		key, err := performSingleKeyExchange(rw)
 		if err != nil {
-			log.Printf("Key exchange attempt %d failed: %v", attempt+1, err)
+			app.metrics.handshakeFailures.Inc()
+			rw.Logger().Warn("key exchange attempt failed", slog.Int("attempt", attempt+1), slog.Any("error", err))
 			continue
 		}
 		return key, nil
@@ -114,16 +150,17 @@ func receivePublicKeyMessage(rw clientmanager.Client) (*big.Int, string, error)
 
 	// Convert string representations back to big.Int
 	clientPublicKey, ok := new(big.Int).SetString(publicKeyMsg.Pub, 62)
-	if !ok || clientPublicKey == nil {
+	if !ok || !handshake.ValidPublicKey(clientPublicKey) {
 		return nil, "", fmt.Errorf("invalid client public key format")
 	}
 
 	return clientPublicKey, publicKeyMsg.Hash, nil
 }
 
-func sendWelcomeInviteMessage(client clientmanager.Client) error {
+func sendWelcomeInviteMessage(client clientmanager.Client, capabilities []string) error {
 	messageData, err := novaprotocol.NewJsonMessage(novaprotocol.MSG_WELCOME_INVITE, &handshake.WelcomeInviteServer2Client{
-		UserID: client.GetID(),
+		UserID:       client.GetID(),
+		Capabilities: capabilities,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to create public key message: %w", err)
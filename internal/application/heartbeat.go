@@ -0,0 +1,84 @@
+package application
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"novachat-server/internal/clientmanager"
+	"novachat-server/novaprotocol"
+	"novachat-server/novaprotocol/serverapi"
+	"sync/atomic"
+	"time"
+)
+
+// heartbeat tracks pings of one connection
+type heartbeat struct {
+	seq    atomic.Uint64
+	missed atomic.Int32
+}
+
+// idleTimeout is the longest silence allowed from a client that answers pings
+func (app *Application) idleTimeout() time.Duration {
+	return app.cfg.PingInterval * time.Duration(app.cfg.PingMaxMissed+1)
+}
+
+// runHeartbeat pings client until ctx is done, closes client after too many missed pongs
+func (app *Application) runHeartbeat(ctx context.Context, client clientmanager.Client) {
+	hb := &heartbeat{}
+	app.heartbeats.Set(client.GetID(), hb)
+	defer app.heartbeats.Remove(client.GetID())
+
+	ticker := time.NewTicker(app.cfg.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if int(hb.missed.Add(1)) > app.cfg.PingMaxMissed {
+			client.Logger().Info("missed pings, disconnecting", slog.Int("missed", app.cfg.PingMaxMissed))
+			client.Close()
+			return
+		}
+
+		msg, err := novaprotocol.NewJsonMessage(novaprotocol.MSG_PING, &serverapi.Ping{Seq: hb.seq.Add(1)})
+		if err != nil {
+			client.Logger().Error("failed to create ping", slog.Any("error", err))
+			continue
+		}
+		if err := respondJson(client, msg); err != nil {
+			client.Logger().Warn("failed to ping client", slog.Any("error", err))
+		}
+	}
+}
+
+// ping answers client's ping
+func (app *Application) ping(client clientmanager.Client, data []byte) error {
+	ping, err := novaprotocol.ParseJsonMessage[serverapi.Ping](data)
+	if err != nil || ping == nil {
+		return fmt.Errorf("failed to parse ping: %w", err)
+	}
+	msg, err := novaprotocol.NewJsonMessage(novaprotocol.MSG_PONG, ping)
+	if err != nil {
+		return err
+	}
+	return respondJson(client, msg)
+}
+
+// pong resets missed pings counter, only the answer to the latest ping counts
+func (app *Application) pong(client clientmanager.Client, data []byte) error {
+	pong, err := novaprotocol.ParseJsonMessage[serverapi.Ping](data)
+	if err != nil || pong == nil {
+		return fmt.Errorf("failed to parse pong: %w", err)
+	}
+	hb, ex := app.heartbeats.Get(client.GetID())
+	if !ex {
+		return nil
+	}
+	if pong.Seq == hb.seq.Load() {
+		hb.missed.Store(0)
+	}
+	return nil
+}
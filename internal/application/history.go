@@ -0,0 +1,155 @@
+package application
+
+import (
+	"errors"
+	"fmt"
+	"novachat-server/internal/clientmanager"
+	"novachat-server/internal/history"
+	"novachat-server/novaprotocol"
+	"novachat-server/novaprotocol/serverapi"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// principal is stable id of client in history. Account of signed in device survives reconnects,
+// anonymous client is known by its connection id, so its history ends with the connection
+func principal(client clientmanager.Client) uuid.UUID {
+	if account, _ := client.GetAccount(); account != uuid.Nil {
+		return account
+	}
+	return client.GetID()
+}
+
+// principalOf resolves connection id of local or remote peer to its principal, other ids are accounts or offline peers
+func (app *Application) principalOf(id uuid.UUID) uuid.UUID {
+	if c, ok := app.clientManager.GetClient(id); ok {
+		return principal(c)
+	}
+	for _, remote := range app.cluster.ListClients() {
+		if remote.ID == id && remote.Account != uuid.Nil {
+			return remote.Account
+		}
+	}
+	return id
+}
+
+// conversation returns history conversation of frame sent by client to destination
+func (app *Application) conversation(client clientmanager.Client, destination uuid.UUID) uuid.UUID {
+	if app.isRoomMember(client.GetID(), destination) {
+		return destination
+	}
+	return history.DirectConversation(principal(client), app.principalOf(destination))
+}
+
+func historyErrorCode(err error) string {
+	switch {
+	case errors.Is(err, history.ErrorNotFound):
+		return serverapi.ErrorNotFound
+	case errors.Is(err, history.ErrorNotOwner):
+		return serverapi.ErrorUnauthorized
+	default:
+		return serverapi.ErrorBadRequest
+	}
+}
+
+// messageOp applies stored message operation to history and relays its frame
+func (app *Application) messageOp(client clientmanager.Client, msgType string, data []byte) error {
+	req, err := novaprotocol.ParseJsonMessage[serverapi.MessageOp](data)
+	if err != nil || req == nil || req.ID == uuid.Nil || req.Destination == uuid.Nil || len(req.Frame) == 0 {
+		return respondError(client, msgType, serverapi.ErrorBadRequest, fmt.Errorf("invalid request"))
+	}
+	if client.IsMuted() {
+		return respondError(client, msgType, serverapi.ErrorUnauthorized, fmt.Errorf("muted"))
+	}
+
+	now := time.Now()
+	conversation := app.conversation(client, req.Destination)
+	switch msgType {
+	case novaprotocol.MSG_MESSAGE_SEND:
+		err = app.history.Append(history.Entry{
+			Conversation: conversation,
+			ID:           req.ID,
+			Origin:       client.GetID(),
+			Author:       principal(client),
+			Destination:  req.Destination,
+			SentAt:       now.UTC(),
+			ReplyTo:      req.ReplyTo,
+			Frame:        req.Frame,
+		})
+	case novaprotocol.MSG_MESSAGE_EDIT:
+		_, err = app.history.Edit(conversation, req.ID, principal(client), req.Frame, now.UTC())
+	case novaprotocol.MSG_MESSAGE_DELETE:
+		_, err = app.history.Delete(conversation, req.ID, principal(client), now.UTC())
+	case novaprotocol.MSG_MESSAGE_REACT:
+		_, err = app.history.React(conversation, req.ID, client.GetID(), req.Frame, now.UTC())
+	}
+	if err != nil {
+		return respondError(client, msgType, historyErrorCode(err), err)
+	}
+
+	l0 := novaprotocol.NewL0Frame(novaprotocol.L0FlagIsEncrypted, req.Destination, req.Frame)
+	l0.SetOrigin(client.GetID())
+	if app.pluginsRelay(client, l0) {
+		app.relay(client.Logger(), l0, now)
+	}
+	return respondAck(client, msgType, &serverapi.MessageStored{ID: req.ID, Conversation: conversation})
+}
+
+func storedMessage(entry history.Entry) serverapi.StoredMessage {
+	msg := serverapi.StoredMessage{
+		ID:          entry.ID,
+		Origin:      entry.Origin,
+		Author:      entry.Author,
+		Destination: entry.Destination,
+		SentAt:      entry.SentAt,
+		ReplyTo:     entry.ReplyTo,
+		Thread:      entry.Thread,
+		Frame:       entry.Frame,
+		Edit:        entry.Edit,
+		EditedAt:    entry.EditedAt,
+		Deleted:     entry.Deleted,
+		DeletedAt:   entry.DeletedAt,
+	}
+	for _, r := range entry.Reactions {
+		msg.Reactions = append(msg.Reactions, serverapi.StoredReaction{Client: r.Client, Frame: r.Frame, At: r.At})
+	}
+	return msg
+}
+
+// historyPage answers with page of conversation between client and peer or room it joined
+func (app *Application) historyPage(client clientmanager.Client, data []byte) error {
+	req, err := novaprotocol.ParseJsonMessage[serverapi.HistoryRequest](data)
+	if err != nil || req == nil || req.With == uuid.Nil || req.Limit < 0 {
+		return respondError(client, novaprotocol.MSG_HISTORY, serverapi.ErrorBadRequest, fmt.Errorf("invalid request"))
+	}
+	// Room history is available to members only, direct conversation always includes client
+	conversation := app.conversation(client, req.With)
+	cursor := history.Cursor{Before: req.Before, After: req.After, Limit: min(req.Limit, app.cfg.HistoryMaxPage)}
+	if req.Limit == 0 {
+		cursor.Limit = min(history.DefaultLimit, app.cfg.HistoryMaxPage)
+	}
+
+	var entries []history.Entry
+	var more bool
+	if req.Thread != uuid.Nil {
+		entries, more, err = app.history.Thread(conversation, req.Thread, cursor)
+	} else {
+		entries, more, err = app.history.Page(conversation, cursor)
+	}
+	if err != nil {
+		return respondError(client, novaprotocol.MSG_HISTORY, historyErrorCode(err), err)
+	}
+
+	page := &serverapi.HistoryPage{
+		With:         req.With,
+		Conversation: conversation,
+		Thread:       req.Thread,
+		Messages:     make([]serverapi.StoredMessage, 0, len(entries)),
+		More:         more,
+	}
+	for _, entry := range entries {
+		page.Messages = append(page.Messages, storedMessage(entry))
+	}
+	return respondAck(client, novaprotocol.MSG_HISTORY, page)
+}
@@ -0,0 +1,64 @@
+package application
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"novachat-server/common/linq"
+	"novachat-server/internal/clientmanager"
+	"novachat-server/novaprotocol/serverapi"
+	"strings"
+)
+
+// healthz reports that process is alive
+func (app *Application) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// readyz reports whether server accepts new connections, false while draining
+func (app *Application) readyz(w http.ResponseWriter, r *http.Request) {
+	if !app.ready.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// bearerAuthorized checks Authorization header against token, empty token denies everyone
+func bearerAuthorized(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1
+}
+
+// status lists connected clients
+func (app *Application) status(w http.ResponseWriter, r *http.Request) {
+	if !bearerAuthorized(r, app.cfg.StatusToken) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	status := &serverapi.Status{
+		Ready:     app.ready.Load(),
+		StartedAt: app.startedAt,
+		Clients: linq.Select(app.clientManager.ListClients(), func(c clientmanager.Client) serverapi.ClientStatus {
+			in, out := c.GetTraffic()
+			return serverapi.ClientStatus{
+				ID:           c.GetID(),
+				Nickname:     c.GetNickname(),
+				RemoteAddr:   c.GetRemoteAddr(),
+				ConnectedAt:  c.GetConnectedAt(),
+				BytesIn:      in,
+				BytesOut:     out,
+				Capabilities: c.GetCapabilities(),
+			}
+		}),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		app.logger.Warn("failed to write status", slog.Any("error", err))
+	}
+}
@@ -0,0 +1,179 @@
+package application
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"novachat-server/internal/nickname"
+	"novachat-server/internal/plugin"
+	"novachat-server/novaprotocol"
+	"novachat-server/novaprotocol/serverapi"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Limit of POST /api/v1/messages body
+const maxApiBodySize = 64 << 10
+
+// integration is REST client posting through its own bot
+type integration struct {
+	plugin.Base
+	name  string
+	token string
+	bot   *botClient
+
+	// Requests are served concurrently while guard expects one caller
+	mutex sync.Mutex
+	guard *floodGuard
+}
+
+func (i *integration) Name() string {
+	return "integration:" + i.name
+}
+func (i *integration) Nickname() string {
+	return i.name
+}
+func (i *integration) Attach(self plugin.BotClient) {
+	i.bot = self.(*botClient)
+}
+
+// allow charges post of given size to rate limiter of integration
+func (i *integration) allow(size int) bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.guard.checkFrame(uint64(size)) == floodAllow
+}
+
+// registerIntegrations registers bot of every configured integration
+func (app *Application) registerIntegrations() error {
+	for name, token := range app.cfg.Integrations {
+		if token == "" {
+			return fmt.Errorf("integration %s has empty token", name)
+		}
+		i := &integration{name: name, token: token, guard: app.newFloodGuard()}
+		if err := app.RegisterBot(i); err != nil {
+			return fmt.Errorf("failed to register integration %s: %w", name, err)
+		}
+		app.integrations = append(app.integrations, i)
+	}
+	return nil
+}
+
+// authorizeIntegration returns integration owning bearer token
+func (app *Application) authorizeIntegration(r *http.Request) (*integration, bool) {
+	provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, false
+	}
+	var found *integration
+	// Every token is compared so timing does not reveal which one matched
+	for _, i := range app.integrations {
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(i.token)) == 1 {
+			found = i
+		}
+	}
+	return found, found != nil
+}
+
+// isIntegrationBanned checks address of request and nickname of integration bot against bans
+func (app *Application) isIntegrationBanned(i *integration, r *http.Request) (*serverapi.Ban, bool) {
+	if ban, ex := app.banList.IsBanned(serverapi.BanKindIP, remoteHost(r.RemoteAddr)); ex {
+		return ban, true
+	}
+	return app.banList.IsBanned(serverapi.BanKindIdentity, nickname.Skeleton(i.bot.info.Nickname))
+}
+
+func writeJson(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// apiClients lists clients of the whole cluster
+func (app *Application) apiClients(w http.ResponseWriter, r *http.Request) {
+	if _, ok := app.authorizeIntegration(r); !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	resp := &serverapi.ListClientsResponse{Clients: make([]serverapi.Client, 0)}
+	for _, c := range app.allClients() {
+		resp.Clients = append(resp.Clients, *c)
+	}
+	if err := writeJson(w, http.StatusOK, resp); err != nil {
+		app.logger.Warn("failed to write clients", slog.Any("error", err))
+	}
+}
+
+// apiPostMessage sends text from integration to client or room, it is routed as if bot sent it
+func (app *Application) apiPostMessage(w http.ResponseWriter, r *http.Request) {
+	i, ok := app.authorizeIntegration(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req serverapi.PostMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxApiBodySize)).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Text == "" || (req.Room == "") == (req.Client == uuid.Nil) {
+		http.Error(w, "text and either client or room are required", http.StatusBadRequest)
+		return
+	}
+
+	// Moderation applies as to connected clients
+	if ban, banned := app.isIntegrationBanned(i, r); banned {
+		http.Error(w, "banned: "+ban.Reason, http.StatusForbidden)
+		return
+	}
+	if i.bot.isMuted() {
+		http.Error(w, "muted", http.StatusForbidden)
+		return
+	}
+	if !i.allow(len(req.Text)) {
+		http.Error(w, "rate limited", http.StatusTooManyRequests)
+		return
+	}
+
+	destination := req.Client
+	if req.Room != "" {
+		name, err := nickname.Normalize(req.Room)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		destination = roomID(name)
+	} else if _, remote := app.cluster.GetClient(destination); !remote && !app.isLocal(destination) {
+		http.Error(w, "client not found", http.StatusNotFound)
+		return
+	}
+
+	l1, err := botText(req.Text)
+	if err != nil {
+		app.logger.Warn("failed to post message", slog.String("integration", i.name), slog.Any("error", err))
+		http.Error(w, "failed to send message", http.StatusInternalServerError)
+		return
+	}
+	l0 := novaprotocol.NewL0Frame(novaprotocol.L0FlagIsEncrypted, destination, l1)
+	l0.SetOrigin(i.bot.info.ID)
+	if !app.pluginsRelayFrom(i.bot.info, i, l0) {
+		http.Error(w, errorDropped.Error(), http.StatusForbidden)
+		return
+	}
+	if req.Room != "" {
+		// Integration is not a member, so it does not receive what room says
+		app.relayRoom(i.bot.logger, l0, time.Now())
+	} else {
+		app.relay(i.bot.logger, l0, time.Now())
+	}
+	app.logger.Debug("integration posted message", slog.String("integration", i.name), slog.String("destination", destination.String()))
+	resp := &serverapi.PostMessageResponse{Origin: i.bot.info.ID, Destination: destination}
+	if err := writeJson(w, http.StatusAccepted, resp); err != nil {
+		app.logger.Warn("failed to write response", slog.Any("error", err))
+	}
+}
@@ -0,0 +1,91 @@
+package application
+
+import (
+	"errors"
+	"novachat-server/internal/metrics"
+	"novachat-server/novaprotocol"
+)
+
+const (
+	frameTypeAPI       = "api"
+	frameTypeUnicast   = "unicast"
+	frameTypeBroadcast = "broadcast"
+	frameTypeRoom      = "room"
+	frameTypeForwarded = "forwarded" // sent to another node
+)
+
+type appMetrics struct {
+	registry metrics.Registry
+
+	framesRouted        metrics.Counter
+	handshakeAttempts   metrics.Counter
+	handshakeFailures   metrics.Counter
+	rekeys              metrics.Counter
+	connectionsRejected metrics.Counter
+	frameErrors         metrics.Counter
+	relayLatency        metrics.Histogram
+}
+
+func (app *Application) initMetrics() {
+	r := metrics.NewRegistry()
+	app.metrics = appMetrics{
+		registry:            r,
+		framesRouted:        r.Counter("nova_frames_routed_total", "Frames routed by server", "type"),
+		handshakeAttempts:   r.Counter("nova_handshake_attempts_total", "Key exchange attempts"),
+		handshakeFailures:   r.Counter("nova_handshake_failures_total", "Failed key exchange attempts"),
+		rekeys:              r.Counter("nova_rekeys_total", "Transport keys replaced mid-session"),
+		connectionsRejected: r.Counter("nova_connections_rejected_total", "Connections rejected by admission policy", "reason"),
+		frameErrors:         r.Counter("nova_frame_errors_total", "Frames failed to parse", "error"),
+		relayLatency:        r.Histogram("nova_relay_latency_seconds", "Time from frame read to relay", metrics.LatencyBuckets),
+	}
+
+	r.GaugeFunc("nova_clients_connected", "Connected clients", func() float64 {
+		return float64(app.clientManager.Count())
+	})
+	r.CounterFunc("nova_bytes_received_total", "Raw bytes received from clients", func() float64 {
+		in, _ := app.clientManager.GetTraffic()
+		return float64(in)
+	})
+	r.CounterFunc("nova_bytes_sent_total", "Raw bytes sent to clients", func() float64 {
+		_, out := app.clientManager.GetTraffic()
+		return float64(out)
+	})
+	r.CounterFunc("nova_bus_dropped_total", "Messages dropped for lagging subscribers", func() float64 {
+		return float64(app.bus.Dropped())
+	})
+	r.CounterFunc("nova_webhook_failed_total", "Webhook events moved to dead letter log", func() float64 {
+		return float64(app.webhooks.Failed())
+	})
+	r.CounterFunc("nova_flood_dropped_total", "Frames dropped by rate limiter", func() float64 {
+		return float64(app.FloodStats().Dropped)
+	})
+	r.CounterFunc("nova_flood_notices_total", "Rate limit notices sent", func() float64 {
+		return float64(app.FloodStats().Notices)
+	})
+	r.CounterFunc("nova_flood_disconnects_total", "Clients disconnected for flooding", func() float64 {
+		return float64(app.FloodStats().Disconnected)
+	})
+}
+
+// countFrameError accounts frame parse error, connection errors are not counted
+func (app *Application) countFrameError(err error) {
+	if label := frameErrorLabel(err); label != "" {
+		app.metrics.frameErrors.Inc(label)
+	}
+}
+
+func frameErrorLabel(err error) string {
+	switch {
+	case errors.Is(err, novaprotocol.ErrorFrameZeroLength):
+		return "zero_length"
+	case errors.Is(err, novaprotocol.ErrorFrameSizeMissmatch):
+		return "size_mismatch"
+	case errors.Is(err, novaprotocol.ErrorFrameTooLarge):
+		return "too_large"
+	case errors.Is(err, novaprotocol.ErrorFrameNoHeader):
+		return "no_header"
+	case errors.Is(err, novaprotocol.ErrorFrameInvalidHashSum):
+		return "invalid_hashsum"
+	}
+	return ""
+}
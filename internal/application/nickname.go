@@ -0,0 +1,108 @@
+package application
+
+import (
+	"errors"
+	"fmt"
+	"novachat-server/common/linq"
+	"novachat-server/internal/clientmanager"
+	"novachat-server/internal/nickname"
+	"novachat-server/novaprotocol"
+	"novachat-server/novaprotocol/handshake"
+	"novachat-server/novaprotocol/serverapi"
+	"slices"
+)
+
+const (
+	maxNicknameAttempts = 3
+)
+
+var errorNicknameBanned = errors.New("nickname is banned")
+
+// setNickname validates nickname and assigns it to client, identity bans are checked for welcome and rename alike
+func (app *Application) setNickname(client clientmanager.Client, raw string) error {
+	nick, err := nickname.Normalize(raw)
+	if err != nil {
+		return err
+	}
+	skeleton := nickname.Skeleton(nick)
+	if ban, banned := app.banList.IsBanned(serverapi.BanKindIdentity, skeleton); banned {
+		return fmt.Errorf("%w: %s", errorNicknameBanned, ban.Reason)
+	}
+	// Directory of other nodes is eventually consistent, simultaneous joins on different nodes may still collide
+	others := append(app.listBots(), linq.Select(app.cluster.ListClients(), func(c serverapi.Client) *serverapi.Client { return &c })...)
+	for _, other := range others {
+		if other.ID != client.GetID() && nickname.Skeleton(other.Nickname) == skeleton {
+			return clientmanager.ErrorNicknameTaken
+		}
+	}
+	return app.clientManager.SetNickname(client, nick)
+}
+
+func nicknameErrorCode(err error) string {
+	if errors.Is(err, clientmanager.ErrorNicknameTaken) {
+		return serverapi.ErrorNicknameTaken
+	}
+	if errors.Is(err, errorNicknameBanned) {
+		return serverapi.ErrorBanned
+	}
+	return serverapi.ErrorNicknameInvalid
+}
+
+// acceptWelcome waits for welcome accept with valid and unique nickname,
+// rejected nicknames are reported to client so it can retry, accepted one is echoed back if client supports it
+func (app *Application) acceptWelcome(client clientmanager.Client) error {
+	for attempt := 0; attempt < maxNicknameAttempts; attempt++ {
+		cInfo, err := recvWelcomeAcceptMessage(client)
+		if err != nil {
+			return err
+		}
+		err = app.setNickname(client, cInfo.Nickname)
+		if err == nil {
+			client.SetCapabilities(app.negotiateCapabilities(cInfo.Capabilities))
+			if !slices.Contains(client.GetCapabilities(), handshake.CapWelcomeAck) {
+				return nil
+			}
+			// Acknowledge with canonical nickname
+			msg, err := novaprotocol.NewJsonMessage(novaprotocol.MSG_WELCOME_ACCEPT, clientInfo(client))
+			if err != nil {
+				return err
+			}
+			return respondJson(client, msg)
+		}
+		if rerr := respondError(client, novaprotocol.MSG_WELCOME_ACCEPT, nicknameErrorCode(err), err); rerr != nil {
+			return fmt.Errorf("failed to send nickname rejection: %w", rerr)
+		}
+		if errors.Is(err, errorNicknameBanned) {
+			return err
+		}
+	}
+	return fmt.Errorf("no acceptable nickname after %d attempts", maxNicknameAttempts)
+}
+
+// changeNickname renames client and notifies everyone, including client itself
+func (app *Application) changeNickname(client clientmanager.Client, data []byte) error {
+	req, err := novaprotocol.ParseJsonMessage[serverapi.NicknameChange](data)
+	if err != nil {
+		return fmt.Errorf("failed to parse nickname change: %w", err)
+	}
+	if req == nil {
+		return fmt.Errorf("empty nickname change")
+	}
+
+	oldNickname := client.GetNickname()
+	if err := app.setNickname(client, req.Nickname); err != nil {
+		return respondError(client, novaprotocol.MSG_NICKNAME_CHANGE, nicknameErrorCode(err), err)
+	}
+	app.announce(client)
+
+	msg, err := novaprotocol.NewJsonMessage(novaprotocol.MSG_NICKNAME_CHANGED, &serverapi.NicknameChanged{
+		ID:          client.GetID(),
+		Nickname:    client.GetNickname(),
+		OldNickname: oldNickname,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create message: %w", err)
+	}
+	app.broadcastJson(nil, msg)
+	return nil
+}
@@ -0,0 +1,253 @@
+package application
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"novachat-server/internal/bus"
+	"novachat-server/internal/clientmanager"
+	"novachat-server/internal/nickname"
+	"novachat-server/internal/plugin"
+	"novachat-server/novaprotocol"
+	"novachat-server/novaprotocol/serverapi"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Bot ids are name based uuids in this namespace, so bot keeps its id across restarts
+var botNamespace = uuid.MustParse("3c9b7e52-1d4a-4b8e-a0f6-5e27c8d41b93")
+
+// RegisterPlugin adds plugin, must be called before Start
+func (app *Application) RegisterPlugin(p plugin.Plugin) error {
+	if err := p.Init(pluginHost{app: app}); err != nil {
+		return fmt.Errorf("failed to init plugin %s: %w", p.Name(), err)
+	}
+	app.plugins = append(app.plugins, p)
+	app.logger.Info("plugin registered", slog.String("plugin", p.Name()))
+	return nil
+}
+
+// RegisterBot adds bot as virtual client listed among connections, must be called before Start
+func (app *Application) RegisterBot(b plugin.Bot) error {
+	nick, err := nickname.Normalize(b.Nickname())
+	if err != nil {
+		return fmt.Errorf("invalid bot nickname: %w", err)
+	}
+	bot := &botClient{
+		app:  app,
+		bot:  b,
+		info: serverapi.Client{ID: uuid.NewSHA1(botNamespace, []byte(b.Name())), Nickname: nick, Status: serverapi.PresenceOnline},
+	}
+	if app.bots.Exists(bot.info.ID) {
+		return fmt.Errorf("bot %s is already registered", b.Name())
+	}
+	bot.logger = app.logger.With(slog.String("bot", b.Name()), slog.String("client_id", bot.info.ID.String()))
+
+	if _, err := bot.subscribe(bus.DirectTopic(bot.info.ID)); err != nil {
+		return err
+	}
+	if err := app.RegisterPlugin(b); err != nil {
+		return err
+	}
+	app.bots.Set(bot.info.ID, bot)
+	if err := app.cluster.ClientUp(bot.info); err != nil {
+		bot.logger.Warn("failed to announce bot to cluster", slog.Any("error", err))
+	}
+	b.Attach(bot)
+	return nil
+}
+
+// listBots returns virtual clients of this node
+func (app *Application) listBots() []*serverapi.Client {
+	bots := make([]*serverapi.Client, 0, app.bots.Count())
+	app.bots.Foreach(func(_ uuid.UUID, bot *botClient) {
+		bots = append(bots, &bot.info)
+	})
+	return bots
+}
+
+// callPlugins runs hook of every plugin, panicking plugin does not take connection down
+func (app *Application) callPlugins(hook string, call func(p plugin.Plugin)) {
+	for _, p := range app.plugins {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					app.logger.Error("plugin panicked", slog.String("plugin", p.Name()), slog.String("hook", hook), slog.Any("panic", r))
+				}
+			}()
+			call(p)
+		}()
+	}
+}
+
+func (app *Application) pluginsConnect(client clientmanager.Client) {
+	info := *clientInfo(client)
+	app.callPlugins("OnConnect", func(p plugin.Plugin) { p.OnConnect(info) })
+}
+
+func (app *Application) pluginsDisconnect(client clientmanager.Client) {
+	info := *clientInfo(client)
+	app.callPlugins("OnDisconnect", func(p plugin.Plugin) { p.OnDisconnect(info) })
+}
+
+// privateMessage reports whether message carries admin command, credentials or key material, plugins never see those
+func privateMessage(msgType string) bool {
+	switch msgType {
+	case novaprotocol.MSG_REKEY, novaprotocol.MSG_ACCOUNT_CREATE, novaprotocol.MSG_DEVICE_LOGIN,
+		novaprotocol.MSG_DEVICE_LINK_CODE, novaprotocol.MSG_DEVICE_LINK, novaprotocol.MSG_DEVICE_LINK_CONFIRM:
+		return true
+	}
+	return strings.HasPrefix(msgType, "adm_")
+}
+
+// pluginsServerMessage returns true if a plugin consumed the message
+func (app *Application) pluginsServerMessage(client clientmanager.Client, msgType string, data []byte) bool {
+	if privateMessage(msgType) {
+		return false
+	}
+	info := *clientInfo(client)
+	consumed := false
+	app.callPlugins("OnServerMessage", func(p plugin.Plugin) {
+		if !consumed {
+			consumed = p.OnServerMessage(info, msgType, data)
+		}
+	})
+	return consumed
+}
+
+// pluginsRelay returns false if a plugin dropped the frame
+func (app *Application) pluginsRelay(client clientmanager.Client, l0frame *novaprotocol.NovaFrameL0) bool {
+	if len(app.plugins) == 0 {
+		return true
+	}
+	return app.pluginsRelayFrom(*clientInfo(client), nil, l0frame)
+}
+
+// pluginsRelayFrom is pluginsRelay for frame of client or bot, sending bot does not see its own frames
+func (app *Application) pluginsRelayFrom(info serverapi.Client, sender plugin.Bot, l0frame *novaprotocol.NovaFrameL0) bool {
+	allowed := true
+	app.callPlugins("OnRelay", func(p plugin.Plugin) {
+		// Bot ids derive from names, so name identifies the bot
+		if allowed && (sender == nil || p.Name() != sender.Name()) {
+			allowed = p.OnRelay(info, l0frame.GetDestination(), l0frame.GetData())
+		}
+	})
+	return allowed
+}
+
+// pluginHost exposes server to plugins
+type pluginHost struct {
+	app *Application
+}
+
+func (h pluginHost) ListClients() []serverapi.Client {
+	clients := make([]serverapi.Client, 0)
+	for _, c := range h.app.allClients() {
+		clients = append(clients, *c)
+	}
+	return clients
+}
+
+func (h pluginHost) SendJson(destination uuid.UUID, jsonMsg []byte) error {
+	if h.app.isLocal(destination) {
+		h.app.publishJson(bus.DirectTopic(destination), uuid.Nil, uuid.Nil, jsonMsg)
+		return nil
+	}
+	return h.app.cluster.SendJson(destination, jsonMsg)
+}
+
+// botClient is virtual client of a bot
+type botClient struct {
+	app    *Application
+	bot    plugin.Bot
+	info   serverapi.Client
+	logger *slog.Logger
+
+	mutex      sync.Mutex
+	mutedUntil time.Time
+}
+
+var (
+	errorBotMuted = errors.New("bot is muted")
+	errorDropped  = errors.New("frame dropped by plugin")
+)
+
+func (c *botClient) setMutedUntil(t time.Time) {
+	c.mutex.Lock()
+	c.mutedUntil = t
+	c.mutex.Unlock()
+}
+func (c *botClient) isMuted() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return time.Now().Before(c.mutedUntil)
+}
+
+func (c *botClient) GetID() uuid.UUID {
+	return c.info.ID
+}
+
+// subscribe delivers messages of topic to bot
+func (c *botClient) subscribe(topic string) (bus.Subscription, error) {
+	return c.app.bus.Subscribe(topic, func(msg bus.Message) {
+		if msg.Except == c.info.ID {
+			return
+		}
+		destination := msg.Destination
+		if destination == uuid.Nil {
+			destination = c.info.ID
+		}
+		defer func() {
+			if r := recover(); r != nil {
+				c.logger.Error("bot panicked", slog.Any("panic", r))
+			}
+		}()
+		c.bot.OnMessage(msg.Origin, destination, msg.Data)
+	}, func() {
+		c.logger.Warn("bot lagging behind, topic no longer delivered", slog.String("topic", topic))
+	})
+}
+
+func (c *botClient) JoinRoom(name string) (serverapi.Room, error) {
+	room, entered, err := c.app.enterRoom(c.info.ID, name, c.subscribe)
+	if err != nil {
+		return serverapi.Room{}, err
+	}
+	if entered {
+		c.app.notifyRoomMember(&c.info, novaprotocol.MSG_ROOM_JOINED, room)
+	}
+	return room, nil
+}
+
+func (c *botClient) Send(destination uuid.UUID, l1Frame []byte) error {
+	if c.isMuted() {
+		return errorBotMuted
+	}
+	l0 := novaprotocol.NewL0Frame(novaprotocol.L0FlagIsEncrypted, destination, l1Frame)
+	l0.SetOrigin(c.info.ID)
+	if !c.app.pluginsRelayFrom(c.info, c.bot, l0) {
+		return errorDropped
+	}
+	c.app.relay(c.logger, l0, time.Now())
+	return nil
+}
+
+func (c *botClient) SendText(destination uuid.UUID, text string) error {
+	l1, err := botText(text)
+	if err != nil {
+		return err
+	}
+	return c.Send(destination, l1)
+}
+
+// botText builds l1 frame of MSG_BOT_TEXT message
+func botText(text string) ([]byte, error) {
+	msg, err := novaprotocol.NewJsonMessage(novaprotocol.MSG_BOT_TEXT, &serverapi.BotText{Text: text})
+	if err != nil {
+		return nil, err
+	}
+	return novaprotocol.NewL1Frame(novaprotocol.L1FlagIsJson, msg).Build(nil)
+}
@@ -0,0 +1,101 @@
+package application
+
+import (
+	"fmt"
+	"log/slog"
+	"novachat-server/common/ratelimit"
+	"novachat-server/internal/bus"
+	"novachat-server/internal/clientmanager"
+	"novachat-server/novaprotocol"
+	"novachat-server/novaprotocol/serverapi"
+
+	"github.com/google/uuid"
+)
+
+const (
+	presenceRate  = 2  // presence updates per second
+	presenceBurst = 10 // allowed presence updates in a row
+	maxStatusText = 128
+)
+
+func (app *Application) presenceLimiter(client clientmanager.Client) ratelimit.Limiter {
+	limiter, ex := app.presenceLimiters.Get(client.GetID())
+	if !ex {
+		limiter = ratelimit.NewTokenBucket(presenceRate, presenceBurst)
+		app.presenceLimiters.Set(client.GetID(), limiter)
+	}
+	return limiter
+}
+
+// updatePresence handles ephemeral presence signals, nothing is persisted except the latest status
+func (app *Application) updatePresence(client clientmanager.Client, data []byte) error {
+	if !app.presenceLimiter(client).Allow() {
+		// Presence is best effort, silently drop floods
+		return nil
+	}
+
+	presence, err := novaprotocol.ParseJsonMessage[serverapi.Presence](data)
+	if err != nil {
+		return fmt.Errorf("failed to parse presence: %w", err)
+	}
+	if presence == nil {
+		return fmt.Errorf("empty presence")
+	}
+	if len(presence.Text) > maxStatusText {
+		return fmt.Errorf("status text is too long")
+	}
+
+	switch presence.State {
+	case serverapi.PresenceOnline, serverapi.PresenceIdle, serverapi.PresenceAway:
+		// Long-living status, visible in connections list
+		client.SetStatus(presence.State, presence.Text)
+		app.announce(client)
+	case serverapi.PresenceTypingStarted, serverapi.PresenceTypingStopped:
+		// Typing is never stored and never carries text
+		presence.Text = ""
+	default:
+		return fmt.Errorf("unknown presence state: %s", presence.State)
+	}
+	presence.ID = client.GetID()
+
+	msg, err := novaprotocol.NewJsonMessage(novaprotocol.MSG_PRESENCE, presence)
+	if err != nil {
+		return fmt.Errorf("failed to create message: %w", err)
+	}
+
+	if presence.Peer != uuid.Nil {
+		// Only the peer is interested
+		if _, ex := app.clientManager.GetClient(presence.Peer); !ex {
+			return app.cluster.SendJson(presence.Peer, msg)
+		}
+		app.publishJson(bus.DirectTopic(presence.Peer), uuid.Nil, uuid.Nil, msg)
+		return nil
+	}
+	app.broadcastJson(client, msg)
+	return nil
+}
+
+// broadcastJson sends server message to every client of the cluster except the given one
+func (app *Application) broadcastJson(except clientmanager.Client, jsonData []byte) {
+	app.broadcastLocal(except, jsonData)
+	if err := app.cluster.SendJson(uuid.Nil, jsonData); err != nil {
+		app.logger.Warn("failed to broadcast to cluster", slog.Any("error", err))
+	}
+}
+
+// broadcastLocal sends server message to every client of this node except the given one
+func (app *Application) broadcastLocal(except clientmanager.Client, jsonData []byte) {
+	exceptID := uuid.Nil
+	if except != nil {
+		exceptID = except.GetID()
+	}
+	app.publishJson(broadcastTopic(jsonData), exceptID, uuid.Nil, jsonData)
+}
+
+// broadcastTopic keeps presence signals lossy, connection and nickname events must reach every client
+func broadcastTopic(jsonData []byte) string {
+	if msgType, _ := novaprotocol.ParseJsonMessageType(jsonData); msgType == novaprotocol.MSG_PRESENCE {
+		return bus.TopicPresence
+	}
+	return bus.TopicBroadcast
+}
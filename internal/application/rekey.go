@@ -0,0 +1,112 @@
+package application
+
+import (
+	"fmt"
+	"log/slog"
+	"math/big"
+	"novachat-server/internal/clientmanager"
+	"novachat-server/novaprotocol"
+	"novachat-server/novaprotocol/handshake"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// rekeyState is pending transport key exchange of one connection
+type rekeyState struct {
+	mutex     sync.Mutex
+	private   *big.Int
+	startedAt time.Time
+}
+
+// rekeyDue reports whether current transport key was used long enough
+func (app *Application) rekeyDue(client clientmanager.Client) bool {
+	frames, bytes, since := client.GetKeyUsage()
+	return (app.cfg.RekeyFrames > 0 && frames >= app.cfg.RekeyFrames) ||
+		(app.cfg.RekeyBytes > 0 && bytes >= app.cfg.RekeyBytes) ||
+		(app.cfg.RekeyInterval > 0 && time.Since(since) >= app.cfg.RekeyInterval)
+}
+
+// checkRekey sends fresh public key to client once transport key is due, heartbeat keeps it checked on idle connections.
+// Rekey unanswered for HandshakeTimeout fails the connection, answer to a superseded key would desync transport keys
+func (app *Application) checkRekey(client clientmanager.Client) error {
+	if !slices.Contains(client.GetCapabilities(), handshake.CapRekey) {
+		return nil
+	}
+	r, ex := app.rekeys.Get(client.GetID())
+	if !ex {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.private != nil {
+		if time.Since(r.startedAt) < app.cfg.HandshakeTimeout {
+			return nil
+		}
+		return fmt.Errorf("client did not answer rekey")
+	}
+	if !app.rekeyDue(client) {
+		return nil
+	}
+
+	private, public, err := handshake.GenerateKeyPair(handshake.Generator2048, handshake.Prime2048)
+	if err != nil {
+		client.Logger().Error("failed to generate key pair", slog.Any("error", err))
+		return nil
+	}
+	msg, err := novaprotocol.NewJsonMessage(novaprotocol.MSG_REKEY, &handshake.Rekey{Pub: public.Text(62)})
+	if err != nil {
+		client.Logger().Error("failed to create rekey message", slog.Any("error", err))
+		return nil
+	}
+	if err := respondJson(client, msg); err != nil {
+		client.Logger().Warn("failed to send rekey", slog.Any("error", err))
+		return nil
+	}
+	r.private, r.startedAt = private, time.Now()
+	return nil
+}
+
+// finishRekey switches transport to key agreed with client's answer, client already sends with it
+func (app *Application) finishRekey(client clientmanager.Client, data []byte) error {
+	r, ex := app.rekeys.Get(client.GetID())
+	if !ex {
+		return fmt.Errorf("unexpected rekey")
+	}
+	r.mutex.Lock()
+	private := r.private
+	r.private = nil
+	r.mutex.Unlock()
+	if private == nil {
+		return fmt.Errorf("unexpected rekey")
+	}
+
+	rekey, err := novaprotocol.ParseJsonMessage[handshake.Rekey](data)
+	if err != nil || rekey == nil {
+		return fmt.Errorf("failed to parse rekey: %w", err)
+	}
+	clientPublic, ok := new(big.Int).SetString(rekey.Pub, 62)
+	if !ok || !handshake.ValidPublicKey(clientPublic) {
+		return fmt.Errorf("invalid rekey public key")
+	}
+	frames, bytes, _ := client.GetKeyUsage()
+	client.SetEncryptionKey(handshake.ComputeSharedKey(private, clientPublic))
+	app.metrics.rekeys.Inc()
+	client.Logger().Debug("transport key replaced", slog.Uint64("frames", frames), slog.Uint64("bytes", bytes))
+	return nil
+}
+
+// isRekeyAnswer reports whether frame is client answer to MSG_REKEY
+func isRekeyAnswer(l0frame *novaprotocol.NovaFrameL0) bool {
+	if l0frame.GetDestination() != uuid.Nil {
+		return false
+	}
+	l1, err := novaprotocol.ParseL1Frame(l0frame.GetData(), nil)
+	if err != nil || l1.GetFlags()&novaprotocol.L1FlagIsJson == 0 {
+		return false
+	}
+	msgType, _ := novaprotocol.ParseJsonMessageType(l1.GetData())
+	return msgType == novaprotocol.MSG_REKEY
+}
@@ -0,0 +1,155 @@
+package application
+
+import (
+	"fmt"
+	"log/slog"
+	"novachat-server/internal/bus"
+	"novachat-server/internal/clientmanager"
+	"novachat-server/internal/nickname"
+	"novachat-server/novaprotocol"
+	"novachat-server/novaprotocol/serverapi"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Room ids are name based uuids in this namespace
+var roomNamespace = uuid.MustParse("8f2d1c3a-6b0e-4f57-9a61-0c4e2b7d9e15")
+
+// roomID maps confusable names to the same room
+func roomID(name string) uuid.UUID {
+	return uuid.NewSHA1(roomNamespace, []byte(nickname.Skeleton(name)))
+}
+
+// clientRooms are rooms joined by one client or bot
+type clientRooms struct {
+	mutex sync.Mutex
+	rooms map[uuid.UUID]joinedRoom
+}
+
+type joinedRoom struct {
+	room serverapi.Room
+	sub  bus.Subscription
+}
+
+func (app *Application) clientRooms(member uuid.UUID) *clientRooms {
+	rooms, ex := app.rooms.Get(member)
+	if !ex {
+		rooms = &clientRooms{rooms: make(map[uuid.UUID]joinedRoom)}
+		app.rooms.Set(member, rooms)
+	}
+	return rooms
+}
+
+// isRoomMember reports whether destination is a room joined by member
+func (app *Application) isRoomMember(member uuid.UUID, id uuid.UUID) bool {
+	rooms, ex := app.rooms.Get(member)
+	if !ex {
+		return false
+	}
+	rooms.mutex.Lock()
+	defer rooms.mutex.Unlock()
+	_, ex = rooms.rooms[id]
+	return ex
+}
+
+// enterRoom subscribes member to room, returns false if it is already a member
+func (app *Application) enterRoom(member uuid.UUID, name string, subscribe func(topic string) (bus.Subscription, error)) (serverapi.Room, bool, error) {
+	// Room names follow nickname rules
+	name, err := nickname.Normalize(name)
+	if err != nil {
+		return serverapi.Room{}, false, err
+	}
+	room := serverapi.Room{ID: roomID(name), Name: name}
+
+	rooms := app.clientRooms(member)
+	rooms.mutex.Lock()
+	defer rooms.mutex.Unlock()
+	if joined, ex := rooms.rooms[room.ID]; ex {
+		return joined.room, false, nil
+	}
+	sub, err := subscribe(bus.RoomTopic(room.ID))
+	if err != nil {
+		return serverapi.Room{}, false, fmt.Errorf("failed to subscribe room: %w", err)
+	}
+	rooms.rooms[room.ID] = joinedRoom{room: room, sub: sub}
+	return room, true, nil
+}
+
+// sendRoomJson notifies room members on every node
+func (app *Application) sendRoomJson(room uuid.UUID, except uuid.UUID, jsonData []byte) {
+	app.publishJson(bus.RoomTopic(room), except, room, jsonData)
+	if err := app.cluster.SendJson(room, jsonData); err != nil {
+		app.logger.Warn("failed to send room message to cluster", slog.Any("error", err))
+	}
+}
+
+func (app *Application) notifyRoomMember(member *serverapi.Client, msgType string, room serverapi.Room) {
+	msg, err := novaprotocol.NewJsonMessage(msgType, &serverapi.RoomMember{Room: room, Client: *member})
+	if err != nil {
+		app.logger.Error("failed to create message", slog.Any("error", err))
+		return
+	}
+	app.sendRoomJson(room.ID, member.ID, msg)
+	app.webhooks.Emit(roomEvent(msgType), &serverapi.RoomMember{Room: room, Client: *member})
+}
+
+func (app *Application) joinRoom(client clientmanager.Client, data []byte) error {
+	req, err := novaprotocol.ParseJsonMessage[serverapi.RoomJoin](data)
+	if err != nil || req == nil {
+		return respondError(client, novaprotocol.MSG_ROOM_JOIN, serverapi.ErrorBadRequest, fmt.Errorf("invalid request"))
+	}
+	room, entered, err := app.enterRoom(client.GetID(), req.Name, func(topic string) (bus.Subscription, error) {
+		return app.subscribe(client, topic, frameTypeRoom)
+	})
+	if err != nil {
+		return respondError(client, novaprotocol.MSG_ROOM_JOIN, serverapi.ErrorBadRequest, err)
+	}
+	if err := respondAck(client, novaprotocol.MSG_ROOM_JOIN, &room); err != nil {
+		return err
+	}
+	if entered {
+		client.Logger().Debug("joined room", slog.String("room", room.Name))
+		app.notifyRoomMember(clientInfo(client), novaprotocol.MSG_ROOM_JOINED, room)
+	}
+	return nil
+}
+
+func (app *Application) leaveRoom(client clientmanager.Client, data []byte) error {
+	req, err := novaprotocol.ParseJsonMessage[serverapi.RoomLeave](data)
+	if err != nil || req == nil {
+		return respondError(client, novaprotocol.MSG_ROOM_LEAVE, serverapi.ErrorBadRequest, fmt.Errorf("invalid request"))
+	}
+
+	rooms := app.clientRooms(client.GetID())
+	rooms.mutex.Lock()
+	joined, ex := rooms.rooms[req.ID]
+	delete(rooms.rooms, req.ID)
+	rooms.mutex.Unlock()
+	if !ex {
+		return respondError(client, novaprotocol.MSG_ROOM_LEAVE, serverapi.ErrorNotFound, fmt.Errorf("room not joined"))
+	}
+	joined.sub.Unsubscribe()
+
+	if err := respondAck(client, novaprotocol.MSG_ROOM_LEAVE, &joined.room); err != nil {
+		return err
+	}
+	app.notifyRoomMember(clientInfo(client), novaprotocol.MSG_ROOM_LEFT, joined.room)
+	return nil
+}
+
+// leaveAllRooms is called when client disconnects
+func (app *Application) leaveAllRooms(client clientmanager.Client) {
+	rooms, ex := app.rooms.Get(client.GetID())
+	if !ex {
+		return
+	}
+	app.rooms.Remove(client.GetID())
+
+	rooms.mutex.Lock()
+	defer rooms.mutex.Unlock()
+	for _, joined := range rooms.rooms {
+		joined.sub.Unsubscribe()
+		app.notifyRoomMember(clientInfo(client), novaprotocol.MSG_ROOM_LEFT, joined.room)
+	}
+}
@@ -0,0 +1,51 @@
+package application
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+)
+
+// listenTcp starts raw tcp transport, accepted connections share client manager with websocket ones
+func (app *Application) listenTcp(tlsConfig *tls.Config) (net.Listener, error) {
+	listener, err := net.Listen("tcp", app.cfg.TcpHostname)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen tcp: %w", err)
+	}
+	if app.cfg.TcpTls {
+		if tlsConfig == nil {
+			listener.Close()
+			return nil, fmt.Errorf("tcp tls requires certificates")
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	app.logger.Info("tcp transport started", slog.String("addr", listener.Addr().String()), slog.Bool("tls", app.cfg.TcpTls))
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					app.logger.Error("tcp transport stopped", slog.Any("error", err))
+				}
+				return
+			}
+			go app.serveTcp(conn)
+		}
+	}()
+	return listener, nil
+}
+
+func (app *Application) serveTcp(conn net.Conn) {
+	if !app.acceptConnection() {
+		conn.Close()
+		return
+	}
+	remoteAddr := remoteHost(conn.RemoteAddr().String())
+	err := app.connectionHandler(conn, remoteAddr)
+	if err != nil {
+		app.logger.Warn("client connection failed", slog.String("remote_addr", remoteAddr), slog.String("transport", "tcp"), slog.Any("error", err))
+	}
+}
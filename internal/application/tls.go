@@ -0,0 +1,54 @@
+package application
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsEnabled reports whether server is configured to serve https/wss
+func (app *Application) tlsEnabled() bool {
+	return app.cfg.TlsCertFile != "" || app.cfg.TlsAutocertDir != ""
+}
+
+// tlsConfig builds server tls config, autocert manager is returned to serve ACME challenges
+func (app *Application) tlsConfig() (*tls.Config, *autocert.Manager, error) {
+	if app.cfg.TlsCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(app.cfg.TlsCertFile, app.cfg.TlsKeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load certificate: %w", err)
+		}
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}, nil, nil
+	}
+
+	if len(app.cfg.TlsAutocertHosts) == 0 {
+		return nil, nil, fmt.Errorf("autocert requires at least one host")
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(app.cfg.TlsAutocertDir),
+		HostPolicy: autocert.HostWhitelist(app.cfg.TlsAutocertHosts...),
+	}
+	return manager.TLSConfig(), manager, nil
+}
+
+// redirectHandler sends plain http requests to the same path over https
+func (app *Application) redirectHandler() http.Handler {
+	_, port, _ := net.SplitHostPort(app.cfg.HttpHostname)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
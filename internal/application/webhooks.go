@@ -0,0 +1,46 @@
+package application
+
+import (
+	"fmt"
+	"log/slog"
+	"novachat-server/internal/config"
+	"novachat-server/internal/webhook"
+	"novachat-server/novaprotocol"
+	"os"
+)
+
+// newWebhooks creates dispatcher from config, returned file is dead letter log if enabled
+func newWebhooks(cfg *config.AppConfig, node string, logger *slog.Logger) (webhook.Dispatcher, *os.File, error) {
+	targets, err := webhook.LoadTargets(cfg.WebhooksFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts := webhook.Options{
+		Node:       node,
+		Attempts:   cfg.WebhookAttempts,
+		Backoff:    cfg.WebhookBackoff,
+		MaxBackoff: cfg.WebhookMaxBackoff,
+		Timeout:    cfg.WebhookTimeout,
+		QueueSize:  cfg.WebhookQueueSize,
+	}
+	var deadLetter *os.File
+	if len(targets) > 0 && cfg.WebhookDeadLetterFile != "" {
+		file, err := os.OpenFile(cfg.WebhookDeadLetterFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open dead letter log: %w", err)
+		}
+		opts.DeadLetter, deadLetter = file, file
+	}
+	if len(targets) > 0 {
+		logger.Info("webhooks enabled", slog.Int("targets", len(targets)))
+	}
+	return webhook.NewDispatcher(targets, opts, logger.With(slog.String("component", "webhook"))), deadLetter, nil
+}
+
+// roomEvent maps room notification to webhook event
+func roomEvent(msgType string) string {
+	if msgType == novaprotocol.MSG_ROOM_JOINED {
+		return webhook.EventRoomJoined
+	}
+	return webhook.EventRoomLeft
+}
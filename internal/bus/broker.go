@@ -0,0 +1,131 @@
+package bus
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Broker is what bus needs from external message broker such as NATS or Redis pub/sub,
+// adapters wrap client library of the broker
+type Broker interface {
+	Publish(subject string, payload []byte) error
+	// Handler may be called concurrently
+	Subscribe(subject string, handler func(payload []byte)) (Subscription, error)
+	Close() error
+}
+
+type brokerBus struct {
+	broker    Broker
+	queueSize int
+	dropped   atomic.Uint64
+}
+
+type brokerSubscription struct {
+	upstream Subscription
+	queue    *queue
+}
+
+// NewBrokerBus creates bus on top of external broker, messages are encoded as json
+func NewBrokerBus(broker Broker, queueSize int) Bus {
+	return &brokerBus{
+		broker:    broker,
+		queueSize: queueSize,
+	}
+}
+
+func (b *brokerBus) Publish(topic string, msg Message) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+	return b.broker.Publish(topic, payload)
+}
+
+func (b *brokerBus) Subscribe(topic string, handler Handler, lagging Lagging) (Subscription, error) {
+	q := newQueue(topic, b.queueSize, &b.dropped, handler, lagging)
+	upstream, err := b.broker.Subscribe(topic, func(payload []byte) {
+		var msg Message
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			// Foreign publisher on our subject, nothing to deliver
+			return
+		}
+		q.push(msg, time.Now().Add(LagTimeout))
+	})
+	if err != nil {
+		q.close()
+		return nil, fmt.Errorf("failed to subscribe %s: %w", topic, err)
+	}
+	return &brokerSubscription{upstream: upstream, queue: q}, nil
+}
+
+func (b *brokerBus) Dropped() uint64 {
+	return b.dropped.Load()
+}
+
+func (b *brokerBus) Close() error {
+	return b.broker.Close()
+}
+
+func (s *brokerSubscription) Unsubscribe() error {
+	err := s.upstream.Unsubscribe()
+	s.queue.close()
+	return err
+}
+
+// localBroker is in-process stand-in for external broker
+type localBroker struct {
+	mutex    sync.RWMutex
+	subjects map[string]map[*localBrokerSubscription]struct{}
+}
+
+type localBrokerSubscription struct {
+	broker  *localBroker
+	subject string
+	handler func(payload []byte)
+}
+
+// NewLocalBroker creates broker delivering payloads within the process, used in tests and single node setups
+func NewLocalBroker() Broker {
+	return &localBroker{subjects: make(map[string]map[*localBrokerSubscription]struct{})}
+}
+
+func (b *localBroker) Publish(subject string, payload []byte) error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	for sub := range b.subjects[subject] {
+		sub.handler(payload)
+	}
+	return nil
+}
+
+func (b *localBroker) Subscribe(subject string, handler func(payload []byte)) (Subscription, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	sub := &localBrokerSubscription{broker: b, subject: subject, handler: handler}
+	if b.subjects[subject] == nil {
+		b.subjects[subject] = make(map[*localBrokerSubscription]struct{})
+	}
+	b.subjects[subject][sub] = struct{}{}
+	return sub, nil
+}
+
+func (b *localBroker) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subjects = make(map[string]map[*localBrokerSubscription]struct{})
+	return nil
+}
+
+func (s *localBrokerSubscription) Unsubscribe() error {
+	b := s.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.subjects[s.subject], s)
+	if len(b.subjects[s.subject]) == 0 {
+		delete(b.subjects, s.subject)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package bus
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Presence and typing signals, every client is subscribed. Lossy, the next signal supersedes a dropped one
+	TopicPresence = "presence"
+	// Connection events and nickname changes, every client is subscribed
+	TopicBroadcast = "broadcast"
+)
+
+// DirectTopic delivers messages to one client
+func DirectTopic(id uuid.UUID) string {
+	return "direct." + id.String()
+}
+
+// RoomTopic delivers messages to every member of room
+func RoomTopic(id uuid.UUID) string {
+	return "room." + id.String()
+}
+
+// AccountTopic delivers messages to every online device of account
+func AccountTopic(id uuid.UUID) string {
+	return "account." + id.String()
+}
+
+// Message is L1 frame on its way to subscribers, they wrap it into L0 frame of their connection
+type Message struct {
+	// Client which subscriptions skip the message, nil skips nobody
+	Except uuid.UUID `json:"except,omitzero"`
+	// L0 origin, nil for server messages
+	Origin uuid.UUID `json:"origin,omitzero"`
+	// L0 destination as sent by origin, nil means subscriber itself
+	Destination uuid.UUID `json:"destination,omitzero"`
+	Data        []byte    `json:"data"`
+	// When server received the frame, zero for server messages
+	ReceivedAt time.Time `json:"received_at,omitzero"`
+}
+
+// Handler consumes messages of one subscription, calls are sequential
+type Handler func(msg Message)
+
+// Lagging is called once when subscriber fell behind on lossless topic, subscription delivers nothing afterwards.
+// Subscriber should drop its connection so client resyncs
+type Lagging func()
+
+// LagTimeout is how long one publish waits for full queues of lossless topic, shared by all its subscribers
+const LagTimeout = time.Second
+
+type Subscription interface {
+	Unsubscribe() error
+}
+
+// Bus decouples routing from sockets: handlers publish to topics,
+// per-client subscribers write to connections at their own pace
+type Bus interface {
+	Publish(topic string, msg Message) error
+	// Subscribe delivers messages of topic to handler, only presence is lossy, nil lagging just drops
+	Subscribe(topic string, handler Handler, lagging Lagging) (Subscription, error)
+	// Messages dropped because subscriber queue was full
+	Dropped() uint64
+	Close() error
+}
+
+// queue is subscriber side of every bus implementation
+type queue struct {
+	messages chan Message
+	dropped  *atomic.Uint64
+	lossy    bool
+	lagging  Lagging
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+func newQueue(topic string, size int, dropped *atomic.Uint64, handler Handler, lagging Lagging) *queue {
+	q := &queue{
+		messages: make(chan Message, size),
+		dropped:  dropped,
+		lossy:    topic == TopicPresence,
+		lagging:  lagging,
+		stop:     make(chan struct{}),
+	}
+	go func() {
+		for {
+			select {
+			case msg := <-q.messages:
+				handler(msg)
+			case <-q.stop:
+				return
+			}
+		}
+	}()
+	return q
+}
+
+// push drops presence of slow subscriber right away, other topics wait until deadline
+// and then cut the subscriber off instead of silently losing its messages
+func (q *queue) push(msg Message, deadline time.Time) {
+	select {
+	case <-q.stop:
+		return
+	case q.messages <- msg:
+		return
+	default:
+	}
+	if q.lossy {
+		q.dropped.Add(1)
+		return
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-q.stop:
+	case q.messages <- msg:
+	case <-timer.C:
+		q.dropped.Add(1)
+		q.stopOnce.Do(func() {
+			close(q.stop)
+			if q.lagging != nil {
+				// Publisher may hold bus lock, lagging usually unsubscribes
+				go q.lagging()
+			}
+		})
+	}
+}
+
+// close stops delivery, message being handled is still completed
+func (q *queue) close() {
+	q.stopOnce.Do(func() {
+		close(q.stop)
+	})
+}
@@ -0,0 +1,134 @@
+package bus_test
+
+import (
+	"novachat-server/internal/bus"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func receive(t *testing.T, ch chan bus.Message) bus.Message {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	return bus.Message{}
+}
+
+func testFanOut(t *testing.T, b bus.Bus) {
+	defer b.Close()
+	room := bus.RoomTopic(uuid.New())
+
+	first, second := make(chan bus.Message, 4), make(chan bus.Message, 4)
+	sub1, err := b.Subscribe(room, func(msg bus.Message) { first <- msg }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Subscribe(room, func(msg bus.Message) { second <- msg }, nil); err != nil {
+		t.Fatal(err)
+	}
+	other := make(chan bus.Message, 4)
+	if _, err := b.Subscribe(bus.TopicPresence, func(msg bus.Message) { other <- msg }, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	origin := uuid.New()
+	if err := b.Publish(room, bus.Message{Origin: origin, Data: []byte("hi")}); err != nil {
+		t.Fatal(err)
+	}
+	for _, ch := range []chan bus.Message{first, second} {
+		msg := receive(t, ch)
+		if msg.Origin != origin || string(msg.Data) != "hi" {
+			t.Errorf("unexpected message: %+v", msg)
+		}
+	}
+
+	sub1.Unsubscribe()
+	b.Publish(room, bus.Message{Data: []byte("again")})
+	if msg := receive(t, second); string(msg.Data) != "again" {
+		t.Errorf("unexpected message: %+v", msg)
+	}
+	select {
+	case msg := <-first:
+		t.Errorf("unsubscribed handler got %+v", msg)
+	case msg := <-other:
+		t.Errorf("other topic got %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestLocalBus(t *testing.T) {
+	testFanOut(t, bus.NewLocalBus(16))
+}
+
+func TestBrokerBus(t *testing.T) {
+	testFanOut(t, bus.NewBrokerBus(bus.NewLocalBroker(), 16))
+}
+
+func TestSlowSubscriberDrops(t *testing.T) {
+	b := bus.NewLocalBus(1)
+	defer b.Close()
+
+	release := make(chan struct{})
+	b.Subscribe(bus.TopicPresence, func(bus.Message) { <-release }, nil)
+	for range 10 {
+		if err := b.Publish(bus.TopicPresence, bus.Message{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(release)
+	// One message is being handled and one is queued
+	if b.Dropped() < 8 {
+		t.Errorf("expected dropped messages, got %d", b.Dropped())
+	}
+}
+
+func TestLaggingSubscriberCutOff(t *testing.T) {
+	b := bus.NewLocalBus(1)
+	defer b.Close()
+	room := bus.RoomTopic(uuid.New())
+
+	release := make(chan struct{})
+	defer close(release)
+	lagging := make(chan struct{})
+	b.Subscribe(room, func(bus.Message) { <-release }, func() { close(lagging) })
+	for range 3 {
+		b.Publish(room, bus.Message{})
+	}
+	// One message is being handled, one is queued and the third times out
+	select {
+	case <-lagging:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lagging subscriber not reported")
+	}
+	if b.Dropped() != 1 {
+		t.Errorf("unexpected dropped count %d", b.Dropped())
+	}
+}
+
+func TestLaggingSubscribersShareDeadline(t *testing.T) {
+	b := bus.NewLocalBus(1)
+	defer b.Close()
+	room := bus.RoomTopic(uuid.New())
+
+	release := make(chan struct{})
+	defer close(release)
+	for range 3 {
+		b.Subscribe(room, func(bus.Message) { <-release }, nil)
+	}
+	start := time.Now()
+	for range 3 {
+		b.Publish(room, bus.Message{})
+	}
+	// Every subscriber times out on the third message, together
+	if elapsed := time.Since(start); elapsed > 2*bus.LagTimeout {
+		t.Errorf("publish stalled for %s", elapsed)
+	}
+	if b.Dropped() != 3 {
+		t.Errorf("unexpected dropped count %d", b.Dropped())
+	}
+}
@@ -0,0 +1,100 @@
+package bus
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type localBus struct {
+	queueSize int
+	dropped   atomic.Uint64
+
+	mutex  sync.RWMutex
+	topics map[string]map[*localSubscription]struct{}
+	closed bool
+}
+
+type localSubscription struct {
+	bus   *localBus
+	topic string
+	queue *queue
+}
+
+// NewLocalBus creates in-process bus, queueSize is the number of messages subscriber may lag behind
+func NewLocalBus(queueSize int) Bus {
+	return &localBus{
+		queueSize: queueSize,
+		topics:    make(map[string]map[*localSubscription]struct{}),
+	}
+}
+
+func (b *localBus) Publish(topic string, msg Message) error {
+	b.mutex.RLock()
+	if b.closed {
+		b.mutex.RUnlock()
+		return fmt.Errorf("bus is closed")
+	}
+	// Pushing may wait for slow subscribers, it must not block Subscribe and Unsubscribe
+	queues := make([]*queue, 0, len(b.topics[topic]))
+	for sub := range b.topics[topic] {
+		queues = append(queues, sub.queue)
+	}
+	b.mutex.RUnlock()
+
+	deadline := time.Now().Add(LagTimeout)
+	for _, q := range queues {
+		q.push(msg, deadline)
+	}
+	return nil
+}
+
+func (b *localBus) Subscribe(topic string, handler Handler, lagging Lagging) (Subscription, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return nil, fmt.Errorf("bus is closed")
+	}
+	sub := &localSubscription{
+		bus:   b,
+		topic: topic,
+		queue: newQueue(topic, b.queueSize, &b.dropped, handler, lagging),
+	}
+	if b.topics[topic] == nil {
+		b.topics[topic] = make(map[*localSubscription]struct{})
+	}
+	b.topics[topic][sub] = struct{}{}
+	return sub, nil
+}
+
+func (b *localBus) Dropped() uint64 {
+	return b.dropped.Load()
+}
+
+func (b *localBus) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.closed = true
+	for _, subs := range b.topics {
+		for sub := range subs {
+			sub.queue.close()
+		}
+	}
+	b.topics = make(map[string]map[*localSubscription]struct{})
+	return nil
+}
+
+func (s *localSubscription) Unsubscribe() error {
+	b := s.bus
+	b.mutex.Lock()
+	subs := b.topics[s.topic]
+	delete(subs, s)
+	if len(subs) == 0 {
+		delete(b.topics, s.topic)
+	}
+	b.mutex.Unlock()
+
+	s.queue.close()
+	return nil
+}
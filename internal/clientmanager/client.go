@@ -1,16 +1,22 @@
 package clientmanager
 
 import (
-	"fmt"
 	"io"
+	"log/slog"
 	"novachat-server/novaprotocol"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 type Client interface {
 	io.ReadWriteCloser
+	// SetEncryptionKey switches transport key atomically, frames of previous key are still decrypted for a while
 	SetEncryptionKey(key []byte)
+	// Frames and bytes protected by current key and when it was set
+	GetKeyUsage() (frames uint64, bytes uint64, since time.Time)
 
 	Encrypt(data []byte) ([]byte, error)
 	Decrypt(data []byte) ([]byte, error)
@@ -19,28 +25,94 @@ type Client interface {
 
 	SetInfo(nickname string)
 	GetNickname() string
+
+	SetStatus(status, text string)
+	GetStatus() (status string, text string)
+
+	// Logger carrying client id, nickname and remote address
+	Logger() *slog.Logger
+
+	// Host part of remote address
+	GetRemoteAddr() string
+	GetConnectedAt() time.Time
+
+	SetCapabilities(caps []string)
+	GetCapabilities() []string
+	// Raw bytes received from and sent to client
+	GetTraffic() (in uint64, out uint64)
+	// Sets read deadline if underlying connection supports it, zero time clears it
+	SetReadDeadline(t time.Time) error
+
+	SetAdmin(admin bool)
+	IsAdmin() bool
+
+	// Muted client can not relay frames to other clients
+	SetMutedUntil(t time.Time)
+	IsMuted() bool
+
+	// Signed in device, nil ids for anonymous client
+	SetAccount(account, device uuid.UUID)
+	GetAccount() (account uuid.UUID, device uuid.UUID)
+}
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
 }
 
 type client struct {
-	id      uuid.UUID
-	conn    io.ReadWriteCloser
-	manager *clientManagerImpl
+	id          uuid.UUID
+	conn        io.ReadWriteCloser
+	remoteAddr  string
+	connectedAt time.Time
+	manager     *clientManagerImpl
+	closeOnce   sync.Once
+	closeErr    error
+	bytesIn     atomic.Uint64
+	bytesOut    atomic.Uint64
 
-	encrypt novaprotocol.CryptFunc
-	decrypt novaprotocol.CryptFunc
+	keys novaprotocol.TransportKeys
 
-	nickname string
+	infoMutex    sync.RWMutex
+	nickname     string
+	status       string
+	statusText   string
+	admin        bool
+	mutedUntil   time.Time
+	account      uuid.UUID
+	device       uuid.UUID
+	capabilities []string
 }
 
 func (c *client) Read(p []byte) (n int, err error) {
-	return c.conn.Read(p)
+	n, err = c.conn.Read(p)
+	c.bytesIn.Add(uint64(n))
+	c.manager.bytesIn.Add(uint64(n))
+	return n, err
 }
 func (c *client) Write(p []byte) (n int, err error) {
-	return c.conn.Write(p)
+	n, err = c.conn.Write(p)
+	c.bytesOut.Add(uint64(n))
+	c.manager.bytesOut.Add(uint64(n))
+	return n, err
 }
 func (c *client) Close() error {
-	c.manager.clients.Remove(c.id)
-	return c.conn.Close()
+	c.closeOnce.Do(func() {
+		c.manager.clients.Remove(c.id)
+		c.closeErr = c.conn.Close()
+		c.Logger().Debug("client closed")
+	})
+	return c.closeErr
+}
+
+func (c *client) Logger() *slog.Logger {
+	attrs := []any{
+		slog.String("client_id", c.id.String()),
+		slog.String("remote_addr", c.remoteAddr),
+	}
+	if nickname := c.GetNickname(); nickname != "" {
+		attrs = append(attrs, slog.String("nickname", nickname))
+	}
+	return c.manager.logger.With(attrs...)
 }
 
 func (c *client) GetID() uuid.UUID {
@@ -48,25 +120,100 @@ func (c *client) GetID() uuid.UUID {
 }
 
 func (c *client) SetEncryptionKey(key []byte) {
-	c.encrypt, c.decrypt = novaprotocol.NewCryptoFuncs(key)
+	c.keys.SetKey(key)
+}
+func (c *client) GetKeyUsage() (uint64, uint64, time.Time) {
+	return c.keys.Usage()
 }
 
 func (c *client) Encrypt(data []byte) ([]byte, error) {
-	if c.encrypt != nil {
-		return c.encrypt(data)
-	}
-	return nil, fmt.Errorf("no encrypt func")
+	return c.keys.Encrypt(data)
 }
 func (c *client) Decrypt(data []byte) ([]byte, error) {
-	if c.decrypt != nil {
-		return c.decrypt(data)
-	}
-	return nil, fmt.Errorf("no decrypt func")
+	return c.keys.Decrypt(data)
 }
 
 func (c *client) SetInfo(nickname string) {
+	c.infoMutex.Lock()
 	c.nickname = nickname
+	c.infoMutex.Unlock()
 }
 func (c *client) GetNickname() string {
+	c.infoMutex.RLock()
+	defer c.infoMutex.RUnlock()
 	return c.nickname
 }
+
+func (c *client) SetStatus(status, text string) {
+	c.infoMutex.Lock()
+	c.status, c.statusText = status, text
+	c.infoMutex.Unlock()
+}
+func (c *client) GetStatus() (string, string) {
+	c.infoMutex.RLock()
+	defer c.infoMutex.RUnlock()
+	return c.status, c.statusText
+}
+
+func (c *client) GetRemoteAddr() string {
+	return c.remoteAddr
+}
+
+func (c *client) GetConnectedAt() time.Time {
+	return c.connectedAt
+}
+
+func (c *client) SetCapabilities(caps []string) {
+	c.infoMutex.Lock()
+	c.capabilities = caps
+	c.infoMutex.Unlock()
+}
+func (c *client) GetCapabilities() []string {
+	c.infoMutex.RLock()
+	defer c.infoMutex.RUnlock()
+	return c.capabilities
+}
+
+func (c *client) GetTraffic() (uint64, uint64) {
+	return c.bytesIn.Load(), c.bytesOut.Load()
+}
+
+func (c *client) SetReadDeadline(t time.Time) error {
+	if d, ok := c.conn.(readDeadliner); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *client) SetAdmin(admin bool) {
+	c.infoMutex.Lock()
+	c.admin = admin
+	c.infoMutex.Unlock()
+}
+func (c *client) IsAdmin() bool {
+	c.infoMutex.RLock()
+	defer c.infoMutex.RUnlock()
+	return c.admin
+}
+
+func (c *client) SetMutedUntil(t time.Time) {
+	c.infoMutex.Lock()
+	c.mutedUntil = t
+	c.infoMutex.Unlock()
+}
+func (c *client) IsMuted() bool {
+	c.infoMutex.RLock()
+	defer c.infoMutex.RUnlock()
+	return time.Now().Before(c.mutedUntil)
+}
+
+func (c *client) SetAccount(account, device uuid.UUID) {
+	c.infoMutex.Lock()
+	c.account, c.device = account, device
+	c.infoMutex.Unlock()
+}
+func (c *client) GetAccount() (uuid.UUID, uuid.UUID) {
+	c.infoMutex.RLock()
+	defer c.infoMutex.RUnlock()
+	return c.account, c.device
+}
@@ -1,23 +1,43 @@
 package clientmanager
 
 import (
+	"errors"
 	"io"
+	"log/slog"
 	"novachat-server/common/safemap"
+	"novachat-server/internal/nickname"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+var ErrorNicknameTaken = errors.New("nickname is already taken")
+
 type ClientManager interface {
-	NewClient(rw io.ReadWriteCloser) (Client, error)
+	NewClient(rw io.ReadWriteCloser, remoteAddr string) (Client, error)
 	GetClient(id uuid.UUID) (Client, bool)
 	ListClients() []Client
+	// Sets already validated nickname, fails if it is confusable with nickname of another client
+	SetNickname(c Client, nick string) error
+	Count() int
+	// Raw bytes received from and sent to all clients since start
+	GetTraffic() (in uint64, out uint64)
 }
 type clientManagerImpl struct {
+	logger  *slog.Logger
 	clients safemap.Safemap[uuid.UUID, Client]
+	// Makes uniqueness check and assignment atomic
+	nicknameMutex sync.Mutex
+
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
 }
 
-func NewClientManager() ClientManager {
+func NewClientManager(logger *slog.Logger) ClientManager {
 	return &clientManagerImpl{
+		logger:  logger,
 		clients: safemap.New[uuid.UUID, Client](),
 	}
 }
@@ -25,6 +45,12 @@ func NewClientManager() ClientManager {
 func (cm *clientManagerImpl) GetClient(id uuid.UUID) (Client, bool) {
 	return cm.clients.Get(id)
 }
+func (cm *clientManagerImpl) Count() int {
+	return cm.clients.Count()
+}
+func (cm *clientManagerImpl) GetTraffic() (uint64, uint64) {
+	return cm.bytesIn.Load(), cm.bytesOut.Load()
+}
 func (cm *clientManagerImpl) ListClients() []Client {
 	clients := make([]Client, 0)
 	cm.clients.Foreach(func(u uuid.UUID, c Client) {
@@ -33,16 +59,36 @@ func (cm *clientManagerImpl) ListClients() []Client {
 	return clients
 }
 
-func (cm *clientManagerImpl) NewClient(rw io.ReadWriteCloser) (Client, error) {
+func (cm *clientManagerImpl) NewClient(rw io.ReadWriteCloser, remoteAddr string) (Client, error) {
 	id, err := uuid.NewRandom()
 	if err != nil {
 		return nil, err
 	}
 	c := &client{
-		id:      id,
-		conn:    rw,
-		manager: cm,
+		id:          id,
+		conn:        rw,
+		remoteAddr:  remoteAddr,
+		connectedAt: time.Now(),
+		manager:     cm,
 	}
 	cm.clients.Set(id, c)
+	c.Logger().Debug("client created")
 	return c, nil
 }
+
+func (cm *clientManagerImpl) SetNickname(c Client, nick string) error {
+	cm.nicknameMutex.Lock()
+	defer cm.nicknameMutex.Unlock()
+
+	skeleton := nickname.Skeleton(nick)
+	for _, other := range cm.ListClients() {
+		if other.GetID() == c.GetID() || other.GetNickname() == "" {
+			continue
+		}
+		if nickname.Skeleton(other.GetNickname()) == skeleton {
+			return ErrorNicknameTaken
+		}
+	}
+	c.SetInfo(nick)
+	return nil
+}
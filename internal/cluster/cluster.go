@@ -0,0 +1,226 @@
+package cluster
+
+import (
+	"fmt"
+	"log/slog"
+	"novachat-server/common/safemap"
+	"novachat-server/novaprotocol"
+	"novachat-server/novaprotocol/serverapi"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Generated by backend when node becomes reachable, receiver sends its directory to it
+	KindHello = "hello"
+	// Generated by backend when node is lost, its clients are dropped from directory
+	KindBye = "bye"
+
+	KindClientUp   = "client_up" // client connected or changed
+	KindClientDown = "client_down"
+	KindFrame      = "frame"
+	KindJson       = "json"
+)
+
+// Message is a unit of inter-node link
+type Message struct {
+	Kind string `json:"kind"`
+	From string `json:"from"`
+
+	Client *serverapi.Client `json:"client,omitempty"`
+	Frame  *Frame            `json:"frame,omitempty"`
+	// Server json message to client or room, nil destination means every client of the node
+	Destination uuid.UUID `json:"destination,omitzero"`
+	Json        []byte    `json:"json,omitempty"`
+}
+
+// Frame is L0 frame in transit, data is already decrypted from origin transport key
+type Frame struct {
+	Origin      uuid.UUID `json:"origin"`
+	Destination uuid.UUID `json:"destination"`
+	Data        []byte    `json:"data"`
+}
+
+// Backend is inter-node link, one instance per node
+type Backend interface {
+	// Join attaches node to the link, receive is called sequentially for every incoming message
+	Join(node string, receive func(Message)) error
+	Leave() error
+	Send(node string, msg Message) error
+	// Broadcast sends message to every other node
+	Broadcast(msg Message) error
+}
+
+// Handler delivers cluster traffic to clients of this node
+type Handler interface {
+	// Destination is local client or room
+	DeliverFrame(frame *novaprotocol.NovaFrameL0)
+	// Destination is local client or room, nil destination means every local client
+	DeliverJson(destination uuid.UUID, jsonMsg []byte)
+	// Clients of lost node, they are already removed from directory
+	NodeLost(node string, clients []serverapi.Client)
+}
+
+// Cluster shares client directory between nodes and routes traffic to node holding destination.
+// Standalone server is a cluster of one node
+type Cluster interface {
+	NodeID() string
+	Start(handler Handler) error
+	Stop() error
+
+	// Announce local client to other nodes, repeated calls update it
+	ClientUp(info serverapi.Client) error
+	ClientDown(id uuid.UUID) error
+
+	// Clients connected to other nodes
+	GetClient(id uuid.UUID) (serverapi.Client, bool)
+	ListClients() []serverapi.Client
+
+	// Forward sends frame to node holding its destination, returns false if destination is unknown
+	Forward(frame *novaprotocol.NovaFrameL0) (bool, error)
+	// Multicast sends frame to every node, used for rooms which members may live anywhere
+	Multicast(frame *novaprotocol.NovaFrameL0) error
+	// SendJson sends server message to node holding destination client,
+	// other destinations (nil or room) are sent to every node
+	SendJson(destination uuid.UUID, jsonMsg []byte) error
+}
+
+type member struct {
+	node string
+	info serverapi.Client
+}
+
+type clusterImpl struct {
+	node    string
+	backend Backend
+	handler Handler
+	logger  *slog.Logger
+
+	local  safemap.Safemap[uuid.UUID, serverapi.Client]
+	remote safemap.Safemap[uuid.UUID, member]
+}
+
+func New(node string, backend Backend, logger *slog.Logger) Cluster {
+	return &clusterImpl{
+		node:    node,
+		backend: backend,
+		logger:  logger.With(slog.String("node", node)),
+		local:   safemap.New[uuid.UUID, serverapi.Client](),
+		remote:  safemap.New[uuid.UUID, member](),
+	}
+}
+
+func (c *clusterImpl) NodeID() string {
+	return c.node
+}
+
+func (c *clusterImpl) Start(handler Handler) error {
+	c.handler = handler
+	if err := c.backend.Join(c.node, c.receive); err != nil {
+		return fmt.Errorf("failed to join cluster: %w", err)
+	}
+	return nil
+}
+
+func (c *clusterImpl) Stop() error {
+	return c.backend.Leave()
+}
+
+func (c *clusterImpl) ClientUp(info serverapi.Client) error {
+	c.local.Set(info.ID, info)
+	return c.backend.Broadcast(Message{Kind: KindClientUp, From: c.node, Client: &info})
+}
+
+func (c *clusterImpl) ClientDown(id uuid.UUID) error {
+	c.local.Remove(id)
+	return c.backend.Broadcast(Message{Kind: KindClientDown, From: c.node, Client: &serverapi.Client{ID: id}})
+}
+
+func (c *clusterImpl) GetClient(id uuid.UUID) (serverapi.Client, bool) {
+	m, ex := c.remote.Get(id)
+	return m.info, ex
+}
+
+func (c *clusterImpl) ListClients() []serverapi.Client {
+	clients := make([]serverapi.Client, 0, c.remote.Count())
+	c.remote.Foreach(func(_ uuid.UUID, m member) {
+		clients = append(clients, m.info)
+	})
+	return clients
+}
+
+func (c *clusterImpl) Forward(frame *novaprotocol.NovaFrameL0) (bool, error) {
+	m, ex := c.remote.Get(frame.GetDestination())
+	if !ex {
+		return false, nil
+	}
+	return true, c.backend.Send(m.node, c.frameMessage(frame))
+}
+
+func (c *clusterImpl) Multicast(frame *novaprotocol.NovaFrameL0) error {
+	return c.backend.Broadcast(c.frameMessage(frame))
+}
+
+func (c *clusterImpl) frameMessage(frame *novaprotocol.NovaFrameL0) Message {
+	return Message{
+		Kind: KindFrame,
+		From: c.node,
+		Frame: &Frame{
+			Origin:      frame.GetOrigin(),
+			Destination: frame.GetDestination(),
+			Data:        frame.GetData(),
+		},
+	}
+}
+
+func (c *clusterImpl) SendJson(destination uuid.UUID, jsonMsg []byte) error {
+	msg := Message{Kind: KindJson, From: c.node, Destination: destination, Json: jsonMsg}
+	if m, ex := c.remote.Get(destination); ex {
+		return c.backend.Send(m.node, msg)
+	}
+	return c.backend.Broadcast(msg)
+}
+
+// receive handles message from another node, called sequentially by backend
+func (c *clusterImpl) receive(msg Message) {
+	switch msg.Kind {
+	case KindHello:
+		c.local.Foreach(func(_ uuid.UUID, info serverapi.Client) {
+			err := c.backend.Send(msg.From, Message{Kind: KindClientUp, From: c.node, Client: &info})
+			if err != nil {
+				c.logger.Warn("failed to send directory", slog.String("peer", msg.From), slog.Any("error", err))
+			}
+		})
+	case KindBye:
+		lost := make([]serverapi.Client, 0)
+		c.remote.Foreach(func(_ uuid.UUID, m member) {
+			if m.node == msg.From {
+				lost = append(lost, m.info)
+			}
+		})
+		for _, info := range lost {
+			c.remote.Remove(info.ID)
+		}
+		c.logger.Info("node lost", slog.String("peer", msg.From), slog.Int("clients", len(lost)))
+		c.handler.NodeLost(msg.From, lost)
+	case KindClientUp:
+		if msg.Client != nil {
+			c.remote.Set(msg.Client.ID, member{node: msg.From, info: *msg.Client})
+		}
+	case KindClientDown:
+		if msg.Client != nil {
+			c.remote.Remove(msg.Client.ID)
+		}
+	case KindFrame:
+		if msg.Frame == nil {
+			return
+		}
+		frame := novaprotocol.NewL0Frame(novaprotocol.L0FlagIsEncrypted, msg.Frame.Destination, msg.Frame.Data)
+		frame.SetOrigin(msg.Frame.Origin)
+		c.handler.DeliverFrame(frame)
+	case KindJson:
+		c.handler.DeliverJson(msg.Destination, msg.Json)
+	default:
+		c.logger.Warn("unknown cluster message", slog.String("kind", msg.Kind), slog.String("peer", msg.From))
+	}
+}
@@ -0,0 +1,140 @@
+package cluster_test
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"novachat-server/internal/cluster"
+	"novachat-server/novaprotocol"
+	"novachat-server/novaprotocol/serverapi"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type testHandler struct {
+	frames chan *novaprotocol.NovaFrameL0
+	jsons  chan []byte
+	lost   chan []serverapi.Client
+}
+
+func newTestHandler() *testHandler {
+	return &testHandler{
+		frames: make(chan *novaprotocol.NovaFrameL0, 16),
+		jsons:  make(chan []byte, 16),
+		lost:   make(chan []serverapi.Client, 16),
+	}
+}
+
+func (h *testHandler) DeliverFrame(frame *novaprotocol.NovaFrameL0) {
+	h.frames <- frame
+}
+func (h *testHandler) DeliverJson(_ uuid.UUID, jsonMsg []byte) {
+	h.jsons <- jsonMsg
+}
+func (h *testHandler) NodeLost(_ string, clients []serverapi.Client) {
+	h.lost <- clients
+}
+
+func receive[T any](t *testing.T, ch chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	var zero T
+	return zero
+}
+
+// waitClient polls directory, it is updated asynchronously
+func waitClient(t *testing.T, c cluster.Cluster, id uuid.UUID, present bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ex := c.GetClient(id); ex == present {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("client %s present=%v expected", id, present)
+}
+
+// testRouting checks directory sync, frame forwarding and node loss between two nodes
+func testRouting(t *testing.T, a, b cluster.Cluster) {
+	ha, hb := newTestHandler(), newTestHandler()
+
+	alice := serverapi.Client{ID: uuid.New(), Nickname: "alice"}
+	// Announced before b joins, b gets it with directory sync
+	if err := a.Start(ha); err != nil {
+		t.Fatal(err)
+	}
+	a.ClientUp(alice)
+	if err := b.Start(hb); err != nil {
+		t.Fatal(err)
+	}
+	waitClient(t, b, alice.ID, true)
+
+	bob := serverapi.Client{ID: uuid.New(), Nickname: "bob"}
+	b.ClientUp(bob)
+	waitClient(t, a, bob.ID, true)
+	if len(a.ListClients()) != 1 {
+		t.Errorf("local clients must not be listed: %v", a.ListClients())
+	}
+
+	frame := novaprotocol.NewL0Frame(novaprotocol.L0FlagIsEncrypted, alice.ID, []byte("hello"))
+	frame.SetOrigin(bob.ID)
+	if ok, err := b.Forward(frame); !ok || err != nil {
+		t.Fatalf("forward failed: %v %v", ok, err)
+	}
+	got := receive(t, ha.frames)
+	if got.GetOrigin() != bob.ID || got.GetDestination() != alice.ID || string(got.GetData()) != "hello" {
+		t.Errorf("unexpected frame: %v %v %q", got.GetOrigin(), got.GetDestination(), got.GetData())
+	}
+
+	if ok, _ := b.Forward(novaprotocol.NewL0Frame(novaprotocol.L0FlagIsEncrypted, uuid.New(), nil)); ok {
+		t.Error("unknown destination must not be forwarded")
+	}
+
+	a.SendJson(uuid.Nil, []byte(`{"type":"x"}`))
+	if got := receive(t, hb.jsons); string(got) != `{"type":"x"}` {
+		t.Errorf("unexpected json: %s", got)
+	}
+
+	if err := b.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	lost := receive(t, ha.lost)
+	if len(lost) != 1 || lost[0].ID != bob.ID {
+		t.Errorf("unexpected lost clients: %v", lost)
+	}
+	waitClient(t, a, bob.ID, false)
+	a.Stop()
+}
+
+func TestMemoryRouting(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	hub := cluster.NewMemoryHub()
+	testRouting(t,
+		cluster.New("a", hub.Backend(), logger),
+		cluster.New("b", hub.Backend(), logger))
+}
+
+func TestTcpRouting(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	addrA, addrB := freeAddr(t), freeAddr(t)
+	testRouting(t,
+		cluster.New("a", cluster.NewTcpBackend(addrA, []string{addrB}, "secret", logger), logger),
+		cluster.New("b", cluster.NewTcpBackend(addrB, []string{addrA}, "secret", logger), logger))
+}
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
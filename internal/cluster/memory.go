@@ -0,0 +1,146 @@
+package cluster
+
+import (
+	"fmt"
+	"sync"
+)
+
+// MemoryHub links nodes living in one process, used by tests and by standalone server
+type MemoryHub struct {
+	mutex sync.Mutex
+	nodes map[string]*memoryBackend
+}
+
+func NewMemoryHub() *MemoryHub {
+	return &MemoryHub{nodes: make(map[string]*memoryBackend)}
+}
+
+// Backend returns link for one more node
+func (h *MemoryHub) Backend() Backend {
+	return &memoryBackend{hub: h}
+}
+
+type memoryBackend struct {
+	hub   *MemoryHub
+	node  string
+	queue *mailbox
+	done  chan struct{}
+}
+
+// mailbox is unbounded queue, so senders never block while hub is locked
+type mailbox struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	items  []Message
+	closed bool
+}
+
+func newMailbox() *mailbox {
+	m := &mailbox{}
+	m.cond = sync.NewCond(&m.mutex)
+	return m
+}
+
+func (m *mailbox) push(msg Message) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return
+	}
+	m.items = append(m.items, msg)
+	m.cond.Signal()
+}
+
+func (m *mailbox) close() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.closed = true
+	m.cond.Signal()
+}
+
+// pop blocks until message is available, returns false when mailbox is closed and empty
+func (m *mailbox) pop() (Message, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for len(m.items) == 0 && !m.closed {
+		m.cond.Wait()
+	}
+	if len(m.items) == 0 {
+		return Message{}, false
+	}
+	msg := m.items[0]
+	m.items = m.items[1:]
+	return msg, true
+}
+
+func (b *memoryBackend) Join(node string, receive func(Message)) error {
+	h := b.hub
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, ex := h.nodes[node]; ex {
+		return fmt.Errorf("node %s already joined", node)
+	}
+
+	b.node = node
+	b.queue = newMailbox()
+	b.done = make(chan struct{})
+	go func() {
+		defer close(b.done)
+		for {
+			msg, ok := b.queue.pop()
+			if !ok {
+				return
+			}
+			receive(msg)
+		}
+	}()
+
+	for other, ob := range h.nodes {
+		ob.queue.push(Message{Kind: KindHello, From: node})
+		b.queue.push(Message{Kind: KindHello, From: other})
+	}
+	h.nodes[node] = b
+	return nil
+}
+
+func (b *memoryBackend) Leave() error {
+	h := b.hub
+	h.mutex.Lock()
+	if h.nodes[b.node] != b {
+		h.mutex.Unlock()
+		return fmt.Errorf("node %s is not joined", b.node)
+	}
+	delete(h.nodes, b.node)
+	for _, ob := range h.nodes {
+		ob.queue.push(Message{Kind: KindBye, From: b.node})
+	}
+	b.queue.close()
+	h.mutex.Unlock()
+
+	<-b.done
+	return nil
+}
+
+func (b *memoryBackend) Send(node string, msg Message) error {
+	h := b.hub
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	target, ex := h.nodes[node]
+	if !ex {
+		return fmt.Errorf("node %s not found", node)
+	}
+	target.queue.push(msg)
+	return nil
+}
+
+func (b *memoryBackend) Broadcast(msg Message) error {
+	h := b.hub
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for node, target := range h.nodes {
+		if node != b.node {
+			target.queue.push(msg)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package cluster
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	tcpRedialInterval = 2 * time.Second
+	tcpHelloTimeout   = 5 * time.Second
+	tcpWriteTimeout   = 10 * time.Second
+)
+
+// tcpHello opens every link connection, both sides prove they know the secret
+type tcpHello struct {
+	Node   string `json:"node"`
+	Secret string `json:"secret"`
+}
+
+// tcpBackend is full mesh of tcp connections carrying json messages.
+// Every node dials every peer and sends only over connections it dialed,
+// so peers must list every other node
+type tcpBackend struct {
+	listenAddr string
+	peers      []string
+	secret     string
+	logger     *slog.Logger
+
+	node     string
+	receive  func(Message)
+	listener net.Listener
+
+	// receive is called sequentially
+	receiveMutex sync.Mutex
+
+	mutex    sync.Mutex
+	outbound map[string]*tcpPeer
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+type tcpPeer struct {
+	mutex   sync.Mutex
+	conn    net.Conn
+	encoder *json.Encoder
+}
+
+// NewTcpBackend creates link listening on listenAddr and dialing peers, secret is shared by every node
+func NewTcpBackend(listenAddr string, peers []string, secret string, logger *slog.Logger) Backend {
+	return &tcpBackend{
+		listenAddr: listenAddr,
+		peers:      peers,
+		secret:     secret,
+		logger:     logger,
+		outbound:   make(map[string]*tcpPeer),
+		conns:      make(map[net.Conn]struct{}),
+	}
+}
+
+func (b *tcpBackend) Join(node string, receive func(Message)) error {
+	listener, err := net.Listen("tcp", b.listenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen cluster link: %w", err)
+	}
+	b.node = node
+	b.receive = receive
+	b.listener = listener
+	b.logger.Info("cluster link started", slog.String("addr", listener.Addr().String()), slog.Int("peers", len(b.peers)))
+
+	b.wg.Add(1)
+	go b.acceptLoop()
+	for _, addr := range b.peers {
+		b.wg.Add(1)
+		go b.dialLoop(addr)
+	}
+	return nil
+}
+
+func (b *tcpBackend) Leave() error {
+	b.mutex.Lock()
+	b.closed = true
+	for conn := range b.conns {
+		conn.Close()
+	}
+	b.mutex.Unlock()
+
+	err := b.listener.Close()
+	b.wg.Wait()
+	return err
+}
+
+func (b *tcpBackend) Send(node string, msg Message) error {
+	b.mutex.Lock()
+	peer, ex := b.outbound[node]
+	b.mutex.Unlock()
+	if !ex {
+		return fmt.Errorf("node %s is not reachable", node)
+	}
+	return peer.send(msg)
+}
+
+func (b *tcpBackend) Broadcast(msg Message) error {
+	b.mutex.Lock()
+	peers := make([]*tcpPeer, 0, len(b.outbound))
+	for _, peer := range b.outbound {
+		peers = append(peers, peer)
+	}
+	b.mutex.Unlock()
+
+	var errs []error
+	for _, peer := range peers {
+		if err := peer.send(msg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p *tcpPeer) send(msg Message) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+	return p.encoder.Encode(msg)
+}
+
+func (b *tcpBackend) deliver(msg Message) {
+	b.receiveMutex.Lock()
+	defer b.receiveMutex.Unlock()
+	b.receive(msg)
+}
+
+// track registers connection so Leave can close it, returns false if backend is already closed
+func (b *tcpBackend) track(conn net.Conn) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return false
+	}
+	b.conns[conn] = struct{}{}
+	return true
+}
+
+func (b *tcpBackend) untrack(conn net.Conn) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.conns, conn)
+}
+
+// dialLoop keeps outbound connection to peer, node becomes reachable when connection is established
+func (b *tcpBackend) dialLoop(addr string) {
+	defer b.wg.Done()
+	for {
+		conn, err := net.DialTimeout("tcp", addr, tcpHelloTimeout)
+		if err == nil {
+			if !b.track(conn) {
+				conn.Close()
+				return
+			}
+			err = b.serveOutbound(conn)
+			b.untrack(conn)
+			conn.Close()
+		}
+		b.mutex.Lock()
+		closed := b.closed
+		b.mutex.Unlock()
+		if closed {
+			return
+		}
+		b.logger.Debug("cluster peer unreachable", slog.String("addr", addr), slog.Any("error", err))
+		time.Sleep(tcpRedialInterval)
+	}
+}
+
+func (b *tcpBackend) serveOutbound(conn net.Conn) error {
+	peer := &tcpPeer{conn: conn, encoder: json.NewEncoder(conn)}
+	decoder := json.NewDecoder(conn)
+
+	conn.SetDeadline(time.Now().Add(tcpHelloTimeout))
+	if err := peer.encoder.Encode(tcpHello{Node: b.node, Secret: b.secret}); err != nil {
+		return fmt.Errorf("failed to send hello: %w", err)
+	}
+	var hello tcpHello
+	if err := decoder.Decode(&hello); err != nil {
+		return fmt.Errorf("failed to read hello: %w", err)
+	}
+	if !b.validHello(hello) {
+		return fmt.Errorf("invalid cluster secret")
+	}
+	if hello.Node == b.node {
+		return fmt.Errorf("peer %s is this node", conn.RemoteAddr().String())
+	}
+	conn.SetDeadline(time.Time{})
+
+	b.mutex.Lock()
+	b.outbound[hello.Node] = peer
+	b.mutex.Unlock()
+	defer func() {
+		b.mutex.Lock()
+		if b.outbound[hello.Node] == peer {
+			delete(b.outbound, hello.Node)
+		}
+		b.mutex.Unlock()
+	}()
+	b.logger.Info("cluster peer connected", slog.String("peer", hello.Node), slog.String("addr", conn.RemoteAddr().String()))
+	b.deliver(Message{Kind: KindHello, From: hello.Node})
+
+	// Nothing is expected from peer, read only to notice connection loss
+	var discard Message
+	for {
+		if err := decoder.Decode(&discard); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *tcpBackend) validHello(hello tcpHello) bool {
+	return hello.Node != "" && subtle.ConstantTimeCompare([]byte(hello.Secret), []byte(b.secret)) == 1
+}
+
+func (b *tcpBackend) acceptLoop() {
+	defer b.wg.Done()
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				b.logger.Error("cluster link stopped", slog.Any("error", err))
+			}
+			return
+		}
+		if !b.track(conn) {
+			conn.Close()
+			return
+		}
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			defer b.untrack(conn)
+			defer conn.Close()
+			if err := b.serveInbound(conn); err != nil {
+				b.logger.Debug("cluster inbound connection closed", slog.String("addr", conn.RemoteAddr().String()), slog.Any("error", err))
+			}
+		}()
+	}
+}
+
+// serveInbound reads messages of peer, node is lost when connection breaks
+func (b *tcpBackend) serveInbound(conn net.Conn) error {
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+
+	conn.SetDeadline(time.Now().Add(tcpHelloTimeout))
+	var hello tcpHello
+	if err := decoder.Decode(&hello); err != nil {
+		return fmt.Errorf("failed to read hello: %w", err)
+	}
+	if !b.validHello(hello) {
+		b.logger.Warn("rejected cluster peer", slog.String("addr", conn.RemoteAddr().String()))
+		return fmt.Errorf("invalid cluster secret")
+	}
+	if err := encoder.Encode(tcpHello{Node: b.node, Secret: b.secret}); err != nil {
+		return fmt.Errorf("failed to send hello: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	defer b.deliver(Message{Kind: KindBye, From: hello.Node})
+	for {
+		var msg Message
+		if err := decoder.Decode(&msg); err != nil {
+			return err
+		}
+		// Peer can speak only for itself
+		msg.From = hello.Node
+		b.deliver(msg)
+	}
+}
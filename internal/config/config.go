@@ -1,9 +1,114 @@
 package config
 
-import "github.com/ilyakaznacheev/cleanenv"
+import (
+	"time"
+
+	"github.com/ilyakaznacheev/cleanenv"
+)
 
 type AppConfig struct {
 	HttpHostname string `env:"HTTP_HOSTNAME" env-default:":8080"`
+
+	// Serve wss:// with certificate files, or with certificates obtained from Let's Encrypt
+	TlsCertFile      string   `env:"TLS_CERT_FILE"`
+	TlsKeyFile       string   `env:"TLS_KEY_FILE"`
+	TlsAutocertDir   string   `env:"TLS_AUTOCERT_DIR"`
+	TlsAutocertHosts []string `env:"TLS_AUTOCERT_HOSTS"`
+	// Plain http listener redirecting to https, empty disables it
+	HttpRedirectHostname string `env:"HTTP_REDIRECT_HOSTNAME"`
+
+	// Raw tcp transport for clients without websocket stack, empty disables it.
+	// With TcpTls it uses the same certificates as https
+	TcpHostname string `env:"TCP_HOSTNAME"`
+	TcpTls      bool   `env:"TCP_TLS"`
+
+	// Websocket Origin values like https://chat.example.com, empty allows any origin
+	AllowedOrigins []string `env:"ALLOWED_ORIGINS"`
+	// Concurrent connections, zero disables limit
+	MaxConnections      int `env:"MAX_CONNECTIONS"`
+	MaxConnectionsPerIp int `env:"MAX_CONNECTIONS_PER_IP"`
+	// Shared secret checked before key exchange, empty disables it.
+	// Token is sent in clear, so use it with tls
+	JoinToken string `env:"JOIN_TOKEN"`
+
+	// Cluster link, empty ClusterListen runs standalone server.
+	// ClusterPeers lists link addresses of every other node, link is trusted so keep it in private network
+	ClusterNode   string   `env:"CLUSTER_NODE"`
+	ClusterListen string   `env:"CLUSTER_LISTEN"`
+	ClusterPeers  []string `env:"CLUSTER_PEERS"`
+	ClusterSecret string   `env:"CLUSTER_SECRET"`
+
+	// Messages a client may lag behind, then presence is dropped and other fan-out disconnects it
+	BusQueueSize int `env:"BUS_QUEUE_SIZE" env-default:"1024"`
+
+	// Bot posting ReminderText to ReminderRoom every ReminderInterval, zero interval disables it
+	ReminderNickname string        `env:"REMINDER_NICKNAME" env-default:"Reminder"`
+	ReminderRoom     string        `env:"REMINDER_ROOM"`
+	ReminderText     string        `env:"REMINDER_TEXT"`
+	ReminderInterval time.Duration `env:"REMINDER_INTERVAL"`
+
+	// Json file with webhook targets: [{"url": "...", "secret": "...", "events": ["client.*"]}], empty disables webhooks.
+	// Events failed after WebhookAttempts are appended to WebhookDeadLetterFile
+	WebhooksFile          string        `env:"WEBHOOKS_FILE"`
+	WebhookDeadLetterFile string        `env:"WEBHOOK_DEAD_LETTER_FILE" env-default:"webhooks_dead.jsonl"`
+	WebhookAttempts       int           `env:"WEBHOOK_ATTEMPTS" env-default:"5"`
+	WebhookBackoff        time.Duration `env:"WEBHOOK_BACKOFF" env-default:"1s"`
+	WebhookMaxBackoff     time.Duration `env:"WEBHOOK_MAX_BACKOFF" env-default:"1m"`
+	WebhookTimeout        time.Duration `env:"WEBHOOK_TIMEOUT" env-default:"10s"`
+	WebhookQueueSize      int           `env:"WEBHOOK_QUEUE_SIZE" env-default:"1024"`
+
+	// Stored messages, every node keeps history of messages sent by its clients.
+	// Empty file keeps history in memory only
+	HistoryFile  string `env:"HISTORY_FILE" env-default:"history.jsonl"`
+	HistoryLimit int    `env:"HISTORY_LIMIT" env-default:"10000"` // messages per conversation
+	// Largest page client may request
+	HistoryMaxPage int `env:"HISTORY_MAX_PAGE" env-default:"200"`
+
+	// Accounts with their devices, empty file keeps accounts in memory only.
+	// Accounts are not shared between nodes, clustered server does not offer them
+	AccountsFile string `env:"ACCOUNTS_FILE" env-default:"accounts.json"`
+	// Time new device has to enter link code and issuer has to confirm it
+	DeviceLinkTTL time.Duration `env:"DEVICE_LINK_TTL" env-default:"5m"`
+
+	// REST integrations as name:token pairs, every integration appears to clients as bot with its name
+	Integrations map[string]string `env:"INTEGRATIONS"`
+
+	// debug, info, warn or error
+	LogLevel string `env:"LOG_LEVEL" env-default:"info"`
+	// text or json
+	LogFormat string `env:"LOG_FORMAT" env-default:"text"`
+
+	// Empty token disables admin commands
+	AdminToken string `env:"ADMIN_TOKEN"`
+	BansFile   string `env:"BANS_FILE" env-default:"bans.json"`
+
+	// Per client limits, burst is the amount allowed in a row
+	RateFramesPerSec float64 `env:"RATE_FRAMES_PER_SEC" env-default:"50"`
+	RateFramesBurst  float64 `env:"RATE_FRAMES_BURST" env-default:"100"`
+	RateBytesPerSec  float64 `env:"RATE_BYTES_PER_SEC" env-default:"4194304"`
+	RateBytesBurst   float64 `env:"RATE_BYTES_BURST" env-default:"67108864"`
+	RateApiPerSec    float64 `env:"RATE_API_PER_SEC" env-default:"10"`
+	RateApiBurst     float64 `env:"RATE_API_BURST" env-default:"20"`
+	// Violations before client gets error notices, and before it is disconnected
+	RateNoticeAfter     int `env:"RATE_NOTICE_AFTER" env-default:"5"`
+	RateDisconnectAfter int `env:"RATE_DISCONNECT_AFTER" env-default:"50"`
+
+	// Deadline of every handshake step
+	HandshakeTimeout time.Duration `env:"HANDSHAKE_TIMEOUT" env-default:"10s"`
+	// Transport key is exchanged again once it protected RekeyFrames frames, RekeyBytes bytes
+	// or is older than RekeyInterval, zero disables the limit
+	RekeyInterval time.Duration `env:"REKEY_INTERVAL" env-default:"1h"`
+	RekeyBytes    uint64        `env:"REKEY_BYTES" env-default:"1073741824"`
+	RekeyFrames   uint64        `env:"REKEY_FRAMES" env-default:"1000000"`
+	// Client is disconnected after PingMaxMissed pings without pong
+	PingInterval  time.Duration `env:"PING_INTERVAL" env-default:"30s"`
+	PingMaxMissed int           `env:"PING_MAX_MISSED" env-default:"2"`
+
+	// On shutdown server reports not ready for ShutdownDrain before closing connections
+	ShutdownDrain   time.Duration `env:"SHUTDOWN_DRAIN" env-default:"5s"`
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" env-default:"10s"`
+	// Bearer token for /status, empty token disables endpoint
+	StatusToken string `env:"STATUS_TOKEN"`
 }
 
 // Load environment variables to AppConfig instance
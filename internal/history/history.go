@@ -0,0 +1,424 @@
+package history
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"novachat-server/common/jsonlog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Reactions kept per message, further reactions are rejected
+const MaxReactions = 256
+
+// Page size used when cursor has no limit
+const DefaultLimit = 50
+
+// Log is compacted once it holds compactRatio lines per live entry, small logs are left alone
+const (
+	compactRatio    = 4
+	compactMinLines = 1024
+)
+
+var (
+	ErrorNotFound         = fmt.Errorf("message not found")
+	ErrorDuplicate        = fmt.Errorf("message already exists")
+	ErrorNotOwner         = fmt.Errorf("message belongs to another client")
+	ErrorDeleted          = fmt.Errorf("message is deleted")
+	ErrorTooManyReactions = fmt.Errorf("too many reactions")
+)
+
+// Direct conversation ids are name based uuids of both participant ids in this namespace
+var directNamespace = uuid.MustParse("b6a7f0d2-93c4-4e1b-8d25-7f1e0a6c3b48")
+
+// DirectConversation returns id of conversation between two participants, the same for both of them.
+// Participants are accounts of signed in devices, so conversation survives reconnects, or connections of anonymous clients
+func DirectConversation(a, b uuid.UUID) uuid.UUID {
+	if b.String() < a.String() {
+		a, b = b, a
+	}
+	return uuid.NewSHA1(directNamespace, append(a[:], b[:]...))
+}
+
+// Entry is stored message. Frames are l1 frames as sent by clients, usually end-to-end encrypted,
+// so server knows only ids and times
+type Entry struct {
+	Conversation uuid.UUID `json:"conversation"`
+	ID           uuid.UUID `json:"id"`
+	// Order of entry in conversation, assigned by Append
+	Seq    uint64    `json:"seq"`
+	Origin uuid.UUID `json:"origin"`
+	// Stable id of sender owning the entry, account of signed in device or connection of anonymous client
+	Author      uuid.UUID `json:"author,omitzero"`
+	Destination uuid.UUID `json:"destination"`
+	SentAt      time.Time `json:"sent_at"`
+	// Message this one answers and root of its thread, Thread is assigned by Append
+	ReplyTo uuid.UUID `json:"reply_to,omitzero"`
+	Thread  uuid.UUID `json:"thread,omitzero"`
+	Frame   []byte    `json:"frame,omitempty"`
+	// Latest edit, replaces content of Frame
+	Edit      []byte     `json:"edit,omitempty"`
+	EditedAt  time.Time  `json:"edited_at,omitzero"`
+	Reactions []Reaction `json:"reactions,omitempty"`
+	// Deleted entry is tombstone without frames, kept so clients catching up remove the message
+	Deleted   bool      `json:"deleted,omitempty"`
+	DeletedAt time.Time `json:"deleted_at,omitzero"`
+}
+
+// owner is author of entry, entries stored before authors were tracked are owned by origin connection
+func (e *Entry) owner() uuid.UUID {
+	if e.Author != uuid.Nil {
+		return e.Author
+	}
+	return e.Origin
+}
+
+// Reaction frames are replayed in order, so removal of reaction follows its addition
+type Reaction struct {
+	Client uuid.UUID `json:"client"`
+	Frame  []byte    `json:"frame"`
+	At     time.Time `json:"at"`
+}
+
+// Cursor selects page of entries. Before and After are entry ids, page ends right before Before
+// or starts right after After. Without both of them page holds the latest entries
+type Cursor struct {
+	Before uuid.UUID
+	After  uuid.UUID
+	Limit  int
+}
+
+// Store keeps recent messages of every conversation
+type Store interface {
+	Append(entry Entry) error
+	// Edit, Delete and React return updated entry, only author may edit or delete entry
+	Edit(conversation, id, author uuid.UUID, frame []byte, at time.Time) (Entry, error)
+	Delete(conversation, id, author uuid.UUID, at time.Time) (Entry, error)
+	React(conversation, id, client uuid.UUID, frame []byte, at time.Time) (Entry, error)
+	Get(conversation, id uuid.UUID) (Entry, bool)
+	// Page returns entries of conversation oldest first, more is true if there are entries
+	// beyond the page in cursor direction
+	Page(conversation uuid.UUID, cursor Cursor) (entries []Entry, more bool, err error)
+	// Thread pages root entry followed by every reply in its thread
+	Thread(conversation, root uuid.UUID, cursor Cursor) (entries []Entry, more bool, err error)
+	Close() error
+}
+
+type conversation struct {
+	// Ordered by Seq
+	entries []*Entry
+	byID    map[uuid.UUID]*Entry
+	// Replies by thread root, ordered by Seq
+	threads map[uuid.UUID][]*Entry
+	nextSeq uint64
+}
+
+type storeImpl struct {
+	mutex         sync.Mutex
+	limit         int
+	conversations map[uuid.UUID]*conversation
+	// Entries in all conversations
+	live int
+	log  jsonlog.Log
+}
+
+// NewStore loads history from json lines file, every change appends updated entry to it.
+// Conversations keep limit latest entries, zero limit keeps everything. Empty path keeps history in memory only
+func NewStore(path string, limit int) (Store, error) {
+	s := &storeImpl{
+		limit:         limit,
+		conversations: make(map[uuid.UUID]*conversation),
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	log, err := jsonlog.Open(path, 64<<20, func(line int, data []byte) error {
+		var entry Entry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return fmt.Errorf("failed to parse history line %d: %w", line, err)
+		}
+		// Later lines are newer versions of the same entry
+		if old, ex := s.get(entry.Conversation, entry.ID); ex {
+			*old = entry
+		} else {
+			s.insert(&entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history: %w", err)
+	}
+	s.log = log
+	// Log is compacted on every start and whenever it grows too much
+	if err := s.compact(); err != nil {
+		log.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *storeImpl) compact() error {
+	err := s.log.Rewrite(func(write func(v any) error) error {
+		for _, c := range s.conversations {
+			for _, entry := range c.entries {
+				if err := write(entry); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to compact history: %w", err)
+	}
+	return nil
+}
+
+// save appends entry to log and compacts log grown with edits and entries dropped by limit, caller holds mutex
+func (s *storeImpl) save(entry *Entry) error {
+	if s.log == nil {
+		return nil
+	}
+	if err := s.log.Append(entry); err != nil {
+		return fmt.Errorf("failed to save history: %w", err)
+	}
+	if lines := s.log.Lines(); lines > compactMinLines && lines > compactRatio*s.live {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *storeImpl) get(conversationID, id uuid.UUID) (*Entry, bool) {
+	c, ex := s.conversations[conversationID]
+	if !ex {
+		return nil, false
+	}
+	entry, ex := c.byID[id]
+	return entry, ex
+}
+
+func (s *storeImpl) conversation(id uuid.UUID) *conversation {
+	c, ex := s.conversations[id]
+	if !ex {
+		c = &conversation{byID: make(map[uuid.UUID]*Entry), threads: make(map[uuid.UUID][]*Entry)}
+		s.conversations[id] = c
+	}
+	return c
+}
+
+// insert adds entry with assigned Seq and Thread and drops oldest entries over limit
+func (s *storeImpl) insert(entry *Entry) {
+	c := s.conversation(entry.Conversation)
+	c.entries = append(c.entries, entry)
+	c.byID[entry.ID] = entry
+	s.live++
+	c.nextSeq = max(c.nextSeq, entry.Seq+1)
+	if entry.Thread != uuid.Nil {
+		c.threads[entry.Thread] = append(c.threads[entry.Thread], entry)
+	}
+
+	if s.limit > 0 && len(c.entries) > s.limit {
+		for _, old := range c.entries[:len(c.entries)-s.limit] {
+			delete(c.byID, old.ID)
+			// Replies are ordered too, so the oldest one is first
+			if replies := c.threads[old.Thread]; old.Thread != uuid.Nil && len(replies) > 0 && replies[0] == old {
+				if len(replies) == 1 {
+					delete(c.threads, old.Thread)
+				} else {
+					c.threads[old.Thread] = replies[1:]
+				}
+			}
+		}
+		s.live -= len(c.entries) - s.limit
+		c.entries = append([]*Entry(nil), c.entries[len(c.entries)-s.limit:]...)
+	}
+}
+
+func (s *storeImpl) Append(entry Entry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ex := s.get(entry.Conversation, entry.ID); ex {
+		return ErrorDuplicate
+	}
+	entry.Seq = s.conversation(entry.Conversation).nextSeq
+	entry.Thread = uuid.Nil
+	if entry.ReplyTo != uuid.Nil {
+		// Replies to replies stay in thread of the root, parent dropped by limit is treated as root
+		entry.Thread = entry.ReplyTo
+		if parent, ex := s.get(entry.Conversation, entry.ReplyTo); ex && parent.Thread != uuid.Nil {
+			entry.Thread = parent.Thread
+		}
+	}
+	s.insert(&entry)
+	return s.save(&entry)
+}
+
+// update applies change to live entry and saves it
+func (s *storeImpl) update(conversationID, id uuid.UUID, change func(entry *Entry) error) (Entry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, ex := s.get(conversationID, id)
+	if !ex {
+		return Entry{}, ErrorNotFound
+	}
+	if entry.Deleted {
+		return Entry{}, ErrorDeleted
+	}
+	updated := *entry
+	if err := change(&updated); err != nil {
+		return Entry{}, err
+	}
+	*entry = updated
+	return updated, s.save(entry)
+}
+
+func (s *storeImpl) Edit(conversationID, id, author uuid.UUID, frame []byte, at time.Time) (Entry, error) {
+	return s.update(conversationID, id, func(entry *Entry) error {
+		if entry.owner() != author {
+			return ErrorNotOwner
+		}
+		entry.Edit = frame
+		entry.EditedAt = at
+		return nil
+	})
+}
+
+func (s *storeImpl) Delete(conversationID, id, author uuid.UUID, at time.Time) (Entry, error) {
+	return s.update(conversationID, id, func(entry *Entry) error {
+		if entry.owner() != author {
+			return ErrorNotOwner
+		}
+		entry.Frame = nil
+		entry.Edit = nil
+		entry.Reactions = nil
+		entry.Deleted = true
+		entry.DeletedAt = at
+		return nil
+	})
+}
+
+func (s *storeImpl) React(conversationID, id, client uuid.UUID, frame []byte, at time.Time) (Entry, error) {
+	return s.update(conversationID, id, func(entry *Entry) error {
+		if len(entry.Reactions) >= MaxReactions {
+			return ErrorTooManyReactions
+		}
+		// Copy, so readers of previous version are not affected
+		entry.Reactions = append(append([]Reaction(nil), entry.Reactions...), Reaction{Client: client, Frame: frame, At: at})
+		return nil
+	})
+}
+
+func (s *storeImpl) Get(conversationID, id uuid.UUID) (Entry, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, ex := s.get(conversationID, id)
+	if !ex {
+		return Entry{}, false
+	}
+	return *entry, true
+}
+
+// page cuts cursor page out of entries ordered by Seq, cursor ids are looked up in byID
+func page(entries []*Entry, byID map[uuid.UUID]*Entry, cursor Cursor) ([]Entry, bool, error) {
+	limit := cursor.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	position := func(id uuid.UUID) (int, error) {
+		entry, ex := byID[id]
+		if !ex {
+			return 0, ErrorNotFound
+		}
+		i, found := slices.BinarySearchFunc(entries, entry.Seq, func(e *Entry, seq uint64) int {
+			return cmp.Compare(e.Seq, seq)
+		})
+		if !found {
+			// Entry is not part of this thread
+			return 0, ErrorNotFound
+		}
+		return i, nil
+	}
+
+	// Page is entries[from:to]
+	from, to := 0, len(entries)
+	more := false
+	switch {
+	case cursor.After != uuid.Nil:
+		i, err := position(cursor.After)
+		if err != nil {
+			return nil, false, err
+		}
+		from = i + 1
+		if cursor.Before != uuid.Nil {
+			if to, err = position(cursor.Before); err != nil {
+				return nil, false, err
+			}
+		}
+		if to-from > limit {
+			to, more = from+limit, true
+		}
+	default:
+		if cursor.Before != uuid.Nil {
+			i, err := position(cursor.Before)
+			if err != nil {
+				return nil, false, err
+			}
+			to = i
+		}
+		if to-from > limit {
+			from, more = to-limit, true
+		}
+	}
+	if from > to {
+		from = to
+	}
+
+	result := make([]Entry, 0, to-from)
+	for _, entry := range entries[from:to] {
+		result = append(result, *entry)
+	}
+	return result, more, nil
+}
+
+func (s *storeImpl) Page(conversationID uuid.UUID, cursor Cursor) ([]Entry, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c, ex := s.conversations[conversationID]
+	if !ex {
+		if cursor.Before != uuid.Nil || cursor.After != uuid.Nil {
+			return nil, false, ErrorNotFound
+		}
+		return []Entry{}, false, nil
+	}
+	return page(c.entries, c.byID, cursor)
+}
+
+func (s *storeImpl) Thread(conversationID, root uuid.UUID, cursor Cursor) ([]Entry, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rootEntry, ex := s.get(conversationID, root)
+	if !ex {
+		return nil, false, ErrorNotFound
+	}
+	c := s.conversations[conversationID]
+	replies := c.threads[root]
+	thread := make([]*Entry, 0, len(replies)+1)
+	thread = append(thread, rootEntry)
+	return page(append(thread, replies...), c.byID, cursor)
+}
+
+func (s *storeImpl) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.log == nil {
+		return nil
+	}
+	err := s.log.Close()
+	s.log = nil
+	return err
+}
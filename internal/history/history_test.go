@@ -0,0 +1,191 @@
+package history_test
+
+import (
+	"bytes"
+	"errors"
+	"novachat-server/internal/history"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestEditDeleteReact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	store, err := history.NewStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob := uuid.New(), uuid.New()
+	conv := history.DirectConversation(alice, bob)
+	if conv != history.DirectConversation(bob, alice) {
+		t.Fatal("direct conversation depends on order")
+	}
+	first, second := uuid.New(), uuid.New()
+	now := time.Now()
+	for _, id := range []uuid.UUID{first, second} {
+		if err := store.Append(history.Entry{Conversation: conv, ID: id, Origin: alice, Destination: bob, SentAt: now, Frame: []byte("msg")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Append(history.Entry{Conversation: conv, ID: first}); !errors.Is(err, history.ErrorDuplicate) {
+		t.Errorf("duplicate: got %v", err)
+	}
+
+	if _, err := store.Edit(conv, first, bob, []byte("hijack"), now); !errors.Is(err, history.ErrorNotOwner) {
+		t.Errorf("edit by other client: got %v", err)
+	}
+	if _, err := store.Edit(conv, first, alice, []byte("fixed"), now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.React(conv, first, bob, []byte("+1"), now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Delete(conv, second, alice, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.React(conv, second, bob, []byte("+1"), now); !errors.Is(err, history.ErrorDeleted) {
+		t.Errorf("react to deleted: got %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Final state survives restart
+	store, err = history.NewStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	entry, ok := store.Get(conv, first)
+	if !ok || string(entry.Frame) != "msg" || string(entry.Edit) != "fixed" || len(entry.Reactions) != 1 || entry.Reactions[0].Client != bob {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+	tombstone, ok := store.Get(conv, second)
+	if !ok || !tombstone.Deleted || tombstone.Frame != nil || tombstone.DeletedAt.IsZero() {
+		t.Errorf("unexpected tombstone %+v", tombstone)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	store, _ := history.NewStore("", 2)
+	conv := uuid.New()
+	ids := []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+	for _, id := range ids {
+		store.Append(history.Entry{Conversation: conv, ID: id})
+	}
+	if _, ok := store.Get(conv, ids[0]); ok {
+		t.Error("oldest entry was not dropped")
+	}
+	if _, ok := store.Get(conv, ids[2]); !ok {
+		t.Error("latest entry was dropped")
+	}
+}
+
+func TestCompactWhileRunning(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	store, _ := history.NewStore(path, 2)
+	defer store.Close()
+	conv := uuid.New()
+	var last uuid.UUID
+	for range 5000 {
+		last = uuid.New()
+		if err := store.Append(history.Entry{Conversation: conv, ID: last}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, _ := os.ReadFile(path)
+	if lines := bytes.Count(data, []byte("\n")); lines > 2000 {
+		t.Errorf("log of 2 entries grew to %d lines", lines)
+	}
+
+	store.Close()
+	store, err := history.NewStore(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if _, ok := store.Get(conv, last); !ok {
+		t.Error("latest entry lost by compaction")
+	}
+}
+
+func TestPageAndThread(t *testing.T) {
+	store, _ := history.NewStore("", 0)
+	conv := uuid.New()
+	ids := make([]uuid.UUID, 10)
+	for i := range ids {
+		ids[i] = uuid.New()
+		entry := history.Entry{Conversation: conv, ID: ids[i]}
+		// 3 answers 1, 5 answers 3, so both are in thread of 1
+		switch i {
+		case 3:
+			entry.ReplyTo = ids[1]
+		case 5:
+			entry.ReplyTo = ids[3]
+		}
+		if err := store.Append(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pageIDs := func(entries []history.Entry) []uuid.UUID {
+		result := make([]uuid.UUID, 0, len(entries))
+		for _, e := range entries {
+			result = append(result, e.ID)
+		}
+		return result
+	}
+	check := func(name string, entries []history.Entry, more bool, err error, want []uuid.UUID, wantMore bool) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := pageIDs(entries); !slices.Equal(got, want) || more != wantMore {
+			t.Errorf("%s: got %v more=%v, want %v more=%v", name, got, more, want, wantMore)
+		}
+	}
+
+	entries, more, err := store.Page(conv, history.Cursor{Limit: 3})
+	check("latest", entries, more, err, ids[7:], true)
+	entries, more, err = store.Page(conv, history.Cursor{Before: ids[7], Limit: 3})
+	check("before", entries, more, err, ids[4:7], true)
+	entries, more, err = store.Page(conv, history.Cursor{Before: ids[2], Limit: 3})
+	check("first page", entries, more, err, ids[:2], false)
+	entries, more, err = store.Page(conv, history.Cursor{After: ids[6], Limit: 5})
+	check("after", entries, more, err, ids[7:], false)
+	if _, _, err := store.Page(conv, history.Cursor{After: uuid.New()}); !errors.Is(err, history.ErrorNotFound) {
+		t.Errorf("unknown cursor: got %v", err)
+	}
+
+	entries, more, err = store.Thread(conv, ids[1], history.Cursor{})
+	check("thread", entries, more, err, []uuid.UUID{ids[1], ids[3], ids[5]}, false)
+	entries, more, err = store.Thread(conv, ids[1], history.Cursor{After: ids[1], Limit: 1})
+	check("thread after root", entries, more, err, []uuid.UUID{ids[3]}, true)
+	if entries[0].Thread != ids[1] {
+		t.Errorf("unexpected thread %s", entries[0].Thread)
+	}
+	if _, _, err := store.Thread(conv, ids[1], history.Cursor{After: ids[2]}); !errors.Is(err, history.ErrorNotFound) {
+		t.Errorf("cursor outside of thread: got %v", err)
+	}
+}
+
+func TestAuthorOwnsAcrossConnections(t *testing.T) {
+	store, _ := history.NewStore("", 0)
+	account, peer := uuid.New(), uuid.New()
+	conv := history.DirectConversation(account, peer)
+	id := uuid.New()
+	if err := store.Append(history.Entry{Conversation: conv, ID: id, Origin: uuid.New(), Author: account, Frame: []byte("msg")}); err != nil {
+		t.Fatal(err)
+	}
+	// Reconnected device has new connection id, but the same account
+	if _, err := store.Edit(conv, id, uuid.New(), []byte("hijack"), time.Now()); !errors.Is(err, history.ErrorNotOwner) {
+		t.Errorf("edit by other connection: got %v", err)
+	}
+	if _, err := store.Delete(conv, id, account, time.Now()); err != nil {
+		t.Errorf("author can not delete after reconnect: %v", err)
+	}
+}
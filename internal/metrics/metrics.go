@@ -0,0 +1,261 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry of metrics, serves them in prometheus text exposition format
+type Registry interface {
+	http.Handler
+
+	Counter(name, help string, labels ...string) Counter
+	Histogram(name, help string, buckets []float64, labels ...string) Histogram
+	// Value is taken at scrape time
+	CounterFunc(name, help string, f func() float64)
+	GaugeFunc(name, help string, f func() float64)
+
+	Write(w io.Writer) error
+}
+
+// Monotonic counter, label values must match label names given at registration
+type Counter interface {
+	Inc(labelValues ...string)
+	Add(v float64, labelValues ...string)
+}
+
+type Histogram interface {
+	Observe(v float64, labelValues ...string)
+}
+
+// Default buckets for latencies in seconds
+var LatencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+type metric interface {
+	write(w io.Writer) error
+}
+
+type registryImpl struct {
+	metrics []metric
+	names   map[string]struct{}
+	mutex   sync.Mutex
+}
+
+func NewRegistry() Registry {
+	return &registryImpl{
+		names: make(map[string]struct{}),
+	}
+}
+
+func (r *registryImpl) register(name string, m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ex := r.names[name]; ex {
+		panic(fmt.Sprintf("metric %s is already registered", name))
+	}
+	r.names[name] = struct{}{}
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *registryImpl) Counter(name, help string, labels ...string) Counter {
+	c := &counterImpl{
+		header: header(name, help, "counter"),
+		name:   name,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+	r.register(name, c)
+	return c
+}
+
+func (r *registryImpl) Histogram(name, help string, buckets []float64, labels ...string) Histogram {
+	h := &histogramImpl{
+		header:  header(name, help, "histogram"),
+		name:    name,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	r.register(name, h)
+	return h
+}
+
+func (r *registryImpl) CounterFunc(name, help string, f func() float64) {
+	r.register(name, &funcImpl{header: header(name, help, "counter"), name: name, f: f})
+}
+
+func (r *registryImpl) GaugeFunc(name, help string, f func() float64) {
+	r.register(name, &funcImpl{header: header(name, help, "gauge"), name: name, f: f})
+}
+
+func (r *registryImpl) Write(w io.Writer) error {
+	r.mutex.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mutex.Unlock()
+
+	for _, m := range metrics {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *registryImpl) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
+
+func header(name, help, kind string) string {
+	return fmt.Sprintf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// labelString formats label pairs, values are escaped
+func labelString(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, n := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		v = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(v)
+		pairs[i] = fmt.Sprintf(`%s="%s"`, n, v)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type funcImpl struct {
+	header string
+	name   string
+	f      func() float64
+}
+
+func (m *funcImpl) write(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "%s%s %s\n", m.header, m.name, formatFloat(m.f()))
+	return err
+}
+
+type counterImpl struct {
+	header string
+	name   string
+	labels []string
+	values map[string]float64
+	mutex  sync.Mutex
+}
+
+func (c *counterImpl) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *counterImpl) Add(v float64, labelValues ...string) {
+	key := labelString(c.labels, labelValues)
+	c.mutex.Lock()
+	c.values[key] += v
+	c.mutex.Unlock()
+}
+
+func (c *counterImpl) write(w io.Writer) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, err := io.WriteString(w, c.header); err != nil {
+		return err
+	}
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		_, err := fmt.Fprintf(w, "%s 0\n", c.name)
+		return err
+	}
+	for _, key := range sortedKeys(c.values) {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatFloat(c.values[key])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+type histogramImpl struct {
+	header  string
+	name    string
+	labels  []string
+	buckets []float64
+	series  map[string]*histogramSeries
+	mutex   sync.Mutex
+}
+
+func (h *histogramImpl) Observe(v float64, labelValues ...string) {
+	key := labelString(h.labels, labelValues)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	s, ex := h.series[key]
+	if !ex {
+		s = &histogramSeries{
+			labelValues: labelValues,
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.series[key] = s
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramImpl) write(w io.Writer) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, err := io.WriteString(w, h.header); err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		names := append(append([]string(nil), h.labels...), "le")
+		for i, b := range h.buckets {
+			values := append(append([]string(nil), s.labelValues...), formatFloat(b))
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(names, values), s.counts[i]); err != nil {
+				return err
+			}
+		}
+		values := append(append([]string(nil), s.labelValues...), "+Inf")
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(names, values), s.count); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", h.name, key, formatFloat(s.sum), h.name, key, s.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
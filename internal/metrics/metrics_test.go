@@ -0,0 +1,41 @@
+package metrics_test
+
+import (
+	"bytes"
+	"novachat-server/internal/metrics"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	r := metrics.NewRegistry()
+	frames := r.Counter("nova_frames_total", "Frames routed", "type")
+	latency := r.Histogram("nova_latency_seconds", "Latency", []float64{0.1, 1})
+	r.GaugeFunc("nova_clients", "Connected clients", func() float64 { return 3 })
+
+	frames.Inc("api")
+	frames.Add(2, "unicast")
+	latency.Observe(0.5)
+
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Error(err)
+		return
+	}
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE nova_frames_total counter",
+		`nova_frames_total{type="api"} 1`,
+		`nova_frames_total{type="unicast"} 2`,
+		`nova_latency_seconds_bucket{le="0.1"} 0`,
+		`nova_latency_seconds_bucket{le="1"} 1`,
+		`nova_latency_seconds_bucket{le="+Inf"} 1`,
+		"nova_latency_seconds_count 1",
+		"# TYPE nova_clients gauge",
+		"nova_clients 3",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing line %q in:\n%s", line, out)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package moderation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"novachat-server/common/atomicfile"
+	"novachat-server/novaprotocol/serverapi"
+	"os"
+	"sync"
+	"time"
+)
+
+// Persistent list of bans, expired bans are ignored and dropped on next save
+type BanList interface {
+	Ban(ban serverapi.Ban) error
+	Unban(kind, value string) error
+	// Returns active ban for value of given kind
+	IsBanned(kind, value string) (*serverapi.Ban, bool)
+	List() []serverapi.Ban
+}
+
+type banKey struct {
+	kind  string
+	value string
+}
+
+type banListImpl struct {
+	path  string
+	bans  map[banKey]serverapi.Ban
+	mutex sync.RWMutex
+}
+
+// Loads bans from json file, file is created on first ban. Empty path keeps bans in memory only
+func NewBanList(path string) (BanList, error) {
+	bl := &banListImpl{
+		path: path,
+		bans: make(map[banKey]serverapi.Ban),
+	}
+	if path == "" {
+		return bl, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return bl, nil
+		}
+		return nil, fmt.Errorf("failed to read bans: %w", err)
+	}
+	var bans []serverapi.Ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return nil, fmt.Errorf("failed to parse bans: %w", err)
+	}
+	for _, ban := range bans {
+		bl.bans[banKey{ban.Kind, ban.Value}] = ban
+	}
+	return bl, nil
+}
+
+func expired(ban serverapi.Ban, now time.Time) bool {
+	return !ban.ExpiresAt.IsZero() && ban.ExpiresAt.Before(now)
+}
+
+func (bl *banListImpl) Ban(ban serverapi.Ban) error {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+	bl.bans[banKey{ban.Kind, ban.Value}] = ban
+	return bl.save()
+}
+
+func (bl *banListImpl) Unban(kind, value string) error {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+	delete(bl.bans, banKey{kind, value})
+	return bl.save()
+}
+
+func (bl *banListImpl) IsBanned(kind, value string) (*serverapi.Ban, bool) {
+	bl.mutex.RLock()
+	defer bl.mutex.RUnlock()
+	ban, ex := bl.bans[banKey{kind, value}]
+	if !ex || expired(ban, time.Now()) {
+		return nil, false
+	}
+	return &ban, true
+}
+
+func (bl *banListImpl) List() []serverapi.Ban {
+	bl.mutex.RLock()
+	defer bl.mutex.RUnlock()
+	now := time.Now()
+	bans := make([]serverapi.Ban, 0, len(bl.bans))
+	for _, ban := range bl.bans {
+		if !expired(ban, now) {
+			bans = append(bans, ban)
+		}
+	}
+	return bans
+}
+
+// save writes active bans to temp file and renames it, so file is never half written.
+// Must be called under write lock
+func (bl *banListImpl) save() error {
+	if bl.path == "" {
+		return nil
+	}
+	now := time.Now()
+	bans := make([]serverapi.Ban, 0, len(bl.bans))
+	for key, ban := range bl.bans {
+		if expired(ban, now) {
+			delete(bl.bans, key)
+			continue
+		}
+		bans = append(bans, ban)
+	}
+
+	data, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.Write(bl.path, data); err != nil {
+		return fmt.Errorf("failed to save bans: %w", err)
+	}
+	return nil
+}
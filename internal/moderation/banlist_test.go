@@ -0,0 +1,90 @@
+package moderation_test
+
+import (
+	"encoding/json"
+	"novachat-server/internal/moderation"
+	"novachat-server/novaprotocol/serverapi"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBanList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	bans, err := moderation.NewBanList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bans.Ban(serverapi.Ban{Kind: serverapi.BanKindIP, Value: "10.0.0.1", Reason: "spam"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bans.Ban(serverapi.Ban{Kind: serverapi.BanKindIdentity, Value: "mallory", Reason: "abuse"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bans.Ban(serverapi.Ban{Kind: serverapi.BanKindIdentity, Value: "eve"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bans.Unban(serverapi.BanKindIdentity, "eve"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bans survive restart
+	bans, err = moderation.NewBanList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ban, ok := bans.IsBanned(serverapi.BanKindIP, "10.0.0.1"); !ok || ban.Reason != "spam" {
+		t.Errorf("address ban lost: %+v", ban)
+	}
+	if ban, ok := bans.IsBanned(serverapi.BanKindIdentity, "mallory"); !ok || ban.Reason != "abuse" {
+		t.Errorf("identity ban lost: %+v", ban)
+	}
+	if _, ok := bans.IsBanned(serverapi.BanKindIdentity, "eve"); ok {
+		t.Error("unbanned identity is still banned")
+	}
+	// Address and identity bans do not match each other
+	if _, ok := bans.IsBanned(serverapi.BanKindIdentity, "10.0.0.1"); ok {
+		t.Error("address ban matched identity")
+	}
+	if _, ok := bans.IsBanned(serverapi.BanKindIP, "mallory"); ok {
+		t.Error("identity ban matched address")
+	}
+	if len(bans.List()) != 2 {
+		t.Errorf("unexpected bans %+v", bans.List())
+	}
+}
+
+func TestBanExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	bans, err := moderation.NewBanList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := serverapi.Ban{Kind: serverapi.BanKindIP, Value: "10.0.0.1", ExpiresAt: time.Now().Add(-time.Minute)}
+	if err := bans.Ban(expired); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bans.IsBanned(serverapi.BanKindIP, "10.0.0.1"); ok {
+		t.Error("expired ban is active")
+	}
+	if len(bans.List()) != 0 {
+		t.Errorf("expired ban listed: %+v", bans.List())
+	}
+
+	// Expired bans are dropped from file on next save
+	if err := bans.Ban(serverapi.Ban{Kind: serverapi.BanKindIP, Value: "10.0.0.2", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved []serverapi.Ban
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].Value != "10.0.0.2" {
+		t.Errorf("expired ban not pruned: %+v", saved)
+	}
+}
@@ -0,0 +1,97 @@
+package nickname
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	MinLength = 2
+	MaxLength = 32
+)
+
+var (
+	ErrorTooShort        = errors.New("nickname is too short")
+	ErrorTooLong         = errors.New("nickname is too long")
+	ErrorInvalidEncoding = errors.New("nickname is not valid utf-8")
+	ErrorInvalidChar     = errors.New("nickname contains forbidden characters")
+)
+
+// Normalize validates raw nickname and returns its canonical (NFKC, trimmed, single spaced) form
+func Normalize(raw string) (string, error) {
+	if !utf8.ValidString(raw) {
+		return "", ErrorInvalidEncoding
+	}
+	// Do not normalize huge strings, nobody needs them
+	if len(raw) > MaxLength*utf8.UTFMax {
+		return "", ErrorTooLong
+	}
+
+	nick := strings.Join(strings.Fields(norm.NFKC.String(raw)), " ")
+	for _, r := range nick {
+		if !allowedRune(r) {
+			return "", ErrorInvalidChar
+		}
+	}
+
+	length := utf8.RuneCountInString(nick)
+	if length < MinLength {
+		return "", ErrorTooShort
+	}
+	if length > MaxLength {
+		return "", ErrorTooLong
+	}
+	return nick, nil
+}
+
+func allowedRune(r rune) bool {
+	switch r {
+	case ' ', '_', '-', '.':
+		return true
+	}
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+// Skeleton maps nickname to a form where visually confusable nicknames collide,
+// two nicknames are considered the same if their skeletons are equal
+func Skeleton(nick string) string {
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(nick) {
+		if unicode.IsMark(r) {
+			// Drop accents
+			continue
+		}
+		// Uppercase look-alikes (I and l) are checked before case folding
+		if c, ex := confusables[r]; ex {
+			r = c
+		}
+		r = unicode.ToLower(r)
+		if c, ex := confusables[r]; ex {
+			r = c
+		}
+		if r == ' ' || r == '_' || r == '-' || r == '.' {
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Most common latin look-alikes
+var confusables = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o',
+	'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'ѕ': 's', 'і': 'i', 'ј': 'j',
+	'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w', 'ь': 'b',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o',
+	'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x', 'ω': 'w', 'ζ': 'z',
+	// Digits
+	'0': 'o', '1': 'l', '3': 'e', '5': 's', '8': 'b',
+	// Latin
+	'I': 'l', 'ı': 'i',
+}
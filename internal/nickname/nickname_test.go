@@ -0,0 +1,42 @@
+package nickname_test
+
+import (
+	"novachat-server/internal/nickname"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	nick, err := nickname.Normalize("  John   Doe ")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if nick != "John Doe" {
+		t.Errorf("unexpected nickname: %q", nick)
+	}
+
+	for _, bad := range []string{"", "a", "bad\x00name", "tab\tname​", string(make([]byte, 200))} {
+		if _, err := nickname.Normalize(bad); err == nil {
+			t.Errorf("nickname %q should be rejected", bad)
+		}
+	}
+}
+
+func TestSkeleton(t *testing.T) {
+	// Cyrillic "а" and "о", digit zero, capital I
+	pairs := [][2]string{
+		{"admin", "аdmin"},
+		{"bob", "b0b"},
+		{"Bill", "BiII"},
+		{"Jose", "José"},
+		{"john_doe", "John Doe"},
+	}
+	for _, p := range pairs {
+		if nickname.Skeleton(p[0]) != nickname.Skeleton(p[1]) {
+			t.Errorf("%q and %q should be confusable", p[0], p[1])
+		}
+	}
+	if nickname.Skeleton("alice") == nickname.Skeleton("alicia") {
+		t.Errorf("different nicknames should not collide")
+	}
+}
@@ -0,0 +1,63 @@
+package plugin
+
+import (
+	"novachat-server/novaprotocol/serverapi"
+
+	"github.com/google/uuid"
+)
+
+// Plugin is server side automation, hooks are called synchronously from connection goroutines
+// so they must return quickly
+type Plugin interface {
+	Name() string
+	// Init is called once on registration
+	Init(host Host) error
+
+	// Client finished handshake
+	OnConnect(client serverapi.Client)
+	OnDisconnect(client serverapi.Client)
+	// OnServerMessage sees json messages sent to server except admin, credential and rekey ones,
+	// returning true consumes it so built-in handling is skipped
+	OnServerMessage(client serverapi.Client, msgType string, data []byte) bool
+	// OnRelay sees every frame sent by client to peer or room, returning false drops it.
+	// Payload is usually end-to-end encrypted
+	OnRelay(client serverapi.Client, destination uuid.UUID, l1Frame []byte) bool
+}
+
+// Host is server as seen by plugins
+type Host interface {
+	// Clients of the whole cluster, bots included
+	ListClients() []serverapi.Client
+	// SendJson sends server message to client or room
+	SendJson(destination uuid.UUID, jsonMsg []byte) error
+}
+
+// Bot is plugin that appears to clients as virtual client
+type Bot interface {
+	Plugin
+	Nickname() string
+	// Attach is called after Init with the virtual client of bot
+	Attach(self BotClient)
+	// OnMessage receives frames addressed to bot or to rooms it joined
+	OnMessage(origin uuid.UUID, destination uuid.UUID, l1Frame []byte)
+}
+
+// BotClient is virtual client driven by bot
+type BotClient interface {
+	GetID() uuid.UUID
+	JoinRoom(name string) (serverapi.Room, error)
+	// Send delivers l1 frame from bot to client or room
+	Send(destination uuid.UUID, l1Frame []byte) error
+	// SendText sends MSG_BOT_TEXT json message from bot
+	SendText(destination uuid.UUID, text string) error
+}
+
+// Base implements every hook as no-op, plugins embed it and override what they need
+type Base struct{}
+
+func (Base) Init(Host) error                                       { return nil }
+func (Base) OnConnect(serverapi.Client)                            {}
+func (Base) OnDisconnect(serverapi.Client)                         {}
+func (Base) OnServerMessage(serverapi.Client, string, []byte) bool { return false }
+func (Base) OnRelay(serverapi.Client, uuid.UUID, []byte) bool      { return true }
+func (Base) OnMessage(uuid.UUID, uuid.UUID, []byte)                {}
@@ -0,0 +1,63 @@
+package plugin
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Reminder is bot posting the same text to a room periodically, e.g. standup reminder
+type Reminder struct {
+	Base
+	ctx      context.Context
+	nickname string
+	room     string
+	text     string
+	interval time.Duration
+	logger   *slog.Logger
+}
+
+// NewReminder creates reminder bot, it stops when ctx is cancelled
+func NewReminder(ctx context.Context, nickname string, room string, text string, interval time.Duration, logger *slog.Logger) *Reminder {
+	return &Reminder{
+		ctx:      ctx,
+		nickname: nickname,
+		room:     room,
+		text:     text,
+		interval: interval,
+		logger:   logger,
+	}
+}
+
+func (r *Reminder) Name() string {
+	return "reminder"
+}
+
+func (r *Reminder) Nickname() string {
+	return r.nickname
+}
+
+func (r *Reminder) Attach(self BotClient) {
+	go r.run(self)
+}
+
+func (r *Reminder) run(self BotClient) {
+	room, err := self.JoinRoom(r.room)
+	if err != nil {
+		r.logger.Error("reminder failed to join room", slog.String("room", r.room), slog.Any("error", err))
+		return
+	}
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := self.SendText(room.ID, r.text); err != nil {
+				r.logger.Warn("reminder failed to send", slog.String("room", r.room), slog.Any("error", err))
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package plugin_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"novachat-server/internal/plugin"
+	"novachat-server/novaprotocol/serverapi"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type fakeBotClient struct {
+	room  serverapi.Room
+	texts chan string
+}
+
+func (c *fakeBotClient) GetID() uuid.UUID {
+	return uuid.Nil
+}
+func (c *fakeBotClient) JoinRoom(name string) (serverapi.Room, error) {
+	c.room = serverapi.Room{ID: uuid.New(), Name: name}
+	return c.room, nil
+}
+func (c *fakeBotClient) Send(uuid.UUID, []byte) error {
+	return nil
+}
+func (c *fakeBotClient) SendText(destination uuid.UUID, text string) error {
+	if destination != c.room.ID {
+		return nil
+	}
+	c.texts <- text
+	return nil
+}
+
+func TestReminder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	var bot plugin.Bot = plugin.NewReminder(ctx, "Reminder", "standup", "Standup in 5 minutes", 10*time.Millisecond, logger)
+	self := &fakeBotClient{texts: make(chan string, 4)}
+	bot.Attach(self)
+
+	for range 2 {
+		select {
+		case text := <-self.texts:
+			if text != "Standup in 5 minutes" {
+				t.Errorf("unexpected text %q", text)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("reminder was not sent")
+		}
+	}
+	if self.room.Name != "standup" {
+		t.Errorf("unexpected room %q", self.room.Name)
+	}
+}
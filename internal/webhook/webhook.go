@@ -0,0 +1,322 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Event types
+const (
+	EventClientConnected    = "client.connected"
+	EventClientDisconnected = "client.disconnected"
+	EventRoomJoined         = "room.joined"
+	EventRoomLeft           = "room.left"
+	EventRoomMessage        = "room.message"
+)
+
+var errorClosed = errors.New("dispatcher closed")
+
+// Request headers, signature is hex encoded HMAC-SHA256 of request body keyed with target secret
+const (
+	HeaderEvent     = "X-Nova-Event"
+	HeaderDelivery  = "X-Nova-Delivery"
+	HeaderSignature = "X-Nova-Signature"
+)
+
+// Target is endpoint receiving events
+type Target struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+	// Event types or prefixes like "room.*", empty list receives every event
+	Events []string `json:"events"`
+}
+
+// Accepts reports whether target is subscribed to event type
+func (t Target) Accepts(eventType string) bool {
+	if len(t.Events) == 0 {
+		return true
+	}
+	for _, filter := range t.Events {
+		if filter == eventType || filter == "*" {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(filter, "*"); ok && strings.HasPrefix(eventType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is json payload posted to targets
+type Event struct {
+	ID   uuid.UUID `json:"id"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Node string    `json:"node,omitempty"`
+	Data any       `json:"data"`
+}
+
+// RoomMessage is data of EventRoomMessage, content is end-to-end encrypted so only its size is known
+type RoomMessage struct {
+	Room   uuid.UUID `json:"room"`
+	Origin uuid.UUID `json:"origin"`
+	Size   int       `json:"size"`
+}
+
+// Sign returns signature of payload
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks signature header value, for receivers written in go
+func Verify(secret string, payload []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, payload)), []byte(signature))
+}
+
+// Loads targets from json file, empty path means no targets
+func LoadTargets(path string) ([]Target, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhooks: %w", err)
+	}
+	var targets []Target
+	if err := json.Unmarshal(data, &targets); err != nil {
+		return nil, fmt.Errorf("failed to parse webhooks: %w", err)
+	}
+	for _, t := range targets {
+		if t.URL == "" {
+			return nil, fmt.Errorf("webhook without url")
+		}
+	}
+	return targets, nil
+}
+
+type Options struct {
+	// Node is reported in every event
+	Node string
+	// Delivery attempts before event goes to dead letter log
+	Attempts int
+	// Delay before second attempt, doubled on every retry up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Timeout of single request
+	Timeout time.Duration
+	// Events waiting per target, events over it go to dead letter log
+	QueueSize int
+	// Json lines of undelivered events, may be nil
+	DeadLetter io.Writer
+}
+
+// DeadLetter is line of dead letter log
+type DeadLetter struct {
+	Target string    `json:"target"`
+	Event  Event     `json:"event"`
+	Error  string    `json:"error"`
+	Time   time.Time `json:"time"`
+}
+
+// Dispatcher delivers events to targets in background, every target has its own queue
+// so slow endpoint does not delay others
+type Dispatcher interface {
+	Emit(eventType string, data any)
+	// Events that went to dead letter log
+	Failed() uint64
+	// Close stops delivery, queued events and events being retried go to dead letter log
+	Close()
+}
+
+type dispatcherImpl struct {
+	opts    Options
+	client  *http.Client
+	logger  *slog.Logger
+	workers []*worker
+	failed  atomic.Uint64
+
+	deadMutex sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+type worker struct {
+	target Target
+	queue  chan Event
+}
+
+func NewDispatcher(targets []Target, opts Options, logger *slog.Logger) Dispatcher {
+	if opts.Attempts <= 0 {
+		opts.Attempts = 1
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 1
+	}
+	if opts.MaxBackoff < opts.Backoff {
+		opts.MaxBackoff = opts.Backoff
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &dispatcherImpl{
+		opts:   opts,
+		client: &http.Client{Timeout: opts.Timeout},
+		logger: logger,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	for _, target := range targets {
+		w := &worker{target: target, queue: make(chan Event, opts.QueueSize)}
+		d.workers = append(d.workers, w)
+		d.wg.Add(1)
+		go d.run(w)
+	}
+	return d
+}
+
+func (d *dispatcherImpl) Emit(eventType string, data any) {
+	if len(d.workers) == 0 {
+		return
+	}
+	event := Event{ID: uuid.New(), Type: eventType, Time: time.Now().UTC(), Node: d.opts.Node, Data: data}
+	for _, w := range d.workers {
+		if !w.target.Accepts(eventType) {
+			continue
+		}
+		if d.ctx.Err() != nil {
+			d.deadLetter(w.target, event, errorClosed)
+			continue
+		}
+		select {
+		case w.queue <- event:
+		default:
+			d.deadLetter(w.target, event, fmt.Errorf("queue is full"))
+		}
+	}
+}
+
+func (d *dispatcherImpl) Failed() uint64 {
+	return d.failed.Load()
+}
+
+func (d *dispatcherImpl) Close() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+func (d *dispatcherImpl) run(w *worker) {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-d.ctx.Done():
+			d.drain(w)
+			return
+		case event := <-w.queue:
+			if err := d.deliver(w.target, event); err != nil {
+				if errors.Is(err, context.Canceled) {
+					err = errorClosed
+				}
+				d.deadLetter(w.target, event, err)
+			}
+		}
+	}
+}
+
+// drain moves events left in queue of closed dispatcher to dead letter log
+func (d *dispatcherImpl) drain(w *worker) {
+	for {
+		select {
+		case event := <-w.queue:
+			d.deadLetter(w.target, event, errorClosed)
+		default:
+			return
+		}
+	}
+}
+
+// deliver posts event retrying with exponential backoff
+func (d *dispatcherImpl) deliver(target Target, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	backoff := d.opts.Backoff
+	for attempt := 1; ; attempt++ {
+		err = d.post(target, event, payload)
+		if err == nil {
+			return nil
+		}
+		if attempt >= d.opts.Attempts {
+			return fmt.Errorf("%d attempts failed, last: %w", attempt, err)
+		}
+		d.logger.Debug("webhook delivery failed, retrying", slog.String("target", target.URL), slog.Int("attempt", attempt), slog.Any("error", err))
+
+		select {
+		case <-d.ctx.Done():
+			return d.ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, d.opts.MaxBackoff)
+	}
+}
+
+func (d *dispatcherImpl) post(target Target, event Event, payload []byte) error {
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, target.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, event.Type)
+	req.Header.Set(HeaderDelivery, event.ID.String())
+	if target.Secret != "" {
+		req.Header.Set(HeaderSignature, Sign(target.Secret, payload))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (d *dispatcherImpl) deadLetter(target Target, event Event, reason error) {
+	defer d.failed.Add(1)
+	d.logger.Warn("webhook event undelivered", slog.String("target", target.URL), slog.String("event", event.Type), slog.Any("error", reason))
+	if d.opts.DeadLetter == nil {
+		return
+	}
+
+	line, err := json.Marshal(DeadLetter{Target: target.URL, Event: event, Error: reason.Error(), Time: time.Now().UTC()})
+	if err != nil {
+		d.logger.Error("failed to encode dead letter", slog.Any("error", err))
+		return
+	}
+	d.deadMutex.Lock()
+	defer d.deadMutex.Unlock()
+	if _, err := d.opts.DeadLetter.Write(append(line, '\n')); err != nil {
+		d.logger.Error("failed to write dead letter", slog.Any("error", err))
+	}
+}
@@ -0,0 +1,161 @@
+package webhook_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"novachat-server/internal/webhook"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTargetFilter(t *testing.T) {
+	target := webhook.Target{Events: []string{webhook.EventClientConnected, "room.*"}}
+	for eventType, want := range map[string]bool{
+		webhook.EventClientConnected:    true,
+		webhook.EventClientDisconnected: false,
+		webhook.EventRoomJoined:         true,
+		webhook.EventRoomMessage:        true,
+	} {
+		if got := target.Accepts(eventType); got != want {
+			t.Errorf("Accepts(%s) = %v, want %v", eventType, got, want)
+		}
+	}
+	if !(webhook.Target{}).Accepts(webhook.EventRoomLeft) {
+		t.Error("target without filter must accept every event")
+	}
+}
+
+func TestDeliveryWithRetry(t *testing.T) {
+	var calls atomic.Int32
+	received := make(chan webhook.Event, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// First attempt fails
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if !webhook.Verify("secret", body, r.Header.Get(webhook.HeaderSignature)) {
+			t.Error("bad signature")
+		}
+		if r.Header.Get(webhook.HeaderEvent) != webhook.EventRoomJoined {
+			t.Errorf("unexpected event header %q", r.Header.Get(webhook.HeaderEvent))
+		}
+		var event webhook.Event
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Error(err)
+		}
+		received <- event
+	}))
+	defer server.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	d := webhook.NewDispatcher([]webhook.Target{{URL: server.URL, Secret: "secret", Events: []string{"room.*"}}},
+		webhook.Options{Node: "node-a", Attempts: 3, Backoff: 10 * time.Millisecond, QueueSize: 4}, logger)
+	defer d.Close()
+
+	d.Emit(webhook.EventClientConnected, "filtered out")
+	d.Emit(webhook.EventRoomJoined, map[string]string{"room": "general"})
+	select {
+	case event := <-received:
+		if event.Type != webhook.EventRoomJoined || event.Node != "node-a" {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not delivered")
+	}
+	if calls.Load() != 2 {
+		t.Errorf("expected 2 calls, got %d", calls.Load())
+	}
+}
+
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func TestDeadLetter(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	dead := &syncBuffer{}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	d := webhook.NewDispatcher([]webhook.Target{{URL: server.URL}},
+		webhook.Options{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond, QueueSize: 4, DeadLetter: dead}, logger)
+	defer d.Close()
+
+	d.Emit(webhook.EventRoomLeft, nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for d.Failed() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("event did not reach dead letter log")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("expected 3 attempts, got %d", calls.Load())
+	}
+
+	var letter webhook.DeadLetter
+	if err := json.Unmarshal([]byte(strings.TrimSpace(dead.String())), &letter); err != nil {
+		t.Fatal(err)
+	}
+	if letter.Target != server.URL || letter.Event.Type != webhook.EventRoomLeft || letter.Error == "" {
+		t.Errorf("unexpected dead letter %+v", letter)
+	}
+}
+
+func TestCloseDeadLettersPending(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	dead := &syncBuffer{}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	d := webhook.NewDispatcher([]webhook.Target{{URL: server.URL}},
+		webhook.Options{Attempts: 3, Backoff: time.Second, QueueSize: 4, DeadLetter: dead}, logger)
+	for range 3 {
+		d.Emit(webhook.EventRoomJoined, nil)
+	}
+	<-started
+	// One event is in flight and two are queued
+	d.Close()
+	d.Emit(webhook.EventRoomLeft, nil)
+	if d.Failed() != 4 {
+		t.Errorf("expected every pending event in dead letter log, got %d", d.Failed())
+	}
+	if lines := strings.Count(dead.String(), "\n"); lines != 4 {
+		t.Errorf("expected 4 dead letters, got %d", lines)
+	}
+}
@@ -0,0 +1,297 @@
+package novaclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"novachat-server/novaprotocol"
+	"novachat-server/novaprotocol/handshake"
+	"novachat-server/novaprotocol/serverapi"
+	"os"
+	"sync"
+
+	"github.com/google/uuid"
+	"golang.org/x/net/websocket"
+)
+
+type Config struct {
+	// ws:// or wss:// url of server websocket endpoint,
+	// tcp:// or tls:// for raw transport
+	URL string
+	// Defaults to http(s) url of the same host
+	Origin string
+	// Trusted roots for wss and tls, nil means system pool
+	RootCAs *x509.CertPool
+
+	// Required only by servers configured with join token
+	JoinToken string
+
+	Nickname string
+	// Defaults to every capability known to this package
+	Capabilities []string
+}
+
+// Connection to nova server, established after handshake
+type Client interface {
+	GetID() uuid.UUID
+	GetNickname() string
+	// Capabilities supported by both client and server
+	GetCapabilities() []string
+
+	// Frames from server and peers, closed when connection is lost
+	Frames() <-chan *novaprotocol.NovaFrameL0
+	// Reason of connection loss, valid after Frames is closed
+	Err() error
+
+	// Sends json message to server
+	SendServer(jsonMsg []byte) error
+	// Sends l1 frame to another client
+	SendPeer(peer uuid.UUID, l1Frame []byte) error
+	// Sends l1 frames sealed for devices of account, keyed by device connection id
+	SendAccount(account uuid.UUID, l1Frames map[uuid.UUID][]byte) error
+
+	Close() error
+}
+
+var defaultCapabilities = []string{
+	handshake.CapPresence,
+	handshake.CapNicknameChange,
+	handshake.CapPing,
+	handshake.CapRooms,
+	handshake.CapHistory,
+	handshake.CapAccounts,
+	handshake.CapRekey,
+	handshake.CapWelcomeAck,
+}
+
+// LoadCertPool returns system roots extended with certificates from PEM file,
+// used to trust self-hosted servers
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ca file: %w", err)
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// Dial connects to server and performs handshake
+func Dial(ctx context.Context, cfg Config) (Client, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %w", err)
+	}
+	switch u.Scheme {
+	case "tcp", "tls":
+		return dialRaw(ctx, u, cfg)
+	}
+
+	origin := cfg.Origin
+	if origin == "" {
+		switch u.Scheme {
+		case "ws":
+			origin = "http://" + u.Host
+		case "wss":
+			origin = "https://" + u.Host
+		default:
+			return nil, fmt.Errorf("unsupported url scheme: %s", u.Scheme)
+		}
+	}
+
+	wsConfig, err := websocket.NewConfig(cfg.URL, origin)
+	if err != nil {
+		return nil, fmt.Errorf("invalid websocket config: %w", err)
+	}
+	if u.Scheme == "wss" {
+		wsConfig.TlsConfig = &tls.Config{
+			RootCAs:    cfg.RootCAs,
+			ServerName: u.Hostname(),
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+	conn, err := wsConfig.DialContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial: %w", err)
+	}
+
+	c, err := NewClient(conn, cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// dialRaw connects to raw tcp transport, optionally wrapped in tls
+func dialRaw(ctx context.Context, u *url.URL, cfg Config) (Client, error) {
+	var conn net.Conn
+	var err error
+	if u.Scheme == "tls" {
+		dialer := &tls.Dialer{Config: &tls.Config{
+			RootCAs:    cfg.RootCAs,
+			ServerName: u.Hostname(),
+			MinVersion: tls.VersionTLS12,
+		}}
+		conn, err = dialer.DialContext(ctx, "tcp", u.Host)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", u.Host)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial: %w", err)
+	}
+
+	c, err := NewClient(conn, cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+type clientImpl struct {
+	conn io.ReadWriteCloser
+
+	id           uuid.UUID
+	nickname     string
+	capabilities []string
+
+	keys novaprotocol.TransportKeys
+
+	writeMutex sync.Mutex
+	frames     chan *novaprotocol.NovaFrameL0
+	err        error
+	closeOnce  sync.Once
+}
+
+// NewClient performs handshake over already established connection
+func NewClient(conn io.ReadWriteCloser, cfg Config) (Client, error) {
+	if cfg.Capabilities == nil {
+		cfg.Capabilities = defaultCapabilities
+	}
+	c := &clientImpl{
+		conn:   conn,
+		frames: make(chan *novaprotocol.NovaFrameL0, 64),
+	}
+	if err := c.handshake(cfg); err != nil {
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *clientImpl) GetID() uuid.UUID {
+	return c.id
+}
+func (c *clientImpl) GetNickname() string {
+	return c.nickname
+}
+func (c *clientImpl) GetCapabilities() []string {
+	return c.capabilities
+}
+
+func (c *clientImpl) Frames() <-chan *novaprotocol.NovaFrameL0 {
+	return c.frames
+}
+func (c *clientImpl) Err() error {
+	return c.err
+}
+
+func (c *clientImpl) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// send writes l0 frame, transport is always encrypted after handshake
+func (c *clientImpl) send(destination uuid.UUID, l1Frame []byte) error {
+	frame := novaprotocol.NewL0Frame(novaprotocol.L0FlagIsEncrypted, destination, l1Frame)
+	frame.SetOrigin(c.id)
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return frame.Write(c.conn, c.keys.Encrypt)
+}
+
+func (c *clientImpl) SendServer(jsonMsg []byte) error {
+	l1, err := novaprotocol.NewL1Frame(novaprotocol.L1FlagIsJson, jsonMsg).Build(nil)
+	if err != nil {
+		return err
+	}
+	return c.send(uuid.Nil, l1)
+}
+
+func (c *clientImpl) SendPeer(peer uuid.UUID, l1Frame []byte) error {
+	return c.send(peer, l1Frame)
+}
+
+func (c *clientImpl) SendAccount(account uuid.UUID, l1Frames map[uuid.UUID][]byte) error {
+	data, err := json.Marshal(&serverapi.AccountFrames{Frames: l1Frames})
+	if err != nil {
+		return err
+	}
+	return c.send(account, data)
+}
+
+// readLoop delivers frames until connection is lost, heartbeat pings are answered here
+func (c *clientImpl) readLoop() {
+	defer close(c.frames)
+	for {
+		frame, err := novaprotocol.ReadL0Frame(c.conn, c.keys.Decrypt)
+		if err != nil {
+			c.err = err
+			return
+		}
+		if frame.GetOrigin() == uuid.Nil {
+			handled, err := c.handleServerFrame(frame)
+			if err != nil {
+				c.err = err
+				return
+			}
+			if handled {
+				continue
+			}
+		}
+		c.frames <- frame
+	}
+}
+
+// handleServerFrame answers pings and rekeys, returns false for frames that must be delivered to user
+func (c *clientImpl) handleServerFrame(frame *novaprotocol.NovaFrameL0) (bool, error) {
+	l1, err := novaprotocol.ParseL1Frame(frame.GetData(), nil)
+	if err != nil || l1.GetFlags()&novaprotocol.L1FlagIsJson == 0 {
+		return false, nil
+	}
+	msgType, err := novaprotocol.ParseJsonMessageType(l1.GetData())
+	if err != nil {
+		return false, nil
+	}
+	if msgType == novaprotocol.MSG_REKEY {
+		return true, c.rekey(l1.GetData())
+	}
+	if msgType != novaprotocol.MSG_PING {
+		return false, nil
+	}
+	ping, err := novaprotocol.ParseJsonMessage[serverapi.Ping](l1.GetData())
+	if err != nil || ping == nil {
+		return true, nil
+	}
+	msg, err := novaprotocol.NewJsonMessage(novaprotocol.MSG_PONG, ping)
+	if err != nil {
+		return true, err
+	}
+	return true, c.SendServer(msg)
+}
@@ -0,0 +1,37 @@
+package novaclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"novachat-server/novaprotocol/serverapi"
+	"os"
+)
+
+// LoadCredentials reads device credentials saved by SaveCredentials, nil without error if file does not exist
+func LoadCredentials(path string) (*serverapi.DeviceCredentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read credentials: %w", err)
+	}
+	var creds serverapi.DeviceCredentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials: %w", err)
+	}
+	return &creds, nil
+}
+
+// SaveCredentials stores device credentials readable by owner only, token signs in as the device
+func SaveCredentials(path string, creds *serverapi.DeviceCredentials) error {
+	data, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return fmt.Errorf("failed to save credentials: %w", err)
+	}
+	return nil
+}
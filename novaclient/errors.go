@@ -0,0 +1,25 @@
+package novaclient
+
+import (
+	"fmt"
+	"novachat-server/novaprotocol/serverapi"
+)
+
+// ServerError is returned when server rejects a request
+type ServerError struct {
+	Request string
+	Code    string
+	Message string
+}
+
+func newServerError(e *serverapi.Error) *ServerError {
+	return &ServerError{
+		Request: e.Request,
+		Code:    e.Code,
+		Message: e.Message,
+	}
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server rejected %s: %s (%s)", e.Request, e.Message, e.Code)
+}
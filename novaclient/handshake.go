@@ -0,0 +1,222 @@
+package novaclient
+
+import (
+	"fmt"
+	"math/big"
+	"novachat-server/novaprotocol"
+	"novachat-server/novaprotocol/handshake"
+	"novachat-server/novaprotocol/serverapi"
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+// readJson reads frame and returns its json message type and body
+func (c *clientImpl) readJson() (string, []byte, error) {
+	l0, err := novaprotocol.ReadL0Frame(c.conn, c.keys.Decrypt)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read l0 frame: %w", err)
+	}
+	l1, err := novaprotocol.ParseL1Frame(l0.GetData(), nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read l1 frame: %w", err)
+	}
+	if l1.GetFlags()&novaprotocol.L1FlagIsJson == 0 {
+		return "", nil, fmt.Errorf("invalid data type")
+	}
+	msgType, err := novaprotocol.ParseJsonMessageType(l1.GetData())
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to parse message type: %w", err)
+	}
+	return msgType, l1.GetData(), nil
+}
+
+// serverError converts MSG_ERROR body to error
+func serverError(data []byte) error {
+	e, err := novaprotocol.ParseJsonMessage[serverapi.Error](data)
+	if err != nil || e == nil {
+		return fmt.Errorf("malformed server error")
+	}
+	return newServerError(e)
+}
+
+// handshake performs join, key exchange and welcome, mirrors server side.
+// Rejections are returned as *ServerError
+func (c *clientImpl) handshake(cfg Config) error {
+	msgType, data, err := c.readJson()
+	if err != nil {
+		return err
+	}
+	if msgType == novaprotocol.MSG_JOIN_REQUEST {
+		if err := c.join(cfg.JoinToken); err != nil {
+			return err
+		}
+		msgType, data, err = c.readJson()
+		if err != nil {
+			return err
+		}
+	}
+	// Server repeats key exchange if it fails, so loop until welcome
+	for msgType == novaprotocol.MSG_DH_PUB {
+		if err := c.keyExchange(data); err != nil {
+			return err
+		}
+		msgType, data, err = c.readJson()
+		if err != nil {
+			return err
+		}
+	}
+	if msgType == novaprotocol.MSG_ERROR {
+		return serverError(data)
+	}
+	if msgType != novaprotocol.MSG_WELCOME_INVITE {
+		return fmt.Errorf("unexpected message type: expected %s, got %s", novaprotocol.MSG_WELCOME_INVITE, msgType)
+	}
+	invite, err := novaprotocol.ParseJsonMessage[handshake.WelcomeInviteServer2Client](data)
+	if err != nil || invite == nil {
+		return fmt.Errorf("failed to parse welcome invite: %w", err)
+	}
+	c.id = invite.UserID
+
+	accept, err := novaprotocol.NewJsonMessage(novaprotocol.MSG_WELCOME_ACCEPT, &handshake.WelcomeAcceptClient2Server{
+		Nickname:     cfg.Nickname,
+		Capabilities: cfg.Capabilities,
+	})
+	if err != nil {
+		return err
+	}
+	if err := c.SendServer(accept); err != nil {
+		return fmt.Errorf("failed to send welcome accept: %w", err)
+	}
+
+	c.capabilities = make([]string, 0)
+	for _, capability := range invite.Capabilities {
+		for _, own := range cfg.Capabilities {
+			if capability == own {
+				c.capabilities = append(c.capabilities, capability)
+			}
+		}
+	}
+	// Server without acknowledgement takes nickname as is or drops connection
+	c.nickname = cfg.Nickname
+	if !slices.Contains(c.capabilities, handshake.CapWelcomeAck) {
+		return nil
+	}
+
+	msgType, data, err = c.readJson()
+	if err != nil {
+		return err
+	}
+	switch msgType {
+	case novaprotocol.MSG_ERROR:
+		return serverError(data)
+	case novaprotocol.MSG_WELCOME_ACCEPT:
+		info, err := novaprotocol.ParseJsonMessage[serverapi.Client](data)
+		if err != nil || info == nil {
+			return fmt.Errorf("failed to parse welcome accept: %w", err)
+		}
+		c.nickname = info.Nickname
+	default:
+		return fmt.Errorf("unexpected message type: expected %s, got %s", novaprotocol.MSG_WELCOME_ACCEPT, msgType)
+	}
+	return nil
+}
+
+// join sends token requested by server, before key exchange so in clear
+func (c *clientImpl) join(token string) error {
+	msg, err := novaprotocol.NewJsonMessage(novaprotocol.MSG_JOIN, &handshake.JoinClient2Server{Token: token})
+	if err != nil {
+		return err
+	}
+	return c.sendPlain(msg)
+}
+
+// sendPlain writes unencrypted json message, used only before key exchange
+func (c *clientImpl) sendPlain(jsonMsg []byte) error {
+	l1, err := novaprotocol.NewL1Frame(novaprotocol.L1FlagIsJson, jsonMsg).Build(nil)
+	if err != nil {
+		return err
+	}
+	if err := novaprotocol.NewL0Frame(novaprotocol.L0FlagNone, uuid.Nil, l1).Write(c.conn, nil); err != nil {
+		return fmt.Errorf("failed to write l0 frame: %w", err)
+	}
+	return nil
+}
+
+// keyExchange answers server's public key and switches transport encryption on
+func (c *clientImpl) keyExchange(data []byte) error {
+	serverKey, err := novaprotocol.ParseJsonMessage[handshake.PublicKeyServer2Client](data)
+	if err != nil || serverKey == nil {
+		return fmt.Errorf("failed to parse public key message: %w", err)
+	}
+	g, okG := new(big.Int).SetString(serverKey.G, 62)
+	p, okP := new(big.Int).SetString(serverKey.P, 62)
+	serverPublic, okPub := new(big.Int).SetString(serverKey.Pub, 62)
+	if !okG || !okP || !okPub {
+		return fmt.Errorf("invalid server public key format")
+	}
+	// Server chosen generator could confine key to small subgroup
+	if p.Cmp(handshake.Prime2048) != 0 || g.Cmp(handshake.Generator2048) != 0 {
+		return fmt.Errorf("unsupported dh group")
+	}
+	if !handshake.ValidPublicKey(serverPublic) {
+		return fmt.Errorf("invalid server public key")
+	}
+
+	private, public, err := handshake.GenerateKeyPair(g, p)
+	if err != nil {
+		return fmt.Errorf("failed to generate key pair: %w", err)
+	}
+	sharedSecret := handshake.ComputeSharedKey(private, serverPublic)
+
+	msg, err := novaprotocol.NewJsonMessage(novaprotocol.MSG_DH_PUB, &handshake.PublicKeyClient2Server{
+		Pub:  public.Text(62),
+		Hash: handshake.ComputeKeyHash(serverKey.Challenge, sharedSecret),
+	})
+	if err != nil {
+		return err
+	}
+	if err := c.sendPlain(msg); err != nil {
+		return err
+	}
+
+	c.keys.SetKey(sharedSecret)
+	return nil
+}
+
+// rekey answers MSG_REKEY and switches transport key. Answer is the last frame sent with old key,
+// frames server sent before it got the answer are still decrypted with old one
+func (c *clientImpl) rekey(data []byte) error {
+	serverKey, err := novaprotocol.ParseJsonMessage[handshake.Rekey](data)
+	if err != nil || serverKey == nil {
+		return fmt.Errorf("failed to parse rekey: %w", err)
+	}
+	serverPublic, ok := new(big.Int).SetString(serverKey.Pub, 62)
+	if !ok || !handshake.ValidPublicKey(serverPublic) {
+		return fmt.Errorf("invalid rekey public key")
+	}
+	private, public, err := handshake.GenerateKeyPair(handshake.Generator2048, handshake.Prime2048)
+	if err != nil {
+		return fmt.Errorf("failed to generate key pair: %w", err)
+	}
+
+	msg, err := novaprotocol.NewJsonMessage(novaprotocol.MSG_REKEY, &handshake.Rekey{Pub: public.Text(62)})
+	if err != nil {
+		return err
+	}
+	l1, err := novaprotocol.NewL1Frame(novaprotocol.L1FlagIsJson, msg).Build(nil)
+	if err != nil {
+		return err
+	}
+	frame := novaprotocol.NewL0Frame(novaprotocol.L0FlagIsEncrypted, uuid.Nil, l1)
+	frame.SetOrigin(c.id)
+
+	// No frame may be sealed between the answer and the switch
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if err := frame.Write(c.conn, c.keys.Encrypt); err != nil {
+		return err
+	}
+	c.keys.SetKey(handshake.ComputeSharedKey(private, serverPublic))
+	return nil
+}
@@ -0,0 +1,35 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Export formats
+const (
+	FormatJson = "json"
+	FormatText = "text"
+)
+
+// Export writes messages as json array or as text lines
+func Export(w io.Writer, format string, messages []Message) error {
+	switch format {
+	case FormatJson:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if messages == nil {
+			messages = []Message{}
+		}
+		return enc.Encode(messages)
+	case FormatText:
+		for _, msg := range messages {
+			if _, err := fmt.Fprintf(w, "%s %s: %s\n", msg.SentAt.Local().Format(time.DateTime), msg.Author, msg.Text); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown export format %q", format)
+}
@@ -0,0 +1,265 @@
+package history
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"novachat-server/common/jsonlog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+// File is compacted once it holds compactRatio lines per message, small files are left alone
+const (
+	compactRatio    = 4
+	compactMinLines = 1024
+)
+
+// Message is decrypted chat message kept on client
+type Message struct {
+	ID uuid.UUID `json:"id"`
+	// Peer client or room of conversation, nil for messages we sent to everyone
+	Peer   uuid.UUID `json:"peer"`
+	Origin uuid.UUID `json:"origin"`
+	Author string    `json:"author"`
+	SentAt time.Time `json:"sent_at"`
+	Text   string    `json:"text"`
+	Edited bool      `json:"edited,omitempty"`
+}
+
+// Result is search hit, Score counts occurrences of query words
+type Result struct {
+	Message
+	Score int
+}
+
+// DB is local history with full-text index. Text is stored decrypted,
+// so file must be protected like any other private data
+type DB interface {
+	// Put adds message or replaces message with the same id
+	Put(msg Message) error
+	Delete(id uuid.UUID) error
+	Get(id uuid.UUID) (Message, bool)
+	// Search returns messages containing every word of query, best first
+	Search(query string, limit int) []Result
+	// Around returns up to n messages of the same conversation before and after message, oldest first
+	Around(id uuid.UUID, n int) []Message
+	Close() error
+}
+
+type record struct {
+	Message
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+type dbImpl struct {
+	mutex    sync.RWMutex
+	messages map[uuid.UUID]Message
+	// Word -> message id -> occurrences
+	index map[string]map[uuid.UUID]int
+	log   jsonlog.Log
+}
+
+// Tokenize splits text into lower case words, used both for indexing and for queries
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Open loads history from json lines file, every change is appended to it.
+// Empty path keeps history in memory only
+func Open(path string) (DB, error) {
+	db := &dbImpl{
+		messages: make(map[uuid.UUID]Message),
+		index:    make(map[string]map[uuid.UUID]int),
+	}
+	if path == "" {
+		return db, nil
+	}
+	log, err := jsonlog.Open(path, 1<<20, func(line int, data []byte) error {
+		var r record
+		if err := json.Unmarshal(data, &r); err != nil {
+			return fmt.Errorf("failed to parse history line %d: %w", line, err)
+		}
+		if r.Deleted {
+			db.remove(r.ID)
+		} else {
+			db.put(r.Message)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history: %w", err)
+	}
+	db.log = log
+	if err := db.compact(); err != nil {
+		log.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (db *dbImpl) compact() error {
+	err := db.log.Rewrite(func(write func(v any) error) error {
+		for _, msg := range db.messages {
+			if err := write(record{Message: msg}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to compact history: %w", err)
+	}
+	return nil
+}
+
+// save appends record to file, caller holds write lock
+func (db *dbImpl) save(r record) error {
+	if db.log == nil {
+		return nil
+	}
+	if err := db.log.Append(r); err != nil {
+		return fmt.Errorf("failed to save history: %w", err)
+	}
+	if lines := db.log.Lines(); lines > compactMinLines && lines > compactRatio*len(db.messages) {
+		return db.compact()
+	}
+	return nil
+}
+
+func (db *dbImpl) put(msg Message) {
+	db.remove(msg.ID)
+	db.messages[msg.ID] = msg
+	for _, word := range Tokenize(msg.Text) {
+		postings, ex := db.index[word]
+		if !ex {
+			postings = make(map[uuid.UUID]int)
+			db.index[word] = postings
+		}
+		postings[msg.ID]++
+	}
+}
+
+func (db *dbImpl) remove(id uuid.UUID) {
+	old, ex := db.messages[id]
+	if !ex {
+		return
+	}
+	delete(db.messages, id)
+	for _, word := range Tokenize(old.Text) {
+		postings := db.index[word]
+		delete(postings, id)
+		if len(postings) == 0 {
+			delete(db.index, word)
+		}
+	}
+}
+
+func (db *dbImpl) Put(msg Message) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.put(msg)
+	return db.save(record{Message: msg})
+}
+
+func (db *dbImpl) Delete(id uuid.UUID) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if _, ex := db.messages[id]; !ex {
+		return nil
+	}
+	db.remove(id)
+	return db.save(record{Message: Message{ID: id}, Deleted: true})
+}
+
+func (db *dbImpl) Get(id uuid.UUID) (Message, bool) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	msg, ex := db.messages[id]
+	return msg, ex
+}
+
+func (db *dbImpl) Search(query string, limit int) []Result {
+	words := Tokenize(query)
+	if len(words) == 0 {
+		return nil
+	}
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	// Start from the rarest word, so intersection stays small
+	slices.SortFunc(words, func(a, b string) int {
+		return cmp.Compare(len(db.index[a]), len(db.index[b]))
+	})
+	scores := make(map[uuid.UUID]int)
+	for id, count := range db.index[words[0]] {
+		scores[id] = count
+	}
+	for _, word := range words[1:] {
+		postings := db.index[word]
+		for id := range scores {
+			count, ex := postings[id]
+			if !ex {
+				delete(scores, id)
+				continue
+			}
+			scores[id] += count
+		}
+	}
+
+	results := make([]Result, 0, len(scores))
+	for id, score := range scores {
+		results = append(results, Result{Message: db.messages[id], Score: score})
+	}
+	slices.SortFunc(results, func(a, b Result) int {
+		if a.Score != b.Score {
+			return cmp.Compare(b.Score, a.Score)
+		}
+		return b.SentAt.Compare(a.SentAt)
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+func (db *dbImpl) Around(id uuid.UUID, n int) []Message {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	target, ex := db.messages[id]
+	if !ex {
+		return nil
+	}
+	conversation := make([]Message, 0)
+	for _, msg := range db.messages {
+		if msg.Peer == target.Peer {
+			conversation = append(conversation, msg)
+		}
+	}
+	slices.SortFunc(conversation, func(a, b Message) int {
+		if c := a.SentAt.Compare(b.SentAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID.String(), b.ID.String())
+	})
+	i := slices.IndexFunc(conversation, func(msg Message) bool { return msg.ID == id })
+	return conversation[max(0, i-n):min(len(conversation), i+n+1)]
+}
+
+func (db *dbImpl) Close() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.log == nil {
+		return nil
+	}
+	err := db.log.Close()
+	db.log = nil
+	return err
+}
@@ -0,0 +1,92 @@
+package history_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"novachat-server/novaclient/history"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestSearch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	db, err := history.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer := uuid.New()
+	now := time.Now()
+	deploy := history.Message{ID: uuid.New(), Peer: peer, Author: "bob", SentAt: now, Text: "Deploy failed, deploy again?"}
+	lunch := history.Message{ID: uuid.New(), Peer: peer, Author: "alice", SentAt: now.Add(time.Second), Text: "Lunch after deploy"}
+	other := history.Message{ID: uuid.New(), Peer: uuid.New(), Author: "carol", SentAt: now, Text: "Привет, мир"}
+	for _, msg := range []history.Message{deploy, lunch, other} {
+		if err := db.Put(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results := db.Search("DEPLOY", 10)
+	if len(results) != 2 || results[0].ID != deploy.ID || results[0].Score != 2 {
+		t.Errorf("unexpected results %+v", results)
+	}
+	if results := db.Search("deploy lunch", 10); len(results) != 1 || results[0].ID != lunch.ID {
+		t.Errorf("every word must match: %+v", results)
+	}
+	if results := db.Search("мир", 10); len(results) != 1 || results[0].ID != other.ID {
+		t.Errorf("unicode search failed: %+v", results)
+	}
+
+	// Edit reindexes message, delete drops it
+	lunch.Text, lunch.Edited = "Dinner instead", true
+	db.Put(lunch)
+	db.Delete(other.ID)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = history.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if results := db.Search("lunch", 10); len(results) != 0 {
+		t.Errorf("old text is still indexed: %+v", results)
+	}
+	if results := db.Search("dinner", 10); len(results) != 1 || !results[0].Edited {
+		t.Errorf("edit lost after reopen: %+v", results)
+	}
+	if results := db.Search("мир", 10); len(results) != 0 {
+		t.Errorf("deleted message found: %+v", results)
+	}
+	if around := db.Around(deploy.ID, 5); len(around) != 2 || around[0].ID != deploy.ID {
+		t.Errorf("unexpected context %+v", around)
+	}
+}
+
+func TestExport(t *testing.T) {
+	msgs := []history.Message{{ID: uuid.New(), Author: "bob", SentAt: time.Now(), Text: "hello"}}
+	var buf bytes.Buffer
+	if err := history.Export(&buf, history.FormatJson, msgs); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []history.Message
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil || len(decoded) != 1 || decoded[0].Text != "hello" {
+		t.Errorf("unexpected json export %s: %v", buf.String(), err)
+	}
+
+	buf.Reset()
+	if err := history.Export(&buf, history.FormatText, msgs); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(buf.String(), "bob: hello\n") {
+		t.Errorf("unexpected text export %q", buf.String())
+	}
+	if err := history.Export(&buf, "xml", msgs); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
@@ -0,0 +1,142 @@
+package identity
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"novachat-server/common/atomicfile"
+	"os"
+	"sync"
+	"time"
+)
+
+// Result of comparing peer identity with the one seen before
+const (
+	KeyNew = iota
+	KeyKnown
+	KeyChanged
+	// Peer sent no identity, old client or stripped by server
+	KeyMissing
+)
+
+var (
+	ErrorBadSignature = errors.New("session key is not signed by identity")
+	// Verified contact sent key without identity, server may have stripped it to substitute the key
+	ErrorIdentityMissing = errors.New("verified contact sent no identity key")
+)
+
+// Contact is identity key last seen for peer name
+type Contact struct {
+	Key        ed25519.PublicKey `json:"key"`
+	FirstSeen  time.Time         `json:"first_seen"`
+	VerifiedAt time.Time         `json:"verified_at,omitzero"`
+}
+
+func (c Contact) Verified() bool {
+	return !c.VerifiedAt.IsZero()
+}
+
+// Contacts remembers identity keys of peers, changed key drops verification
+type Contacts interface {
+	// Check stores key of peer, previous contact is returned for KeyKnown and KeyChanged
+	Check(name string, key ed25519.PublicKey) (int, Contact, error)
+	Get(name string) (Contact, bool)
+	// Verify marks current key of peer as compared out of band
+	Verify(name string) error
+}
+
+type contactsImpl struct {
+	path     string
+	mutex    sync.Mutex
+	contacts map[string]Contact
+}
+
+// OpenContacts loads contacts from json file, file is created on first change. Empty path keeps contacts in memory only
+func OpenContacts(path string) (Contacts, error) {
+	c := &contactsImpl{path: path, contacts: make(map[string]Contact)}
+	if path == "" {
+		return c, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return c, nil
+		}
+		return nil, fmt.Errorf("failed to read contacts: %w", err)
+	}
+	if err := json.Unmarshal(data, &c.contacts); err != nil {
+		return nil, fmt.Errorf("failed to parse contacts: %w", err)
+	}
+	return c, nil
+}
+
+func (c *contactsImpl) Check(name string, key ed25519.PublicKey) (int, Contact, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	old, ex := c.contacts[name]
+	if ex && bytes.Equal(old.Key, key) {
+		return KeyKnown, old, nil
+	}
+	c.contacts[name] = Contact{Key: key, FirstSeen: time.Now().UTC()}
+	if err := c.save(); err != nil {
+		return KeyNew, Contact{}, err
+	}
+	if ex {
+		return KeyChanged, old, nil
+	}
+	return KeyNew, Contact{}, nil
+}
+
+func (c *contactsImpl) Get(name string) (Contact, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	contact, ex := c.contacts[name]
+	return contact, ex
+}
+
+func (c *contactsImpl) Verify(name string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	contact, ex := c.contacts[name]
+	if !ex {
+		return fmt.Errorf("unknown contact %s", name)
+	}
+	contact.VerifiedAt = time.Now().UTC()
+	c.contacts[name] = contact
+	return c.save()
+}
+
+// save writes contacts to temp file and renames it, caller holds lock
+func (c *contactsImpl) save() error {
+	if c.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(c.contacts, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.Write(c.path, data); err != nil {
+		return fmt.Errorf("failed to save contacts: %w", err)
+	}
+	return nil
+}
+
+// CheckPeerKey verifies signature of session key sent by peer and compares identity with the one seen before.
+// Key must not be used on error, missing identity of verified contact counts as key change
+func CheckPeerKey(contacts Contacts, name string, identity ed25519.PublicKey, key string, signature []byte) (int, Contact, error) {
+	if len(identity) == 0 {
+		if old, ex := contacts.Get(name); ex && old.Verified() {
+			return KeyChanged, old, ErrorIdentityMissing
+		}
+		return KeyMissing, Contact{}, nil
+	}
+	if !VerifyKey(identity, key, signature) {
+		return KeyNew, Contact{}, ErrorBadSignature
+	}
+	if name == "" {
+		return KeyNew, Contact{}, nil
+	}
+	return contacts.Check(name, identity)
+}
@@ -0,0 +1,124 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	fingerprintVersion    = 0
+	fingerprintIterations = 5200
+	// Digits contributed by every key, fingerprint is 60 digits in groups of 5
+	fingerprintDigits = 30
+)
+
+// Prefix of signed data, keeps identity signatures from being reused in other protocols
+const keySignaturePrefix = "nova-peer-key:"
+
+// Identity is long-term key of user, it signs session keys sent to peers
+type Identity struct {
+	private ed25519.PrivateKey
+}
+
+// New returns identity that lives as long as the process
+func New() (*Identity, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{private: private}, nil
+}
+
+// FromPrivateKey wraps key kept elsewhere, e.g. in keystore
+func FromPrivateKey(private ed25519.PrivateKey) *Identity {
+	return &Identity{private: private}
+}
+
+// LoadOrCreate reads identity from PEM file, creating it on first start
+func LoadOrCreate(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		id, err := New()
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(id.private)
+		if err != nil {
+			return nil, err
+		}
+		data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			return nil, fmt.Errorf("failed to save identity: %w", err)
+		}
+		return id, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("no private key in %s", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse identity: %w", err)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("identity is not ed25519 key")
+	}
+	return &Identity{private: private}, nil
+}
+
+func (id *Identity) Public() ed25519.PublicKey {
+	return id.private.Public().(ed25519.PublicKey)
+}
+
+// SignKey signs session public key sent to peer
+func (id *Identity) SignKey(key string) []byte {
+	return ed25519.Sign(id.private, []byte(keySignaturePrefix+key))
+}
+
+// VerifyKey checks that session public key was signed by identity
+func VerifyKey(identity ed25519.PublicKey, key string, signature []byte) bool {
+	return len(identity) == ed25519.PublicKeySize && ed25519.Verify(identity, []byte(keySignaturePrefix+key), signature)
+}
+
+// fingerprintPart derives digits of one key, iterated hashing makes collisions expensive to search
+func fingerprintPart(key ed25519.PublicKey) string {
+	h := append([]byte{0, fingerprintVersion}, key...)
+	for range fingerprintIterations {
+		sum := sha512.Sum512(append(h, key...))
+		h = sum[:]
+	}
+	var b strings.Builder
+	for i := 0; i < fingerprintDigits/5; i++ {
+		chunk := h[i*5 : i*5+5]
+		n := uint64(chunk[0])<<32 | uint64(chunk[1])<<24 | uint64(chunk[2])<<16 | uint64(chunk[3])<<8 | uint64(chunk[4])
+		fmt.Fprintf(&b, "%05d", n%100000)
+	}
+	return b.String()
+}
+
+// Fingerprint is safety number of two identities, both peers get the same digits.
+// Users compare it out of band, any substituted key changes it
+func Fingerprint(a, b ed25519.PublicKey) string {
+	first, second := fingerprintPart(a), fingerprintPart(b)
+	if first > second {
+		first, second = second, first
+	}
+	digits := first + second
+	groups := make([]string, 0, len(digits)/5)
+	for i := 0; i < len(digits); i += 5 {
+		groups = append(groups, digits[i:i+5])
+	}
+	return strings.Join(groups, " ")
+}
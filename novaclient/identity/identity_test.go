@@ -0,0 +1,90 @@
+package identity_test
+
+import (
+	"errors"
+	"novachat-server/novaclient/identity"
+	"path/filepath"
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	alice, err := identity.LoadOrCreate(filepath.Join(dir, "alice.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := identity.LoadOrCreate(filepath.Join(dir, "alice.pem"))
+	if err != nil || !reloaded.Public().Equal(alice.Public()) {
+		t.Fatalf("identity changed after reload: %v", err)
+	}
+	bob, _ := identity.New()
+	mallory, _ := identity.New()
+
+	fp := identity.Fingerprint(alice.Public(), bob.Public())
+	if fp != identity.Fingerprint(bob.Public(), alice.Public()) {
+		t.Error("fingerprint depends on order of keys")
+	}
+	if len(fp) != 60+11 {
+		t.Errorf("unexpected fingerprint %q", fp)
+	}
+	if fp == identity.Fingerprint(alice.Public(), mallory.Public()) {
+		t.Error("substituted key kept fingerprint")
+	}
+
+	sig := bob.SignKey("session")
+	if !identity.VerifyKey(bob.Public(), "session", sig) || identity.VerifyKey(mallory.Public(), "session", sig) {
+		t.Error("unexpected signature check result")
+	}
+}
+
+func TestContacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "contacts.json")
+	contacts, err := identity.OpenContacts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, _ := identity.New()
+	if status, _, _ := contacts.Check("bob", bob.Public()); status != identity.KeyNew {
+		t.Errorf("unexpected status %d", status)
+	}
+	if err := contacts.Verify("bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	contacts, err = identity.OpenContacts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, old, _ := contacts.Check("bob", bob.Public()); status != identity.KeyKnown || !old.Verified() {
+		t.Errorf("verification lost after reopen: %d %+v", status, old)
+	}
+	mallory, _ := identity.New()
+	if status, old, _ := contacts.Check("bob", mallory.Public()); status != identity.KeyChanged || !old.Verified() {
+		t.Errorf("key change not reported: %d %+v", status, old)
+	}
+	if current, _ := contacts.Get("bob"); current.Verified() {
+		t.Error("changed key stayed verified")
+	}
+}
+
+func TestIdentityDowngrade(t *testing.T) {
+	contacts, _ := identity.OpenContacts("")
+	bob, _ := identity.New()
+	sig := bob.SignKey("session")
+	if status, _, err := identity.CheckPeerKey(contacts, "bob", nil, "session", nil); err != nil || status != identity.KeyMissing {
+		t.Errorf("unverified contact without identity rejected: %d %v", status, err)
+	}
+	if _, _, err := identity.CheckPeerKey(contacts, "bob", bob.Public(), "substituted", sig); !errors.Is(err, identity.ErrorBadSignature) {
+		t.Errorf("unexpected error for forged key: %v", err)
+	}
+	if status, _, err := identity.CheckPeerKey(contacts, "bob", bob.Public(), "session", sig); err != nil || status != identity.KeyNew {
+		t.Fatalf("valid key rejected: %d %v", status, err)
+	}
+	contacts.Verify("bob")
+
+	// Server strips identity of verified contact to substitute its own key
+	status, old, err := identity.CheckPeerKey(contacts, "bob", nil, "substituted", nil)
+	if !errors.Is(err, identity.ErrorIdentityMissing) || status != identity.KeyChanged || !old.Verified() {
+		t.Errorf("downgrade of verified contact accepted: %d %v", status, err)
+	}
+}
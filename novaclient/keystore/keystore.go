@@ -0,0 +1,433 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"novachat-server/common/atomicfile"
+	"novachat-server/novaclient/identity"
+	"novachat-server/novaprotocol/handshake"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	version = 1
+	kdf     = "argon2id"
+	keySize = 32
+	// AES-GCM standard nonce and tag sizes
+	nonceSize = 12
+	tagSize   = 16
+)
+
+// Default argon2id cost, stored in file so it can be raised without breaking old keystores
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+)
+
+// Shared keys of earlier sessions kept per peer, history stored under them stays readable
+const maxPreviousKeys = 16
+
+// Bounds of argon2id cost accepted from file, crafted keystore must not exhaust memory or cpu before passphrase is checked
+const (
+	maxArgonTime   = 10
+	maxArgonMemory = 1 << 20 // KiB
+)
+
+var (
+	ErrorLocked     = errors.New("keystore is locked")
+	ErrorPassphrase = errors.New("wrong passphrase or corrupted keystore")
+	ErrorFormat     = errors.New("unsupported keystore format")
+)
+
+// Peer is what we know about peer with nickname
+type Peer struct {
+	Identity ed25519.PublicKey `json:"identity,omitempty"`
+	// Shared key of the last key exchange
+	SessionKey []byte `json:"session_key,omitempty"`
+	// Shared keys of earlier exchanges, newest first
+	PreviousKeys [][]byte  `json:"previous_keys,omitempty"`
+	FirstSeen    time.Time `json:"first_seen"`
+	VerifiedAt   time.Time `json:"verified_at,omitzero"`
+}
+
+// contents is plaintext of keystore, it exists only while keystore is unlocked
+type contents struct {
+	Identity ed25519.PrivateKey `json:"identity"`
+	// Key pair of peer to peer key exchange, kept so shared keys survive restart
+	SessionPrivate *big.Int        `json:"session_private"`
+	SessionPublic  *big.Int        `json:"session_public"`
+	Peers          map[string]Peer `json:"peers"`
+}
+
+// envelope is keystore on disk, header fields are authenticated together with data
+type envelope struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	Salt    []byte `json:"salt"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+	Nonce   []byte `json:"nonce,omitempty"`
+	Data    []byte `json:"data,omitempty"`
+}
+
+// Keystore keeps identity, session keys and verified peers encrypted with key derived from passphrase.
+// It implements identity.Contacts, changed identity of peer drops its verification
+type Keystore interface {
+	identity.Contacts
+
+	// Unlock decrypts keystore, new keystore with fresh keys is created when file does not exist
+	Unlock(passphrase []byte) error
+	// Lock wipes keys from memory, everything but Unlock fails with ErrorLocked until then
+	Lock()
+	Locked() bool
+
+	Identity() (*identity.Identity, error)
+	// SessionKeyPair returns key pair of peer to peer key exchange
+	SessionKeyPair() (private, public *big.Int, err error)
+	Peer(name string) (Peer, bool)
+	// SetSessionKey stores shared key of the last exchange with peer, replaced key is kept in PreviousKeys
+	SetSessionKey(name string, key []byte) error
+
+	// Export writes backup encrypted with the same passphrase
+	Export(w io.Writer) error
+	// Import replaces contents with backup encrypted with passphrase, keystore must be unlocked
+	Import(r io.Reader, passphrase []byte) error
+}
+
+type keystoreImpl struct {
+	path     string
+	mutex    sync.Mutex
+	key      []byte
+	envelope envelope
+	contents *contents
+}
+
+// Open returns locked keystore stored at path
+func Open(path string) Keystore {
+	return &keystoreImpl{path: path}
+}
+
+func deriveKey(passphrase []byte, e *envelope) []byte {
+	return argon2.IDKey(passphrase, e.Salt, e.Time, e.Memory, e.Threads, keySize)
+}
+
+// additionalData binds header of envelope to ciphertext
+func additionalData(e envelope) []byte {
+	e.Nonce, e.Data = nil, nil
+	data, _ := json.Marshal(e)
+	return data
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func readEnvelope(r io.Reader) (*envelope, error) {
+	var e envelope
+	if err := json.NewDecoder(r).Decode(&e); err != nil {
+		return nil, fmt.Errorf("failed to parse keystore: %w", err)
+	}
+	if e.Version != version || e.KDF != kdf || len(e.Salt) == 0 {
+		return nil, ErrorFormat
+	}
+	if e.Time < 1 || e.Time > maxArgonTime || e.Memory > maxArgonMemory || e.Threads < 1 {
+		return nil, fmt.Errorf("%w: argon2id parameters out of bounds", ErrorFormat)
+	}
+	// GCM panics on nonce of wrong length
+	if len(e.Nonce) != nonceSize || len(e.Data) < tagSize {
+		return nil, fmt.Errorf("%w: truncated ciphertext", ErrorFormat)
+	}
+	return &e, nil
+}
+
+// decrypt opens envelope with passphrase, returns derived key and contents
+func decrypt(e *envelope, passphrase []byte) ([]byte, *contents, error) {
+	key := deriveKey(passphrase, e)
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err := gcm.Open(nil, e.Nonce, e.Data, additionalData(*e))
+	if err != nil {
+		return nil, nil, ErrorPassphrase
+	}
+	defer clear(plaintext)
+	var c contents
+	if err := json.Unmarshal(plaintext, &c); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse keystore: %w", err)
+	}
+	if len(c.Identity) != ed25519.PrivateKeySize || c.SessionPrivate == nil || c.SessionPublic == nil {
+		return nil, nil, ErrorFormat
+	}
+	if c.Peers == nil {
+		c.Peers = make(map[string]Peer)
+	}
+	return key, &c, nil
+}
+
+func newContents() (*contents, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sessionPrivate, sessionPublic, err := handshake.GenerateKeyPair(handshake.Generator2048, handshake.Prime2048)
+	if err != nil {
+		return nil, err
+	}
+	return &contents{Identity: private, SessionPrivate: sessionPrivate, SessionPublic: sessionPublic, Peers: make(map[string]Peer)}, nil
+}
+
+func (k *keystoreImpl) Unlock(passphrase []byte) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.contents != nil {
+		return nil
+	}
+
+	f, err := os.Open(k.path)
+	if errors.Is(err, os.ErrNotExist) {
+		c, err := newContents()
+		if err != nil {
+			return err
+		}
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+		k.envelope = envelope{Version: version, KDF: kdf, Salt: salt, Time: argonTime, Memory: argonMemory, Threads: argonThreads}
+		k.key = deriveKey(passphrase, &k.envelope)
+		k.contents = c
+		if err := k.save(); err != nil {
+			k.wipe()
+			return err
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open keystore: %w", err)
+	}
+	defer f.Close()
+
+	e, err := readEnvelope(f)
+	if err != nil {
+		return err
+	}
+	key, c, err := decrypt(e, passphrase)
+	if err != nil {
+		return err
+	}
+	k.envelope, k.key, k.contents = *e, key, c
+	return nil
+}
+
+// wipe zeroes keys in memory, caller holds lock
+func (k *keystoreImpl) wipe() {
+	clear(k.key)
+	k.key = nil
+	if k.contents != nil {
+		clear(k.contents.Identity)
+		k.contents.SessionPrivate.SetInt64(0)
+		for _, p := range k.contents.Peers {
+			clear(p.SessionKey)
+			for _, key := range p.PreviousKeys {
+				clear(key)
+			}
+		}
+		k.contents = nil
+	}
+}
+
+func (k *keystoreImpl) Lock() {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.wipe()
+}
+
+func (k *keystoreImpl) Locked() bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.contents == nil
+}
+
+// save encrypts contents with fresh nonce, writes them to temp file and renames it, caller holds lock
+func (k *keystoreImpl) save() error {
+	plaintext, err := json.Marshal(k.contents)
+	if err != nil {
+		return err
+	}
+	defer clear(plaintext)
+	gcm, err := newGCM(k.key)
+	if err != nil {
+		return err
+	}
+	e := k.envelope
+	e.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(e.Nonce); err != nil {
+		return err
+	}
+	e.Data = gcm.Seal(nil, e.Nonce, plaintext, additionalData(e))
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	// Keystore can not be rebuilt, atomic write keeps the old one until the new one is on disk
+	if err := atomicfile.Write(k.path, data); err != nil {
+		return fmt.Errorf("failed to save keystore: %w", err)
+	}
+	k.envelope = e
+	return nil
+}
+
+func (k *keystoreImpl) Identity() (*identity.Identity, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.contents == nil {
+		return nil, ErrorLocked
+	}
+	return identity.FromPrivateKey(bytes.Clone(k.contents.Identity)), nil
+}
+
+func (k *keystoreImpl) SessionKeyPair() (*big.Int, *big.Int, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.contents == nil {
+		return nil, nil, ErrorLocked
+	}
+	return new(big.Int).Set(k.contents.SessionPrivate), new(big.Int).Set(k.contents.SessionPublic), nil
+}
+
+func (k *keystoreImpl) Peer(name string) (Peer, bool) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.contents == nil {
+		return Peer{}, false
+	}
+	p, ex := k.contents.Peers[name]
+	return p, ex
+}
+
+func (k *keystoreImpl) SetSessionKey(name string, key []byte) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.contents == nil {
+		return ErrorLocked
+	}
+	p, ex := k.contents.Peers[name]
+	if !ex {
+		p.FirstSeen = time.Now().UTC()
+	}
+	if bytes.Equal(p.SessionKey, key) {
+		return nil
+	}
+	if p.SessionKey != nil {
+		p.PreviousKeys = append([][]byte{p.SessionKey}, p.PreviousKeys...)
+		if len(p.PreviousKeys) > maxPreviousKeys {
+			clear(p.PreviousKeys[maxPreviousKeys])
+			p.PreviousKeys = p.PreviousKeys[:maxPreviousKeys]
+		}
+	}
+	p.SessionKey = bytes.Clone(key)
+	k.contents.Peers[name] = p
+	return k.save()
+}
+
+func (k *keystoreImpl) Check(name string, key ed25519.PublicKey) (int, identity.Contact, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.contents == nil {
+		return identity.KeyNew, identity.Contact{}, ErrorLocked
+	}
+	p, ex := k.contents.Peers[name]
+	old := identity.Contact{Key: p.Identity, FirstSeen: p.FirstSeen, VerifiedAt: p.VerifiedAt}
+	if ex && p.Identity.Equal(key) {
+		return identity.KeyKnown, old, nil
+	}
+	// Session key belonged to previous identity
+	k.contents.Peers[name] = Peer{Identity: key, FirstSeen: time.Now().UTC()}
+	if err := k.save(); err != nil {
+		return identity.KeyNew, identity.Contact{}, err
+	}
+	if ex && p.Identity != nil {
+		return identity.KeyChanged, old, nil
+	}
+	return identity.KeyNew, identity.Contact{}, nil
+}
+
+func (k *keystoreImpl) Get(name string) (identity.Contact, bool) {
+	p, ex := k.Peer(name)
+	if !ex || p.Identity == nil {
+		return identity.Contact{}, false
+	}
+	return identity.Contact{Key: p.Identity, FirstSeen: p.FirstSeen, VerifiedAt: p.VerifiedAt}, true
+}
+
+func (k *keystoreImpl) Verify(name string) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.contents == nil {
+		return ErrorLocked
+	}
+	p, ex := k.contents.Peers[name]
+	if !ex || p.Identity == nil {
+		return fmt.Errorf("unknown contact %s", name)
+	}
+	p.VerifiedAt = time.Now().UTC()
+	k.contents.Peers[name] = p
+	return k.save()
+}
+
+func (k *keystoreImpl) Export(w io.Writer) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.contents == nil {
+		return ErrorLocked
+	}
+	return json.NewEncoder(w).Encode(k.envelope)
+}
+
+func (k *keystoreImpl) Import(r io.Reader, passphrase []byte) error {
+	e, err := readEnvelope(r)
+	if err != nil {
+		return err
+	}
+	key, c, err := decrypt(e, passphrase)
+	if err != nil {
+		return err
+	}
+	clear(key)
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.contents == nil {
+		return ErrorLocked
+	}
+	// Backup is encrypted again with passphrase of this keystore
+	old := k.contents
+	k.contents = c
+	if err := k.save(); err != nil {
+		k.contents = old
+		return err
+	}
+	clear(old.Identity)
+	old.SessionPrivate.SetInt64(0)
+	return nil
+}
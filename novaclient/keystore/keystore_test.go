@@ -0,0 +1,127 @@
+package keystore_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"novachat-server/novaclient/identity"
+	"novachat-server/novaclient/keystore"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeystore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "keys")
+	ks := keystore.Open(path)
+	if _, err := ks.Identity(); !errors.Is(err, keystore.ErrorLocked) {
+		t.Fatalf("locked keystore returned identity: %v", err)
+	}
+	if err := ks.Unlock([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	id, _ := ks.Identity()
+	_, pub, _ := ks.SessionKeyPair()
+	bob, _ := identity.New()
+	ks.Check("bob", bob.Public())
+	ks.SetSessionKey("bob", []byte("session"))
+	if err := ks.Verify("bob"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	if bytes.Contains(data, []byte("bob")) {
+		t.Error("keystore is stored in clear")
+	}
+	ks.Lock()
+	if _, ok := ks.Peer("bob"); ok || !ks.Locked() {
+		t.Error("locked keystore returned peer")
+	}
+
+	ks = keystore.Open(path)
+	if err := ks.Unlock([]byte("wrong")); !errors.Is(err, keystore.ErrorPassphrase) {
+		t.Fatalf("unexpected error for wrong passphrase: %v", err)
+	}
+	if err := ks.Unlock([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, _ := ks.Identity()
+	_, reloadedPub, _ := ks.SessionKeyPair()
+	if !reloaded.Public().Equal(id.Public()) || reloadedPub.Cmp(pub) != 0 {
+		t.Error("keys changed after unlock")
+	}
+	if p, _ := ks.Peer("bob"); !bytes.Equal(p.SessionKey, []byte("session")) {
+		t.Errorf("session key lost: %+v", p)
+	}
+	if c, _ := ks.Get("bob"); !c.Verified() {
+		t.Error("verification lost")
+	}
+	// History sealed under key of earlier session stays readable
+	ks.SetSessionKey("bob", []byte("next"))
+	if p, _ := ks.Peer("bob"); !bytes.Equal(p.SessionKey, []byte("next")) || len(p.PreviousKeys) != 1 || !bytes.Equal(p.PreviousKeys[0], []byte("session")) {
+		t.Errorf("previous session key lost: %+v", p)
+	}
+
+	// Backup restored into keystore with another passphrase
+	var backup bytes.Buffer
+	if err := ks.Export(&backup); err != nil {
+		t.Fatal(err)
+	}
+	other := keystore.Open(filepath.Join(dir, "other"))
+	if err := other.Unlock([]byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Import(bytes.NewReader(backup.Bytes()), []byte("wrong")); !errors.Is(err, keystore.ErrorPassphrase) {
+		t.Fatalf("backup imported with wrong passphrase: %v", err)
+	}
+	if err := other.Import(&backup, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	other.Lock()
+	if err := other.Unlock([]byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	if restored, _ := other.Identity(); !restored.Public().Equal(id.Public()) {
+		t.Error("identity not restored from backup")
+	}
+}
+
+func TestKeystoreCostBounds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := keystore.Open(path).Unlock([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	for _, cost := range []map[string]any{{"time": 0}, {"time": 11}, {"memory": 1<<20 + 1}, {"threads": 0}} {
+		var e map[string]any
+		json.Unmarshal(data, &e)
+		for k, v := range cost {
+			e[k] = v
+		}
+		crafted, _ := json.Marshal(e)
+		os.WriteFile(path, crafted, 0o600)
+		if err := keystore.Open(path).Unlock([]byte("secret")); !errors.Is(err, keystore.ErrorFormat) {
+			t.Errorf("keystore with cost %v not rejected: %v", cost, err)
+		}
+	}
+}
+
+func TestKeystoreTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := keystore.Open(path).Unlock([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	for _, field := range []map[string]any{{"nonce": nil}, {"nonce": []byte{1, 2, 3}}, {"data": []byte{1, 2, 3}}} {
+		var e map[string]any
+		json.Unmarshal(data, &e)
+		for k, v := range field {
+			e[k] = v
+		}
+		crafted, _ := json.Marshal(e)
+		os.WriteFile(path, crafted, 0o600)
+		if err := keystore.Open(path).Unlock([]byte("secret")); !errors.Is(err, keystore.ErrorFormat) {
+			t.Errorf("keystore with %v not rejected: %v", field, err)
+		}
+	}
+}
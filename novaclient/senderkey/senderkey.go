@@ -0,0 +1,365 @@
+package senderkey
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"novachat-server/novaprotocol"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// MSG_DISTRIBUTION carries Distribution, it must be sent over pairwise encrypted channel only
+const MSG_DISTRIBUTION = "sk_dist"
+
+const (
+	version = 1
+	// Messages of one sender that may be lost or reordered before decryption fails
+	MaxSkip = 1000
+
+	headerSize = 1 + 4 + 4 // version, key id, iteration
+	nonceSize  = 12
+)
+
+var (
+	ErrorNoKey        = errors.New("no sender key")
+	ErrorInvalid      = errors.New("invalid sender key message")
+	ErrorBadSignature = errors.New("invalid sender key signature")
+	ErrorReplayed     = errors.New("message key already used")
+	ErrorTooFar       = errors.New("too many skipped messages")
+)
+
+// Distribution is sender key of one member of group. Chain key is at Iteration, so
+// receiver can decrypt messages from that point on, but none of the earlier ones
+type Distribution struct {
+	Group      uuid.UUID `json:"group"`
+	KeyID      uint32    `json:"key_id"`
+	Iteration  uint32    `json:"iteration"`
+	ChainKey   []byte    `json:"chain_key"`
+	SigningKey []byte    `json:"signing_key"`
+}
+
+// chain derives one message key per iteration, keys of past iterations can not be recovered
+type chain struct {
+	iteration uint32
+	key       []byte
+}
+
+func derive(key []byte, label byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte{label})
+	return mac.Sum(nil)
+}
+
+// next returns message key of current iteration and moves chain forward
+func (c *chain) next() []byte {
+	messageKey := derive(c.key, 1)
+	c.key = derive(c.key, 2)
+	c.iteration++
+	return messageKey
+}
+
+type ownKey struct {
+	id      uint32
+	chain   chain
+	signing ed25519.PrivateKey
+}
+
+// senderState is key of other member, previous key is kept for messages sent before rotation
+type senderState struct {
+	current  *receiverKey
+	previous *receiverKey
+}
+
+type receiverKey struct {
+	id      uint32
+	chain   chain
+	verify  ed25519.PublicKey
+	skipped map[uint32][]byte
+}
+
+// Keyring holds own sender key and keys of other members for every group.
+// Group message is encrypted once with own key and decrypted by every member with copy of it
+type Keyring interface {
+	// Encrypt seals plaintext with own key of group, key is created on first use
+	Encrypt(group uuid.UUID, plaintext []byte) ([]byte, error)
+	Decrypt(group, sender uuid.UUID, data []byte) ([]byte, error)
+	// EncryptFunc and DecryptFunc plug keyring into l1 frames
+	EncryptFunc(group uuid.UUID) novaprotocol.CryptFunc
+	DecryptFunc(group, sender uuid.UUID) novaprotocol.CryptFunc
+
+	// Distribution returns own current key, to be sent to members
+	Distribution(group uuid.UUID) (*Distribution, error)
+	// Rotate replaces own key, removed members never get the new one
+	Rotate(group uuid.UUID) (*Distribution, error)
+	// Receive stores key of sender, it replaces previous key of the sender
+	Receive(sender uuid.UUID, d *Distribution) error
+	// Remove drops key of sender, returns false if sender had no key
+	Remove(group, sender uuid.UUID) bool
+	// Members that distributed their keys to us
+	Members(group uuid.UUID) []uuid.UUID
+	// Leave drops own and received keys of group
+	Leave(group uuid.UUID)
+}
+
+type keyringImpl struct {
+	mutex   sync.Mutex
+	own     map[uuid.UUID]*ownKey
+	senders map[uuid.UUID]map[uuid.UUID]*senderState
+}
+
+func NewKeyring() Keyring {
+	return &keyringImpl{
+		own:     make(map[uuid.UUID]*ownKey),
+		senders: make(map[uuid.UUID]map[uuid.UUID]*senderState),
+	}
+}
+
+func newOwnKey() (*ownKey, error) {
+	_, signing, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	var id [4]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &ownKey{id: binary.BigEndian.Uint32(id[:]), chain: chain{key: key}, signing: signing}, nil
+}
+
+// ownKey returns own key of group, caller holds lock
+func (k *keyringImpl) ownKey(group uuid.UUID) (*ownKey, error) {
+	if own, ex := k.own[group]; ex {
+		return own, nil
+	}
+	own, err := newOwnKey()
+	if err != nil {
+		return nil, err
+	}
+	k.own[group] = own
+	return own, nil
+}
+
+func (own *ownKey) distribution(group uuid.UUID) *Distribution {
+	return &Distribution{
+		Group:      group,
+		KeyID:      own.id,
+		Iteration:  own.chain.iteration,
+		ChainKey:   append([]byte(nil), own.chain.key...),
+		SigningKey: append([]byte(nil), own.signing.Public().(ed25519.PublicKey)...),
+	}
+}
+
+func seal(key, header, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, header), nil
+}
+
+func open(key, header, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < nonceSize {
+		return nil, ErrorInvalid
+	}
+	return gcm.Open(nil, sealed[:nonceSize], sealed[nonceSize:], header)
+}
+
+// Encrypt produces version, key id, iteration, sealed plaintext and signature of all of them
+func (k *keyringImpl) Encrypt(group uuid.UUID, plaintext []byte) ([]byte, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	own, err := k.ownKey(group)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, headerSize)
+	header[0] = version
+	binary.BigEndian.PutUint32(header[1:], own.id)
+	binary.BigEndian.PutUint32(header[5:], own.chain.iteration)
+	sealed, err := seal(own.chain.next(), header, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	msg := append(header, sealed...)
+	return append(msg, ed25519.Sign(own.signing, msg)...), nil
+}
+
+// messageKey returns key of iteration, moving chain forward and keeping skipped keys
+func (r *receiverKey) messageKey(iteration uint32) ([]byte, error) {
+	if iteration < r.chain.iteration {
+		key, ex := r.skipped[iteration]
+		if !ex {
+			return nil, ErrorReplayed
+		}
+		delete(r.skipped, iteration)
+		return key, nil
+	}
+	if iteration-r.chain.iteration > MaxSkip {
+		return nil, ErrorTooFar
+	}
+	for r.chain.iteration < iteration {
+		skipped := r.chain.iteration
+		r.skipped[skipped] = r.chain.next()
+	}
+	// Keys too old to arrive anymore
+	for skipped := range r.skipped {
+		if iteration-skipped > MaxSkip {
+			delete(r.skipped, skipped)
+		}
+	}
+	return r.chain.next(), nil
+}
+
+func (k *keyringImpl) Decrypt(group, sender uuid.UUID, data []byte) ([]byte, error) {
+	if len(data) < headerSize+nonceSize+ed25519.SignatureSize || data[0] != version {
+		return nil, ErrorInvalid
+	}
+	msg, signature := data[:len(data)-ed25519.SignatureSize], data[len(data)-ed25519.SignatureSize:]
+	header := msg[:headerSize]
+	id := binary.BigEndian.Uint32(header[1:])
+	iteration := binary.BigEndian.Uint32(header[5:])
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	state, ex := k.senders[group][sender]
+	if !ex {
+		return nil, ErrorNoKey
+	}
+	r := state.current
+	if r.id != id {
+		r = state.previous
+	}
+	if r == nil || r.id != id {
+		return nil, ErrorNoKey
+	}
+	// Signature is checked before chain moves, so forged message can not burn keys
+	if !ed25519.Verify(r.verify, msg, signature) {
+		return nil, ErrorBadSignature
+	}
+	key, err := r.messageKey(iteration)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := open(key, header, msg[headerSize:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt sender key message: %w", err)
+	}
+	return plaintext, nil
+}
+
+func (k *keyringImpl) EncryptFunc(group uuid.UUID) novaprotocol.CryptFunc {
+	return func(data []byte) ([]byte, error) {
+		return k.Encrypt(group, data)
+	}
+}
+
+func (k *keyringImpl) DecryptFunc(group, sender uuid.UUID) novaprotocol.CryptFunc {
+	return func(data []byte) ([]byte, error) {
+		return k.Decrypt(group, sender, data)
+	}
+}
+
+func (k *keyringImpl) Distribution(group uuid.UUID) (*Distribution, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	own, err := k.ownKey(group)
+	if err != nil {
+		return nil, err
+	}
+	return own.distribution(group), nil
+}
+
+func (k *keyringImpl) Rotate(group uuid.UUID) (*Distribution, error) {
+	own, err := newOwnKey()
+	if err != nil {
+		return nil, err
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.own[group] = own
+	return own.distribution(group), nil
+}
+
+func (k *keyringImpl) Receive(sender uuid.UUID, d *Distribution) error {
+	if d == nil || d.Group == uuid.Nil || len(d.ChainKey) != 32 || len(d.SigningKey) != ed25519.PublicKeySize {
+		return ErrorInvalid
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	senders, ex := k.senders[d.Group]
+	if !ex {
+		senders = make(map[uuid.UUID]*senderState)
+		k.senders[d.Group] = senders
+	}
+	state, ex := senders[sender]
+	if !ex {
+		state = &senderState{}
+		senders[sender] = state
+	}
+	// Repeated or late distribution must not rewind chain or replace newer key
+	if (state.current != nil && state.current.id == d.KeyID) || (state.previous != nil && state.previous.id == d.KeyID) {
+		return nil
+	}
+	state.previous = state.current
+	state.current = &receiverKey{
+		id:      d.KeyID,
+		chain:   chain{iteration: d.Iteration, key: append([]byte(nil), d.ChainKey...)},
+		verify:  append(ed25519.PublicKey(nil), d.SigningKey...),
+		skipped: make(map[uint32][]byte),
+	}
+	return nil
+}
+
+func (k *keyringImpl) Remove(group, sender uuid.UUID) bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	_, ex := k.senders[group][sender]
+	delete(k.senders[group], sender)
+	return ex
+}
+
+func (k *keyringImpl) Members(group uuid.UUID) []uuid.UUID {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	members := make([]uuid.UUID, 0, len(k.senders[group]))
+	for sender := range k.senders[group] {
+		members = append(members, sender)
+	}
+	return members
+}
+
+func (k *keyringImpl) Leave(group uuid.UUID) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	delete(k.own, group)
+	delete(k.senders, group)
+}
@@ -0,0 +1,88 @@
+package senderkey_test
+
+import (
+	"errors"
+	"novachat-server/novaclient/senderkey"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestGroupMessages(t *testing.T) {
+	group, alice, bob := uuid.New(), uuid.New(), uuid.New()
+	aliceRing, bobRing := senderkey.NewKeyring(), senderkey.NewKeyring()
+
+	first, err := aliceRing.Encrypt(group, []byte("before bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := aliceRing.Distribution(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bobRing.Receive(alice, d); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bobRing.Decrypt(group, alice, first); err == nil {
+		t.Error("newcomer decrypted message sent before it got the key")
+	}
+
+	// Out of order delivery, every message decrypts exactly once
+	second, _ := aliceRing.Encrypt(group, []byte("second"))
+	third, _ := aliceRing.Encrypt(group, []byte("third"))
+	if text, err := bobRing.Decrypt(group, alice, third); err != nil || string(text) != "third" {
+		t.Errorf("unexpected %q: %v", text, err)
+	}
+	if text, err := bobRing.Decrypt(group, alice, second); err != nil || string(text) != "second" {
+		t.Errorf("unexpected %q: %v", text, err)
+	}
+	if _, err := bobRing.Decrypt(group, alice, second); !errors.Is(err, senderkey.ErrorReplayed) {
+		t.Errorf("replay accepted: %v", err)
+	}
+
+	forged, _ := aliceRing.Encrypt(group, []byte("forged"))
+	forged[len(forged)-1] ^= 1
+	if _, err := bobRing.Decrypt(group, alice, forged); !errors.Is(err, senderkey.ErrorBadSignature) {
+		t.Errorf("forged message accepted: %v", err)
+	}
+
+	// Bob leaves, alice rotates and does not send him the new key
+	if _, err := aliceRing.Rotate(group); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := aliceRing.Encrypt(group, []byte("after bob"))
+	if _, err := bobRing.Decrypt(group, alice, after); !errors.Is(err, senderkey.ErrorNoKey) {
+		t.Errorf("removed member decrypted rotated key: %v", err)
+	}
+	if members := bobRing.Members(group); len(members) != 1 || members[0] != alice {
+		t.Errorf("unexpected members %v", members)
+	}
+	if !bobRing.Remove(group, alice) || bobRing.Remove(group, bob) {
+		t.Error("unexpected remove result")
+	}
+}
+
+func TestStaleDistribution(t *testing.T) {
+	group, alice := uuid.New(), uuid.New()
+	aliceRing, bobRing := senderkey.NewKeyring(), senderkey.NewKeyring()
+	old, _ := aliceRing.Distribution(group)
+	bobRing.Receive(alice, old)
+	before, _ := aliceRing.Encrypt(group, []byte("before rotation"))
+	if _, err := bobRing.Decrypt(group, alice, before); err != nil {
+		t.Fatal(err)
+	}
+	rotated, _ := aliceRing.Rotate(group)
+	bobRing.Receive(alice, rotated)
+
+	// Distribution of the replaced key arrives late, it must not rewind its chain
+	if err := bobRing.Receive(alice, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bobRing.Decrypt(group, alice, before); err == nil {
+		t.Error("replay accepted after late distribution")
+	}
+	after, _ := aliceRing.Encrypt(group, []byte("after rotation"))
+	if text, err := bobRing.Decrypt(group, alice, after); err != nil || string(text) != "after rotation" {
+		t.Errorf("unexpected %q: %v", text, err)
+	}
+}
@@ -0,0 +1,53 @@
+package chatapi
+
+import (
+	"fmt"
+	"novachat-server/novaprotocol"
+)
+
+type payload interface {
+	Validate() error
+}
+
+// NewJsonMessage validates payload and wraps it into json message of given type
+func NewJsonMessage[T payload](msgType string, p T) ([]byte, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return novaprotocol.NewJsonMessage(msgType, p)
+}
+
+func parse[T any, P interface {
+	*T
+	payload
+}](jsonMsg []byte) (*T, error) {
+	p, err := novaprotocol.ParseJsonMessage[T](jsonMsg)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, fmt.Errorf("invalid message: no data")
+	}
+	if err := P(p).Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Parse helpers reject messages failing validation
+
+func ParseMessage(jsonMsg []byte) (*Message, error) {
+	return parse[Message](jsonMsg)
+}
+
+func ParseEdit(jsonMsg []byte) (*Edit, error) {
+	return parse[Edit](jsonMsg)
+}
+
+func ParseDelete(jsonMsg []byte) (*Delete, error) {
+	return parse[Delete](jsonMsg)
+}
+
+func ParseReaction(jsonMsg []byte) (*Reaction, error) {
+	return parse[Reaction](jsonMsg)
+}
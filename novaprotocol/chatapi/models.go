@@ -0,0 +1,225 @@
+package chatapi
+
+import (
+	"encoding/hex"
+	"fmt"
+	"novachat-server/novaprotocol"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// Version of message schema written by this package. Messages without version
+// come from clients predating schema and carry text only
+const Version = 1
+
+// Peer to peer messages, always end-to-end encrypted, server only relays them.
+// Destination is peer or room
+const (
+	MSG_CHAT     = "ch_msg"
+	MSG_EDIT     = "ch_edit"
+	MSG_DELETE   = "ch_delete"
+	MSG_REACTION = "ch_react"
+)
+
+// Content formats
+const (
+	ContentText     = "text"
+	ContentMarkdown = "markdown"
+)
+
+const (
+	MaxTextLength   = 16 << 10 // bytes
+	MaxMentions     = 64
+	MaxAttachments  = 16
+	MaxReactionSize = 32 // bytes, enough for emoji sequences
+	maxFileNameSize = 255
+)
+
+var (
+	ErrorUnsupportedVersion = fmt.Errorf("invalid message: unsupported version")
+	ErrorNoID               = fmt.Errorf("invalid message: no id")
+	ErrorTextTooLong        = fmt.Errorf("invalid message: text too long")
+	ErrorInvalidText        = fmt.Errorf("invalid message: text is not valid utf-8")
+	ErrorEmptyMessage       = fmt.Errorf("invalid message: no text and no attachments")
+	ErrorInvalidContent     = fmt.Errorf("invalid message: unknown content format")
+	ErrorInvalidMention     = fmt.Errorf("invalid message: mention out of text")
+	ErrorInvalidAttachment  = fmt.Errorf("invalid message: invalid attachment")
+	ErrorInvalidReaction    = fmt.Errorf("invalid message: invalid reaction")
+	ErrorTooManyItems       = fmt.Errorf("invalid message: too many mentions or attachments")
+)
+
+// Message is chat message sent with MSG_CHAT
+type Message struct {
+	Version int       `json:"v"`
+	ID      uuid.UUID `json:"id"`
+	SentAt  time.Time `json:"sent_at"`
+	// ContentText if empty
+	Content string `json:"content,omitempty"`
+	Text    string `json:"text"`
+	// Message this one answers, also identifies thread
+	ReplyTo     uuid.UUID    `json:"reply_to,omitzero"`
+	Mentions    []Mention    `json:"mentions,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+// Mention marks part of text referring to client, offsets are in bytes
+type Mention struct {
+	Client uuid.UUID `json:"client"`
+	Offset int       `json:"offset"`
+	Length int       `json:"length"`
+}
+
+// Attachment references file sent with file frames
+type Attachment struct {
+	FileID uuid.UUID `json:"file_id"`
+	Name   string    `json:"name"`
+	Size   uint32    `json:"size"`
+	// Hex encoded sha256 of file, matches FileHash of file start frame
+	Hash     string `json:"hash"`
+	MimeType string `json:"mime_type,omitempty"`
+}
+
+// Edit replaces text of message sent earlier by the same client, sent with MSG_EDIT
+type Edit struct {
+	Version  int       `json:"v"`
+	ID       uuid.UUID `json:"id"`
+	EditedAt time.Time `json:"edited_at"`
+	Content  string    `json:"content,omitempty"`
+	Text     string    `json:"text"`
+	Mentions []Mention `json:"mentions,omitempty"`
+}
+
+// Delete removes message sent earlier by the same client, sent with MSG_DELETE
+type Delete struct {
+	Version   int       `json:"v"`
+	ID        uuid.UUID `json:"id"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// Reaction adds or removes reaction of sender to message, sent with MSG_REACTION
+type Reaction struct {
+	Version  int       `json:"v"`
+	ID       uuid.UUID `json:"id"`
+	Reaction string    `json:"reaction"`
+	Remove   bool      `json:"remove,omitempty"`
+}
+
+// NewMessage creates text message with fresh id
+func NewMessage(text string) *Message {
+	return &Message{Version: Version, ID: uuid.New(), SentAt: time.Now().UTC(), Text: text}
+}
+
+// NewAttachment references file announced by file start frame
+func NewAttachment(params novaprotocol.FileStartFrameParams, mimeType string) Attachment {
+	return Attachment{
+		FileID:   params.FileID,
+		Name:     params.FileName,
+		Size:     params.FileSize,
+		Hash:     hex.EncodeToString(params.FileHash[:]),
+		MimeType: mimeType,
+	}
+}
+
+func checkVersion(v int) error {
+	if v < 0 || v > Version {
+		return ErrorUnsupportedVersion
+	}
+	return nil
+}
+
+func checkText(content string, text string, mentions []Mention) error {
+	if content != "" && content != ContentText && content != ContentMarkdown {
+		return ErrorInvalidContent
+	}
+	if len(text) > MaxTextLength {
+		return ErrorTextTooLong
+	}
+	if !utf8.ValidString(text) {
+		return ErrorInvalidText
+	}
+	if len(mentions) > MaxMentions {
+		return ErrorTooManyItems
+	}
+	for _, m := range mentions {
+		end := m.Offset + m.Length
+		if m.Client == uuid.Nil || m.Offset < 0 || m.Length <= 0 || end > len(text) ||
+			!utf8.RuneStart(text[m.Offset]) || (end < len(text) && !utf8.RuneStart(text[end])) {
+			return ErrorInvalidMention
+		}
+	}
+	return nil
+}
+
+func (m *Message) Validate() error {
+	if err := checkVersion(m.Version); err != nil {
+		return err
+	}
+	if m.Version == 0 {
+		// Legacy message, only text is meaningful
+		return checkText("", m.Text, nil)
+	}
+	if m.ID == uuid.Nil {
+		return ErrorNoID
+	}
+	if m.Text == "" && len(m.Attachments) == 0 {
+		return ErrorEmptyMessage
+	}
+	if err := checkText(m.Content, m.Text, m.Mentions); err != nil {
+		return err
+	}
+	if len(m.Attachments) > MaxAttachments {
+		return ErrorTooManyItems
+	}
+	for _, a := range m.Attachments {
+		if hash, err := hex.DecodeString(a.Hash); err != nil || len(hash) != 32 {
+			return ErrorInvalidAttachment
+		}
+		if a.FileID == uuid.Nil || a.Name == "" || len(a.Name) > maxFileNameSize || !utf8.ValidString(a.Name) {
+			return ErrorInvalidAttachment
+		}
+	}
+	return nil
+}
+
+// IsMarkdown reports whether text should be rendered as markdown
+func (m *Message) IsMarkdown() bool {
+	return m.Content == ContentMarkdown
+}
+
+func (e *Edit) Validate() error {
+	if err := checkVersion(e.Version); err != nil {
+		return err
+	}
+	if e.ID == uuid.Nil {
+		return ErrorNoID
+	}
+	if e.Text == "" {
+		return ErrorEmptyMessage
+	}
+	return checkText(e.Content, e.Text, e.Mentions)
+}
+
+func (d *Delete) Validate() error {
+	if err := checkVersion(d.Version); err != nil {
+		return err
+	}
+	if d.ID == uuid.Nil {
+		return ErrorNoID
+	}
+	return nil
+}
+
+func (r *Reaction) Validate() error {
+	if err := checkVersion(r.Version); err != nil {
+		return err
+	}
+	if r.ID == uuid.Nil {
+		return ErrorNoID
+	}
+	if r.Reaction == "" || len(r.Reaction) > MaxReactionSize || !utf8.ValidString(r.Reaction) {
+		return ErrorInvalidReaction
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package chatapi_test
+
+import (
+	"errors"
+	"novachat-server/novaprotocol"
+	"novachat-server/novaprotocol/chatapi"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	msg := chatapi.NewMessage("hi @bob")
+	msg.Content = chatapi.ContentMarkdown
+	msg.ReplyTo = uuid.New()
+	msg.Mentions = []chatapi.Mention{{Client: uuid.New(), Offset: 3, Length: 4}}
+	msg.Attachments = []chatapi.Attachment{chatapi.NewAttachment(novaprotocol.FileStartFrameParams{
+		FileSize: 3, BlocksCount: 1, FileName: "a.txt", FileID: uuid.New(),
+	}, "text/plain")}
+
+	data, err := chatapi.NewJsonMessage(chatapi.MSG_CHAT, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := chatapi.ParseMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.ID != msg.ID || parsed.ReplyTo != msg.ReplyTo || !parsed.IsMarkdown() ||
+		len(parsed.Mentions) != 1 || len(parsed.Attachments) != 1 || parsed.Attachments[0] != msg.Attachments[0] {
+		t.Errorf("message changed: %+v", parsed)
+	}
+
+	// Message without reply has no reply_to field
+	data, _ = chatapi.NewJsonMessage(chatapi.MSG_CHAT, chatapi.NewMessage("plain"))
+	if strings.Contains(string(data), "reply_to") {
+		t.Errorf("unexpected reply_to in %s", data)
+	}
+}
+
+func TestLegacyMessage(t *testing.T) {
+	msg, err := chatapi.ParseMessage([]byte(`{"data":{"text":"old client"},"type":"ch_msg"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Text != "old client" {
+		t.Errorf("unexpected text %q", msg.Text)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	id := uuid.New()
+	valid := func() *chatapi.Message {
+		return &chatapi.Message{Version: chatapi.Version, ID: id, Text: "héllo"}
+	}
+	tests := []struct {
+		name   string
+		modify func(m *chatapi.Message)
+		err    error
+	}{
+		{"valid", func(m *chatapi.Message) {}, nil},
+		{"future version", func(m *chatapi.Message) { m.Version = chatapi.Version + 1 }, chatapi.ErrorUnsupportedVersion},
+		{"no id", func(m *chatapi.Message) { m.ID = uuid.Nil }, chatapi.ErrorNoID},
+		{"empty", func(m *chatapi.Message) { m.Text = "" }, chatapi.ErrorEmptyMessage},
+		{"too long", func(m *chatapi.Message) { m.Text = strings.Repeat("a", chatapi.MaxTextLength+1) }, chatapi.ErrorTextTooLong},
+		{"bad utf8", func(m *chatapi.Message) { m.Text = "\xff" }, chatapi.ErrorInvalidText},
+		{"bad content", func(m *chatapi.Message) { m.Content = "html" }, chatapi.ErrorInvalidContent},
+		{"mention out of text", func(m *chatapi.Message) {
+			m.Mentions = []chatapi.Mention{{Client: uuid.New(), Offset: 4, Length: 10}}
+		}, chatapi.ErrorInvalidMention},
+		{"mention inside rune", func(m *chatapi.Message) {
+			m.Mentions = []chatapi.Mention{{Client: uuid.New(), Offset: 2, Length: 1}}
+		}, chatapi.ErrorInvalidMention},
+		{"attachment without hash", func(m *chatapi.Message) {
+			m.Attachments = []chatapi.Attachment{{FileID: uuid.New(), Name: "a"}}
+		}, chatapi.ErrorInvalidAttachment},
+	}
+	for _, test := range tests {
+		msg := valid()
+		test.modify(msg)
+		if err := msg.Validate(); !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	if err := (&chatapi.Reaction{Version: chatapi.Version, ID: id, Reaction: ""}).Validate(); !errors.Is(err, chatapi.ErrorInvalidReaction) {
+		t.Errorf("empty reaction: got %v", err)
+	}
+	if err := (&chatapi.Edit{Version: chatapi.Version, ID: id, Text: "fixed"}).Validate(); err != nil {
+		t.Errorf("edit: %v", err)
+	}
+	if _, err := chatapi.NewJsonMessage(chatapi.MSG_DELETE, &chatapi.Delete{Version: chatapi.Version}); !errors.Is(err, chatapi.ErrorNoID) {
+		t.Errorf("delete without id: got %v", err)
+	}
+}
@@ -6,8 +6,74 @@ import (
 	"crypto/rand"
 	"fmt"
 	"io"
+	"sync/atomic"
+	"time"
 )
 
+// RekeyGrace is how long frames encrypted with previous transport key are accepted after rekey
+const RekeyGrace = 30 * time.Second
+
+// TransportKeys holds key of encrypted transport, zero value has no key.
+// Key is switched atomically, frames the peer sent before it switched are still decrypted for RekeyGrace
+type TransportKeys struct {
+	state atomic.Pointer[transportState]
+}
+
+type transportState struct {
+	encrypt    CryptFunc
+	decrypt    CryptFunc
+	previous   CryptFunc
+	switchedAt time.Time
+	// Frames and bytes sealed or opened with the key
+	frames atomic.Uint64
+	bytes  atomic.Uint64
+}
+
+// SetKey switches to new key, previous one is kept for decryption only
+func (k *TransportKeys) SetKey(key []byte) {
+	s := &transportState{switchedAt: time.Now()}
+	s.encrypt, s.decrypt = NewCryptoFuncs(key)
+	if old := k.state.Load(); old != nil {
+		s.previous = old.decrypt
+	}
+	k.state.Store(s)
+}
+
+func (k *TransportKeys) Encrypt(data []byte) ([]byte, error) {
+	s := k.state.Load()
+	if s == nil {
+		return nil, fmt.Errorf("no encrypt func")
+	}
+	s.frames.Add(1)
+	s.bytes.Add(uint64(len(data)))
+	return s.encrypt(data)
+}
+
+func (k *TransportKeys) Decrypt(data []byte) ([]byte, error) {
+	s := k.state.Load()
+	if s == nil {
+		return nil, fmt.Errorf("no decrypt func")
+	}
+	plaintext, err := s.decrypt(data)
+	if err != nil && s.previous != nil && time.Since(s.switchedAt) < RekeyGrace {
+		plaintext, err = s.previous(data)
+	}
+	if err == nil {
+		s.frames.Add(1)
+		s.bytes.Add(uint64(len(plaintext)))
+	}
+	return plaintext, err
+}
+
+// Usage reports traffic protected by current key and when it was set
+func (k *TransportKeys) Usage() (frames, bytes uint64, since time.Time) {
+	s := k.state.Load()
+	if s == nil {
+		return 0, 0, time.Time{}
+	}
+	return s.frames.Load(), s.bytes.Load(), s.switchedAt
+}
+
 func NewCryptoFuncs(key []byte) (encrypt CryptFunc, decrypt CryptFunc) {
 	encrypt = func(b []byte) ([]byte, error) {
 		return encryptAES256(key, b)
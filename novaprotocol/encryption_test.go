@@ -0,0 +1,39 @@
+package novaprotocol_test
+
+import (
+	"bytes"
+	"novachat-server/novaprotocol"
+	"testing"
+)
+
+func TestTransportKeysRekey(t *testing.T) {
+	var sender, receiver novaprotocol.TransportKeys
+	if _, err := sender.Encrypt([]byte("x")); err == nil {
+		t.Fatal("encrypted without key")
+	}
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	sender.SetKey(oldKey)
+	receiver.SetKey(oldKey)
+
+	inFlight, _ := sender.Encrypt([]byte("in flight"))
+	sender.SetKey(newKey)
+	fresh, _ := sender.Encrypt([]byte("fresh"))
+	receiver.SetKey(newKey)
+
+	// Frame sealed before sender switched still opens after receiver switched
+	for _, frame := range [][]byte{fresh, inFlight} {
+		if _, err := receiver.Decrypt(frame); err != nil {
+			t.Errorf("frame dropped after rekey: %v", err)
+		}
+	}
+	frames, size, _ := receiver.Usage()
+	if frames != 2 || size != uint64(len("in flight")+len("fresh")) {
+		t.Errorf("unexpected usage: %d frames, %d bytes", frames, size)
+	}
+
+	// Only one previous key is kept
+	receiver.SetKey(bytes.Repeat([]byte{3}, 32))
+	if _, err := receiver.Decrypt(inFlight); err == nil {
+		t.Error("frame of retired key decrypted")
+	}
+}
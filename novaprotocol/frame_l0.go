@@ -1,7 +1,6 @@
 package novaprotocol
 
 import (
-	"bytes"
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
@@ -210,41 +209,30 @@ func ParseL0Frame(data []byte, decryptFunc CryptFunc) (*NovaFrameL0, error) {
 	}, nil
 }
 
+// ReadL0Frame reads exactly one frame, so it works on streams (tcp) as well as on message based transports.
+// io.EOF is returned only if stream ends on frame boundary
 func ReadL0Frame(r io.Reader, decryptFunc CryptFunc) (*NovaFrameL0, error) {
-	buf := make([]byte, 0124)
-	var completeMessage bytes.Buffer
-
-	firstPacket := true
-	totalRead := 0
-	targetRead := uint32(0)
-
-	for {
-		n, err := r.Read(buf)
-		if err != nil {
-			if err == io.EOF && totalRead > 0 {
-				return nil, io.EOF
-			}
-			return nil, err
-		}
+	sizeField := make([]byte, l0sizeFieldSize)
+	if _, err := io.ReadFull(r, sizeField); err != nil {
+		return nil, err
+	}
 
-		totalRead += n
-		completeMessage.Write(buf[:n])
-
-		if firstPacket {
-			if len(buf) < l0headerSize {
-				return nil, ErrorFrameNoHeader
-			}
-			firstPacket = false
-			targetRead = binary.LittleEndian.Uint32(buf[:4])
-			if targetRead > l0MaxFrameSize {
-				return nil, ErrorFrameTooLarge
-			}
-		}
+	targetRead := binary.LittleEndian.Uint32(sizeField)
+	if targetRead > l0MaxFrameSize {
+		return nil, ErrorFrameTooLarge
+	}
+	if targetRead < l0minFrameSize {
+		return nil, ErrorFrameNoHeader
+	}
 
-		if uint32(totalRead) >= targetRead {
-			break
+	frameData := make([]byte, targetRead)
+	copy(frameData, sizeField)
+	if _, err := io.ReadFull(r, frameData[l0sizeFieldSize:]); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
 		}
+		return nil, err
 	}
 
-	return ParseL0Frame(completeMessage.Bytes(), decryptFunc)
+	return ParseL0Frame(frameData, decryptFunc)
 }
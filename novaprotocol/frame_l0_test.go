@@ -1,9 +1,12 @@
 package novaprotocol_test
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"novachat-server/novaprotocol"
 	"testing"
+	"testing/iotest"
 
 	"github.com/google/uuid"
 )
@@ -38,3 +41,29 @@ func TestL0BuildParse(t *testing.T) {
 	fmt.Println(string(frame.GetData()))
 
 }
+
+func TestL0ReadStream(t *testing.T) {
+	var stream bytes.Buffer
+	for _, text := range []string{"first frame", "second frame"} {
+		if err := novaprotocol.NewL0Frame(novaprotocol.L0FlagNone, uuid.Max, []byte(text)).Write(&stream, nil); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	// Frames are glued together and arrive byte by byte, like on tcp
+	r := iotest.OneByteReader(&stream)
+	for _, text := range []string{"first frame", "second frame"} {
+		frame, err := novaprotocol.ReadL0Frame(r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if string(frame.GetData()) != text {
+			t.Errorf("data missmatch: %q", frame.GetData())
+		}
+	}
+	if _, err := novaprotocol.ReadL0Frame(r, nil); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
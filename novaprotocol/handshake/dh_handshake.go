@@ -16,14 +16,19 @@ var (
 
 // Генерация ключевой пары
 func GenerateKeyPair(g, p *big.Int) (private, public *big.Int, err error) {
-	private, err = rand.Int(rand.Reader, Prime2048)
+	private, err = rand.Int(rand.Reader, p)
 	if err != nil {
 		return nil, nil, err
 	}
-	public = new(big.Int).Exp(g, p, Prime2048)
+	public = new(big.Int).Exp(g, private, p)
 	return private, public, nil
 }
 
+// ValidPublicKey reports whether peer public key is in [2, p-2], 0, 1 and p-1 force a predictable shared key
+func ValidPublicKey(public *big.Int) bool {
+	return public.Cmp(big.NewInt(1)) > 0 && public.Cmp(new(big.Int).Sub(Prime2048, big.NewInt(1))) < 0
+}
+
 // Вычисление общего ключа
 func ComputeSharedKey(private, peerPublic *big.Int) []byte {
 	sharedSecret := new(big.Int).Exp(peerPublic, private, Prime2048)
@@ -51,9 +56,33 @@ type PublicKeyClient2Server struct {
 	Hash string `json:"hash,omitempty"`
 }
 
+// Optional protocol features, client and server use the ones both of them support
+const (
+	CapPresence       = "presence"
+	CapNicknameChange = "nick_change"
+	CapPing           = "ping"
+	CapRooms          = "rooms"
+	CapHistory        = "history"
+	CapAccounts       = "accounts"
+	CapRekey          = "rekey"
+	// Server answers accepted MSG_WELCOME_ACCEPT with serverapi.Client holding canonical nickname
+	CapWelcomeAck = "welcome_ack"
+)
+
+// Rekey carries ephemeral public key of MSG_REKEY in both directions
+type Rekey struct {
+	Pub string `json:"pub"`
+}
+
+type JoinClient2Server struct {
+	Token string `json:"token"`
+}
+
 type WelcomeInviteServer2Client struct {
-	UserID uuid.UUID `json:"user_id"`
+	UserID       uuid.UUID `json:"user_id"`
+	Capabilities []string  `json:"capabilities,omitempty"`
 }
 type WelcomeAcceptClient2Server struct {
-	Nickname string `json:"nickname"`
+	Nickname     string   `json:"nickname"`
+	Capabilities []string `json:"capabilities,omitempty"`
 }
@@ -0,0 +1,39 @@
+package handshake_test
+
+import (
+	"bytes"
+	"math/big"
+	"novachat-server/novaprotocol/handshake"
+	"testing"
+)
+
+// Public key used to be g^p, the same for every peer, so every session derived one shared key
+func TestGenerateKeyPair(t *testing.T) {
+	alicePrivate, alicePublic, err := handshake.GenerateKeyPair(handshake.Generator2048, handshake.Prime2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobPrivate, bobPublic, _ := handshake.GenerateKeyPair(handshake.Generator2048, handshake.Prime2048)
+	if alicePublic.Cmp(bobPublic) == 0 {
+		t.Fatal("public key does not depend on private key")
+	}
+	if alicePublic.Cmp(new(big.Int).Exp(handshake.Generator2048, alicePrivate, handshake.Prime2048)) != 0 {
+		t.Error("public key is not g^private mod p")
+	}
+	if !bytes.Equal(handshake.ComputeSharedKey(alicePrivate, bobPublic), handshake.ComputeSharedKey(bobPrivate, alicePublic)) {
+		t.Error("peers derived different shared keys")
+	}
+}
+
+func TestValidPublicKey(t *testing.T) {
+	pMinus1 := new(big.Int).Sub(handshake.Prime2048, big.NewInt(1))
+	for _, public := range []*big.Int{big.NewInt(-1), big.NewInt(0), big.NewInt(1), pMinus1, handshake.Prime2048} {
+		if handshake.ValidPublicKey(public) {
+			t.Errorf("degenerate key %s accepted", public.Text(16))
+		}
+	}
+	_, public, _ := handshake.GenerateKeyPair(handshake.Generator2048, handshake.Prime2048)
+	if !handshake.ValidPublicKey(public) {
+		t.Error("generated key rejected")
+	}
+}
@@ -1,11 +1,283 @@
 package serverapi
 
-import "github.com/google/uuid"
+import (
+	"time"
 
+	"github.com/google/uuid"
+)
+
+const (
+	PresenceOnline        = "online"
+	PresenceIdle          = "idle"
+	PresenceAway          = "away"
+	PresenceTypingStarted = "typing_started"
+	PresenceTypingStopped = "typing_stopped"
+)
+
+const (
+	ErrorNicknameInvalid = "nickname_invalid"
+	ErrorNicknameTaken   = "nickname_taken"
+	ErrorUnauthorized    = "unauthorized"
+	ErrorBanned          = "banned"
+	ErrorNotFound        = "not_found"
+	ErrorBadRequest      = "bad_request"
+	ErrorRateLimited     = "rate_limited"
+	ErrorServerFull      = "server_full"
+	ErrorTooManyConns    = "too_many_connections"
+)
+
+const (
+	BanKindIP = "ip"
+	// Identity ban blocks nickname and its lookalikes on welcome and rename.
+	// It is advisory only, banned user may connect under another nickname
+	BanKindIdentity = "identity"
+)
+
+// Error is sent by server when request can not be fulfilled.
+// Request contains type of the failed message
+type Error struct {
+	Request string `json:"request"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type RoomJoin struct {
+	Name string `json:"name"`
+}
+
+type RoomLeave struct {
+	ID uuid.UUID `json:"id"`
+}
+
+// Room id is derived from name, so every node agrees on it
+type Room struct {
+	ID   uuid.UUID `json:"id"`
+	Name string    `json:"name"`
+}
+
+// RoomMember is sent to room members when somebody joins or leaves
+type RoomMember struct {
+	Room   Room   `json:"room"`
+	Client Client `json:"client"`
+}
+
+// MessageOp is stored message operation, ID is chat message id and Frame is l1 frame relayed to Destination.
+// Edit and delete are allowed to author of message only, deleted message stays in history as tombstone.
+// Author is account of signed in device, so it keeps its messages after reconnect, anonymous client only within connection
+type MessageOp struct {
+	ID          uuid.UUID `json:"id"`
+	Destination uuid.UUID `json:"destination"`
+	Frame       []byte    `json:"frame"`
+	// Message answered by this one, only used when message is sent
+	ReplyTo uuid.UUID `json:"reply_to,omitzero"`
+}
+
+// MessageStored acknowledges MessageOp
+type MessageStored struct {
+	ID           uuid.UUID `json:"id"`
+	Conversation uuid.UUID `json:"conversation"`
+}
+
+// HistoryRequest asks for page of conversation with peer client, peer account or joined room. Conversations of
+// signed in devices are kept per account and survive reconnects of both sides. Page ends right before
+// message Before or starts right after message After, without both of them it holds the latest messages.
+// Non-nil Thread limits page to thread root and its replies
+type HistoryRequest struct {
+	With   uuid.UUID `json:"with"`
+	Thread uuid.UUID `json:"thread,omitzero"`
+	Before uuid.UUID `json:"before,omitzero"`
+	After  uuid.UUID `json:"after,omitzero"`
+	Limit  int       `json:"limit,omitempty"`
+}
+
+// HistoryPage holds messages oldest first, More is true if there are messages beyond the page
+// in requested direction
+type HistoryPage struct {
+	With         uuid.UUID       `json:"with"`
+	Conversation uuid.UUID       `json:"conversation"`
+	Thread       uuid.UUID       `json:"thread,omitzero"`
+	Messages     []StoredMessage `json:"messages"`
+	More         bool            `json:"more"`
+}
+
+// StoredMessage carries frames as they were sent, client decrypts them and applies Edit and Reactions.
+// Deleted message is tombstone without frames
+type StoredMessage struct {
+	ID          uuid.UUID        `json:"id"`
+	Origin      uuid.UUID        `json:"origin"`
+	Author      uuid.UUID        `json:"author,omitzero"` // Stable id of sender, see MessageOp
+	Destination uuid.UUID        `json:"destination"`
+	SentAt      time.Time        `json:"sent_at"`
+	ReplyTo     uuid.UUID        `json:"reply_to,omitzero"`
+	Thread      uuid.UUID        `json:"thread,omitzero"`
+	Frame       []byte           `json:"frame,omitempty"`
+	Edit        []byte           `json:"edit,omitempty"`
+	EditedAt    time.Time        `json:"edited_at,omitzero"`
+	Reactions   []StoredReaction `json:"reactions,omitempty"`
+	Deleted     bool             `json:"deleted,omitempty"`
+	DeletedAt   time.Time        `json:"deleted_at,omitzero"`
+}
+type StoredReaction struct {
+	Client uuid.UUID `json:"client"`
+	Frame  []byte    `json:"frame"`
+	At     time.Time `json:"at"`
+}
+
+type BotText struct {
+	Text string `json:"text"`
+}
+
+// Client is one connection, Account is set when it is signed in device of account
 type Client struct {
-	ID       uuid.UUID `json:"id"`
-	Nickname string    `json:"nickname"`
+	ID         uuid.UUID `json:"id"`
+	Nickname   string    `json:"nickname"`
+	Account    uuid.UUID `json:"account,omitzero"`
+	Status     string    `json:"status,omitempty"`
+	StatusText string    `json:"status_text,omitempty"`
 }
 type ListClientsResponse struct {
 	Clients []Client `json:"clients"`
 }
+
+// Presence is sent by client to server and fanned out by server to peers.
+// Peer limits delivery to one client (typing in a private chat), uuid.Nil means everyone
+type Presence struct {
+	ID    uuid.UUID `json:"id"`
+	State string    `json:"state"`
+	Text  string    `json:"text,omitempty"`
+	Peer  uuid.UUID `json:"peer,omitempty"`
+}
+
+type NicknameChange struct {
+	Nickname string `json:"nickname"`
+}
+type NicknameChanged struct {
+	ID          uuid.UUID `json:"id"`
+	Nickname    string    `json:"nickname"`
+	OldNickname string    `json:"old_nickname"`
+}
+
+type Ping struct {
+	Seq uint64 `json:"seq"`
+}
+
+// Status is served by /status http endpoint
+type Status struct {
+	Ready     bool           `json:"ready"`
+	StartedAt time.Time      `json:"started_at"`
+	Clients   []ClientStatus `json:"clients"`
+}
+type ClientStatus struct {
+	ID           uuid.UUID `json:"id"`
+	Nickname     string    `json:"nickname"`
+	RemoteAddr   string    `json:"remote_addr"`
+	ConnectedAt  time.Time `json:"connected_at"`
+	BytesIn      uint64    `json:"bytes_in"`
+	BytesOut     uint64    `json:"bytes_out"`
+	Capabilities []string  `json:"capabilities"`
+}
+
+// PostMessage is body of POST /api/v1/messages, text goes to client with given id or to room with given name
+type PostMessage struct {
+	Client uuid.UUID `json:"client"`
+	Room   string    `json:"room,omitempty"`
+	Text   string    `json:"text"`
+}
+type PostMessageResponse struct {
+	Origin      uuid.UUID `json:"origin"`
+	Destination uuid.UUID `json:"destination"`
+}
+
+type AccountCreate struct {
+	DeviceName string `json:"device_name"`
+}
+
+// DeviceCredentials sign device in with MSG_DEVICE_LOGIN, server sends token only once, when device is created
+type DeviceCredentials struct {
+	Account uuid.UUID `json:"account"`
+	Device  uuid.UUID `json:"device"`
+	Token   string    `json:"token"`
+}
+
+// Device of account, Client is its connection while it is online
+type Device struct {
+	ID        uuid.UUID `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	RevokedAt time.Time `json:"revoked_at,omitzero"`
+	Client    uuid.UUID `json:"client,omitzero"`
+}
+
+// DeviceLinkCode is shown by signed in device as text or QR code and typed or scanned by new device
+type DeviceLinkCode struct {
+	Code      string    `json:"code"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// DeviceLink is sent by new device, Name is how it appears in device list
+type DeviceLink struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+}
+
+// DeviceLinkRequest asks issuer of the code to confirm new device
+type DeviceLinkRequest struct {
+	Code       string    `json:"code"`
+	Name       string    `json:"name"`
+	Client     uuid.UUID `json:"client"`
+	RemoteAddr string    `json:"remote_addr"`
+}
+type DeviceLinkConfirm struct {
+	Code    string `json:"code"`
+	Approve bool   `json:"approve"`
+}
+
+type DeviceRevoke struct {
+	ID uuid.UUID `json:"id"`
+}
+
+// AccountFrames is data of L0 frame addressed to account. Devices have their own session keys,
+// so sender seals L1 frame for every device it exchanged keys with, keyed by device connection id.
+// Server delivers each device only its own frame, devices missing from Frames get nothing
+type AccountFrames struct {
+	Frames map[uuid.UUID][]byte `json:"frames"`
+}
+
+type Kicked struct {
+	Reason string `json:"reason"`
+}
+
+type AdminAuth struct {
+	Token string `json:"token"`
+}
+type AdminKick struct {
+	ID     uuid.UUID `json:"id"`
+	Reason string    `json:"reason"`
+}
+
+// AdminBan bans Value of given Kind, or, if ID is set, IP or identity of connected client.
+// Zero Duration bans forever
+type AdminBan struct {
+	ID       uuid.UUID `json:"id,omitempty"`
+	Kind     string    `json:"kind"`
+	Value    string    `json:"value,omitempty"`
+	Duration int64     `json:"duration,omitempty"` // seconds
+	Reason   string    `json:"reason"`
+}
+type AdminUnban struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+// AdminMute drops frames relayed by client for Duration seconds, zero Duration lifts the mute
+type AdminMute struct {
+	ID       uuid.UUID `json:"id"`
+	Duration int64     `json:"duration"`
+}
+
+type Ban struct {
+	Kind      string    `json:"kind"`
+	Value     string    `json:"value"`
+	Reason    string    `json:"reason"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
@@ -9,14 +9,77 @@ const (
 
 const (
 	// Client->Server|Server->Client
-	MSG_DH_PUB = "dh_pub" // The only unencrypted message
+	MSG_DH_PUB = "dh_pub" // Unencrypted, as are admission messages
+
+	// Admission, before key exchange. Join request is sent only if server requires join token,
+	// rejections are MSG_ERROR with MSG_JOIN request
+	MSG_JOIN_REQUEST = "srv_join_request"
+	MSG_JOIN         = "srv_join"
 
 	MSG_WELCOME_INVITE = "srv_welcome_invite"
+	// Rejected nickname is answered with MSG_ERROR so client may retry,
+	// accepted one is echoed back only with handshake.CapWelcomeAck negotiated
 	MSG_WELCOME_ACCEPT = "srv_welcome_accept"
 
+	MSG_ERROR = "srv_error"
+
 	MSG_NEW_CONNECTION  = "srv_new_conn"
 	MSG_CONNECTION_LOST = "src_conn_lost"
 	MSG_LIST_CONN       = "srv_conn_list"
+
+	// Heartbeat, both sides may ping, other side answers with pong carrying the same seq
+	MSG_PING = "srv_ping"
+	MSG_PONG = "srv_pong"
+
+	// Fresh key exchange over encrypted transport. Server sends its public key, client answers with its own
+	// and switches to new key right after the answer, server switches once it gets the answer
+	MSG_REKEY = "srv_rekey"
+
+	MSG_PRESENCE = "srv_presence" // Ephemeral, never persisted
+
+	MSG_NICKNAME_CHANGE  = "srv_nick_change"
+	MSG_NICKNAME_CHANGED = "srv_nick_changed"
+
+	MSG_KICKED = "srv_kicked"
+
+	// Rooms are addressed by id as L0 destination, members get frames with room id as destination
+	MSG_ROOM_JOIN   = "srv_room_join"
+	MSG_ROOM_LEAVE  = "srv_room_leave"
+	MSG_ROOM_JOINED = "srv_room_joined"
+	MSG_ROOM_LEFT   = "srv_room_left"
+
+	// Stored messages, server keeps them in history and relays Frame to Destination as if
+	// client sent it directly. Answered with the same type on success
+	MSG_MESSAGE_SEND   = "srv_msg_send"
+	MSG_MESSAGE_EDIT   = "srv_msg_edit"
+	MSG_MESSAGE_DELETE = "srv_msg_delete"
+	MSG_MESSAGE_REACT  = "srv_msg_react"
+	// Page of stored messages of conversation with peer or room, answered with the same type
+	MSG_HISTORY = "srv_history"
+
+	// Accounts group devices, every device connects as its own client with its own session key.
+	// Frames addressed to account id carry serverapi.AccountFrames, every online device of it gets the frame sealed for it
+	MSG_ACCOUNT_CREATE = "srv_account_create"
+	MSG_DEVICE_LOGIN   = "srv_device_login"
+	// Linking: signed in device gets short code, new device sends it with MSG_DEVICE_LINK, server passes
+	// MSG_DEVICE_LINK_REQUEST to the code issuer and answers new device with credentials once issuer confirms it
+	MSG_DEVICE_LINK_CODE    = "srv_device_link_code"
+	MSG_DEVICE_LINK         = "srv_device_link"
+	MSG_DEVICE_LINK_REQUEST = "srv_device_link_request"
+	MSG_DEVICE_LINK_CONFIRM = "srv_device_link_confirm"
+	MSG_DEVICE_LIST         = "srv_device_list"
+	MSG_DEVICE_REVOKE       = "srv_device_revoke"
+
+	// Unencrypted text from server side bot, origin is the bot
+	MSG_BOT_TEXT = "bot_text"
+
+	// Moderation, require admin role
+	MSG_ADMIN_AUTH      = "adm_auth"
+	MSG_ADMIN_KICK      = "adm_kick"
+	MSG_ADMIN_BAN       = "adm_ban"
+	MSG_ADMIN_UNBAN     = "adm_unban"
+	MSG_ADMIN_LIST_BANS = "adm_ban_list"
+	MSG_ADMIN_MUTE      = "adm_mute"
 )
 
 // CryptFunc represents encryption/decryption function signature